@@ -0,0 +1,94 @@
+package flashx
+
+import (
+	"net"
+	"net/http"
+)
+
+// Reasons for which a request can be denied
+const (
+	// DenialBlacklisted is the reason of the requests
+	// coming from an IP of BlacklistIPs
+	DenialBlacklisted = "blacklisted"
+
+	// DenialNotWhitelisted is the reason of the requests coming
+	// from an IP that is not in WhitelistIPs
+	DenialNotWhitelisted = "not_whitelisted"
+
+	// DenialRateLimited is the reason of the requests coming from
+	// a client that went over NumberOfRequestsPerSecondPerClient
+	DenialRateLimited = "rate_limited"
+)
+
+// DeniedResponse describes the response written
+// for the requests that are denied
+type DeniedResponse struct {
+	// StatusCode is the status code of the response
+	// If not set, 429 Too Many Requests is used for the rate
+	// limited requests and 403 Forbidden for the other ones
+	StatusCode int
+
+	// Header holds the headers of the response
+	Header http.Header
+
+	// Body is the body of the response
+	Body []byte
+}
+
+// AccessDenial describes a request that was denied
+type AccessDenial struct {
+	// IP is the IP the request came from
+	IP net.IP
+
+	// Reason tells why the request was denied, such as
+	// DenialBlacklisted, DenialNotWhitelisted or DenialRateLimited
+	Reason string
+}
+
+// blacklist denies the requests coming from a blacklisted IP, or from
+// an IP that is not whitelisted, and reports whether the request was
+// denied. A denied request must not be routed
+func (e *Engine) blacklist(writer http.ResponseWriter, request *http.Request) bool {
+	e.mu.RLock()
+	blacklistSet, whitelistSet := e.blacklistSet, e.whitelistSet
+	e.mu.RUnlock()
+	if blacklistSet == nil && whitelistSet == nil {
+		return false
+	}
+	ip := ClientIP(request)
+	switch {
+	case blacklistSet.contains(ip):
+		e.deny(writer, request, AccessDenial{IP: ip, Reason: DenialBlacklisted})
+	case whitelistSet != nil && !whitelistSet.contains(ip):
+		e.deny(writer, request, AccessDenial{IP: ip, Reason: DenialNotWhitelisted})
+	default:
+		return false
+	}
+	return true
+}
+
+// deny reports the denial to OnAccessDenied and writes DeniedResponse
+func (e *Engine) deny(writer http.ResponseWriter, request *http.Request, denial AccessDenial) {
+	if e.OnAccessDenied != nil {
+		e.OnAccessDenied(request, denial)
+	}
+	statusCode := http.StatusForbidden
+	if denial.Reason == DenialRateLimited {
+		statusCode = http.StatusTooManyRequests
+	}
+	response := e.DeniedResponse
+	if response == nil {
+		writer.WriteHeader(statusCode)
+		return
+	}
+	for key, values := range response.Header {
+		for _, value := range values {
+			writer.Header().Add(key, value)
+		}
+	}
+	if response.StatusCode != 0 {
+		statusCode = response.StatusCode
+	}
+	writer.WriteHeader(statusCode)
+	writer.Write(response.Body)
+}
@@ -0,0 +1,107 @@
+package flashx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEngine_Initiate_denied(t *testing.T) {
+	var hits int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	var denials []AccessDenial
+	tests := []struct {
+		name           string
+		deniedResponse *DeniedResponse
+		wantStatus     int
+		wantBody       string
+		wantHeader     string
+	}{
+		{name: "default response", wantStatus: http.StatusForbidden},
+		{
+			name: "custom response",
+			deniedResponse: &DeniedResponse{
+				StatusCode: http.StatusUnavailableForLegalReasons,
+				Header:     http.Header{"Content-Type": {"application/json"}},
+				Body:       []byte(`{"error":"denied"}`),
+			},
+			wantStatus: http.StatusUnavailableForLegalReasons,
+			wantBody:   `{"error":"denied"}`,
+			wantHeader: "application/json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Engine{
+				URLs:           []string{server.URL},
+				BlacklistIPs:   []string{"192.168.1.0/24"},
+				DeniedResponse: tt.deniedResponse,
+				OnAccessDenied: func(request *http.Request, denial AccessDenial) {
+					denials = append(denials, denial)
+				},
+			}
+			if err := e.Setup(); err != nil {
+				t.Fatalf("Engine.Setup() error = %v", err)
+			}
+			defer e.Close()
+
+			for _, initiate := range []func(http.ResponseWriter, *http.Request){
+				e.Initiate,
+				func(w http.ResponseWriter, r *http.Request) { e.InitiateOverride(w, r, serverURL) },
+			} {
+				request := httptest.NewRequest("GET", "http://flashx/", nil)
+				request.RemoteAddr = "192.168.1.7:5678"
+				w := httptest.NewRecorder()
+				initiate(w, request)
+				if w.Code != tt.wantStatus {
+					t.Errorf("Engine.Initiate() status = %v, want %v", w.Code, tt.wantStatus)
+				}
+				if w.Body.String() != tt.wantBody {
+					t.Errorf("Engine.Initiate() body = %v, want %v", w.Body.String(), tt.wantBody)
+				}
+				if got := w.Header().Get("Content-Type"); got != tt.wantHeader {
+					t.Errorf("Engine.Initiate() Content-Type = %v, want %v", got, tt.wantHeader)
+				}
+			}
+		})
+	}
+
+	if got := atomic.LoadInt64(&hits); got != 0 {
+		t.Errorf("denied requests reached the URL %v times, want 0", got)
+	}
+	if len(denials) != 4 {
+		t.Fatalf("OnAccessDenied was called %v times, want 4", len(denials))
+	}
+	if denial := denials[0]; denial.Reason != DenialBlacklisted || denial.IP.String() != "192.168.1.7" {
+		t.Errorf("OnAccessDenied() denial = %+v, want 192.168.1.7 blacklisted", denial)
+	}
+}
+
+func TestEngine_blacklist_notWhitelisted(t *testing.T) {
+	var got AccessDenial
+	e := &Engine{
+		URLs:           []string{"http://localhost:3000"},
+		WhitelistIPs:   []string{"10.0.0.0/8"},
+		OnAccessDenied: func(request *http.Request, denial AccessDenial) { got = denial },
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	request := httptest.NewRequest("GET", "http://flashx/", nil)
+	request.RemoteAddr = "[2001:db8::1]:5678"
+	if !e.blacklist(httptest.NewRecorder(), request) {
+		t.Fatal("Engine.blacklist() = false, want the request to be denied")
+	}
+	if got.Reason != DenialNotWhitelisted {
+		t.Errorf("OnAccessDenied() reason = %v, want %v", got.Reason, DenialNotWhitelisted)
+	}
+}
@@ -0,0 +1,295 @@
+package flashx
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// BackendStatus describes the state of a URL of the pool
+type BackendStatus struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+
+	// Healthy is false while health checks report the URL as unhealthy
+	Healthy bool `json:"healthy"`
+
+	// Ejected is set while outlier detection ejects the URL
+	Ejected bool `json:"ejected"`
+
+	// Circuit holds the state of the circuit breaker of the URL,
+	// either "closed", "open" or "half-open"
+	Circuit string `json:"circuit"`
+
+	// Draining is set while the URL is being drained
+	Draining bool `json:"draining"`
+
+	// Active holds the number of requests in flight
+	Active int64 `json:"active"`
+
+	// Requests and Failures count the requests the URL
+	// served, and the ones it failed to serve
+	Requests int64 `json:"requests"`
+	Failures int64 `json:"failures"`
+
+	// Metadata holds the labels found along with the URL by a Discovery
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Backends returns the state of every URL of the pool
+func (e *Engine) Backends() []BackendStatus {
+	now := time.Now()
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	urls, backends := e.urls, e.backends
+	statuses := make([]BackendStatus, 0, len(urls))
+	for _, v := range urls {
+		b := backends[v]
+		statuses = append(statuses, BackendStatus{
+			URL:      v.String(),
+			Weight:   int(atomic.LoadInt64(&b.weight)),
+			Healthy:  atomic.LoadInt32(&b.down) == 0,
+			Ejected:  b.ejected(now),
+			Circuit:  b.circuit.stateName(),
+			Draining: atomic.LoadInt32(&b.draining) == 1,
+			Active:   atomic.LoadInt64(&b.active),
+			Requests: atomic.LoadInt64(&b.requests),
+			Failures: atomic.LoadInt64(&b.failures),
+			Metadata: b.metadata,
+		})
+	}
+	return statuses
+}
+
+// strategyName returns the admin API name of the current
+// load balancing strategy, or "custom" for a custom Balancer
+func (e *Engine) strategyName() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.Balancer != nil && e.balancer == e.Balancer {
+		return "custom"
+	}
+	for name, strategy := range strategyNames {
+		if strategy == e.LoadBalancingStrategy {
+			return name
+		}
+	}
+	return "custom"
+}
+
+// AdminHandler returns an http.Handler exposing a JSON API to inspect
+// and change the Engine while it is serving requests.
+// Every request must carry the token in an "Authorization: Bearer"
+// header. If the token is empty, every request is refused.
+// The endpoints are:
+//
+//	GET    /backends         lists the URLs of the pool along with their state
+//	POST   /backends         adds a URL, from a {"url": "...", "weight": 1} body
+//	DELETE /backends?url=    removes a URL right away
+//	POST   /backends/drain   drains a URL, from a {"url": "..."} body
+//	PUT    /backends/weight  changes the weight of a URL, from a {"url": "...", "weight": 1} body
+//	GET    /strategy         returns the load balancing strategy
+//	PUT    /strategy         switches the strategy, from a {"strategy": "round_robin"} body
+//	GET    /blacklist        lists the blacklisted IPs and CIDR ranges
+//	POST   /blacklist        blacklists an IP or a CIDR range, from a {"ip": "..."} body
+//	DELETE /blacklist?ip=    removes an IP or a CIDR range from the blacklist
+//	GET    /whitelist        lists the whitelisted IPs and CIDR ranges
+//	POST   /whitelist        whitelists an IP or a CIDR range, from a {"ip": "..."} body
+//	DELETE /whitelist?ip=    removes an IP or a CIDR range from the whitelist
+//
+// Use http.StripPrefix to mount the handler under a path
+func (e *Engine) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/backends", e.adminBackends)
+	mux.HandleFunc("/backends/drain", e.adminDrain)
+	mux.HandleFunc("/backends/weight", e.adminWeight)
+	mux.HandleFunc("/strategy", e.adminStrategy)
+	mux.HandleFunc("/blacklist", adminIPList(e.blacklistIPs, e.BlacklistIP, e.UnblacklistIP))
+	mux.HandleFunc("/whitelist", adminIPList(e.whitelistIPs, e.WhitelistIP, e.UnwhitelistIP))
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !validAdminToken(request, token) {
+			writeAdminError(writer, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		mux.ServeHTTP(writer, request)
+	})
+}
+
+func validAdminToken(request *http.Request, token string) bool {
+	const prefix = "Bearer "
+	authorization := request.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(authorization, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(authorization[len(prefix):]), []byte(token)) == 1
+}
+
+// adminBackend is the body of the requests changing a URL of the pool
+type adminBackend struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+func (e *Engine) adminBackends(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		writeAdminJSON(writer, http.StatusOK, e.Backends())
+	case http.MethodPost:
+		body := adminBackend{Weight: 1}
+		if !readAdminJSON(writer, request, &body) {
+			return
+		}
+		if err := e.AddBackend(body.URL, body.Weight); err != nil {
+			writeAdminPoolError(writer, err)
+			return
+		}
+		writeAdminJSON(writer, http.StatusCreated, body)
+	case http.MethodDelete:
+		if err := e.RemoveBackend(request.URL.Query().Get("url")); err != nil {
+			writeAdminPoolError(writer, err)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminMethodNotAllowed(writer, http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+}
+
+func (e *Engine) adminDrain(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writeAdminMethodNotAllowed(writer, http.MethodPost)
+		return
+	}
+	var body adminBackend
+	if !readAdminJSON(writer, request, &body) {
+		return
+	}
+	if _, err := e.DrainBackend(body.URL); err != nil {
+		writeAdminPoolError(writer, err)
+		return
+	}
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+func (e *Engine) adminWeight(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPut {
+		writeAdminMethodNotAllowed(writer, http.MethodPut)
+		return
+	}
+	var body adminBackend
+	if !readAdminJSON(writer, request, &body) {
+		return
+	}
+	if err := e.SetWeight(body.URL, body.Weight); err != nil {
+		writeAdminPoolError(writer, err)
+		return
+	}
+	writeAdminJSON(writer, http.StatusOK, body)
+}
+
+// adminStrategy is the body of the requests on the load balancing strategy
+type adminStrategy struct {
+	Strategy string `json:"strategy"`
+}
+
+func (e *Engine) adminStrategy(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		writeAdminJSON(writer, http.StatusOK, adminStrategy{Strategy: e.strategyName()})
+	case http.MethodPut:
+		var body adminStrategy
+		if !readAdminJSON(writer, request, &body) {
+			return
+		}
+		strategy, ok := strategyNames[body.Strategy]
+		if !ok {
+			writeAdminError(writer, http.StatusBadRequest, ErrUnknownStrategy.Error())
+			return
+		}
+		if err := e.SetStrategy(strategy); err != nil {
+			writeAdminError(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeAdminJSON(writer, http.StatusOK, body)
+	default:
+		writeAdminMethodNotAllowed(writer, http.MethodGet, http.MethodPut)
+	}
+}
+
+// adminIP is the body of the requests changing the blacklist or the whitelist
+type adminIP struct {
+	IP string `json:"ip"`
+}
+
+// adminIPList returns the handler of the blacklist or the whitelist
+func adminIPList(list func() []string, add func(string) error, remove func(string)) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case http.MethodGet:
+			ips := list()
+			if ips == nil {
+				ips = []string{}
+			}
+			writeAdminJSON(writer, http.StatusOK, ips)
+		case http.MethodPost:
+			var body adminIP
+			if !readAdminJSON(writer, request, &body) {
+				return
+			}
+			if body.IP == "" {
+				writeAdminError(writer, http.StatusBadRequest, "ip is required")
+				return
+			}
+			if err := add(body.IP); err != nil {
+				writeAdminError(writer, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeAdminJSON(writer, http.StatusCreated, body)
+		case http.MethodDelete:
+			remove(request.URL.Query().Get("ip"))
+			writer.WriteHeader(http.StatusNoContent)
+		default:
+			writeAdminMethodNotAllowed(writer, http.MethodGet, http.MethodPost, http.MethodDelete)
+		}
+	}
+}
+
+func readAdminJSON(writer http.ResponseWriter, request *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(request.Body).Decode(v); err != nil {
+		writeAdminError(writer, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeAdminJSON(writer http.ResponseWriter, statusCode int, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	json.NewEncoder(writer).Encode(v)
+}
+
+func writeAdminError(writer http.ResponseWriter, statusCode int, message string) {
+	writeAdminJSON(writer, statusCode, map[string]string{"error": message})
+}
+
+// writeAdminPoolError writes an error returned by
+// the methods changing the pool
+func writeAdminPoolError(writer http.ResponseWriter, err error) {
+	switch err {
+	case ErrURLExists:
+		writeAdminError(writer, http.StatusConflict, err.Error())
+	case ErrURLNotFound:
+		writeAdminError(writer, http.StatusNotFound, err.Error())
+	default:
+		writeAdminError(writer, http.StatusBadRequest, err.Error())
+	}
+}
+
+func writeAdminMethodNotAllowed(writer http.ResponseWriter, methods ...string) {
+	writer.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAdminError(writer, http.StatusMethodNotAllowed, "method not allowed")
+}
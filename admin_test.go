@@ -0,0 +1,223 @@
+package flashx
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEngine_AdminHandler(t *testing.T) {
+	e := &Engine{
+		URLs:                  []string{"http://localhost:3000"},
+		LoadBalancingStrategy: RoundRobin,
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+	handler := e.AdminHandler("secret")
+
+	// the requests run in order, each one seeing the changes of the previous ones
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		token      string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "missing token",
+			method:     "GET",
+			target:     "/backends",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "invalid token",
+			method:     "GET",
+			target:     "/backends",
+			token:      "wrong",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "add a URL",
+			method:     "POST",
+			target:     "/backends",
+			body:       `{"url": "http://localhost:4000", "weight": 2}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "add a URL already in the pool",
+			method:     "POST",
+			target:     "/backends",
+			body:       `{"url": "http://localhost:4000"}`,
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "add a missing URL",
+			method:     "POST",
+			target:     "/backends",
+			body:       `{"weight": 1}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "add an invalid URL",
+			method:     "POST",
+			target:     "/backends",
+			body:       `{"url": "not a url"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "add a URL with an invalid body",
+			method:     "POST",
+			target:     "/backends",
+			body:       `{"url":`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "change the weight of a URL",
+			method:     "PUT",
+			target:     "/backends/weight",
+			body:       `{"url": "http://localhost:3000", "weight": 3}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "list the URLs",
+			method:     "GET",
+			target:     "/backends",
+			wantStatus: http.StatusOK,
+			wantBody: `[{"url":"http://localhost:3000","weight":3,"healthy":true,"ejected":false,"circuit":"closed","draining":false,"active":0,"requests":0,"failures":0},` +
+				`{"url":"http://localhost:4000","weight":2,"healthy":true,"ejected":false,"circuit":"closed","draining":false,"active":0,"requests":0,"failures":0}]`,
+		},
+		{
+			name:       "drain a URL",
+			method:     "POST",
+			target:     "/backends/drain",
+			body:       `{"url": "http://localhost:4000"}`,
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "remove a drained URL",
+			method:     "DELETE",
+			target:     "/backends?url=http://localhost:4000",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "remove a URL",
+			method:     "DELETE",
+			target:     "/backends?url=http://localhost:3000",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "method not allowed",
+			method:     "PATCH",
+			target:     "/backends",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "get the strategy",
+			method:     "GET",
+			target:     "/strategy",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"strategy":"round_robin"}`,
+		},
+		{
+			name:       "switch the strategy",
+			method:     "PUT",
+			target:     "/strategy",
+			body:       `{"strategy": "least_connections"}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "switch to an unknown strategy",
+			method:     "PUT",
+			target:     "/strategy",
+			body:       `{"strategy": "random"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "get the switched strategy",
+			method:     "GET",
+			target:     "/strategy",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"strategy":"least_connections"}`,
+		},
+		{
+			name:       "blacklist an IP",
+			method:     "POST",
+			target:     "/blacklist",
+			body:       `{"ip": "192.168.1.7"}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "list the blacklist",
+			method:     "GET",
+			target:     "/blacklist",
+			wantStatus: http.StatusOK,
+			wantBody:   `["192.168.1.7"]`,
+		},
+		{
+			name:       "remove an IP from the blacklist",
+			method:     "DELETE",
+			target:     "/blacklist?ip=192.168.1.7",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "list the empty blacklist",
+			method:     "GET",
+			target:     "/blacklist",
+			wantStatus: http.StatusOK,
+			wantBody:   `[]`,
+		},
+		{
+			name:       "blacklist an invalid IP",
+			method:     "POST",
+			target:     "/blacklist",
+			body:       `{"ip": "192.168.1"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "whitelist a CIDR range",
+			method:     "POST",
+			target:     "/whitelist",
+			body:       `{"ip": "10.0.0.0/8"}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "list the whitelist",
+			method:     "GET",
+			target:     "/whitelist",
+			wantStatus: http.StatusOK,
+			wantBody:   `["10.0.0.0/8"]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			token := tt.token
+			if token == "" && tt.wantStatus != http.StatusUnauthorized {
+				token = "secret"
+			}
+			if token != "" {
+				request.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, request)
+			if w.Code != tt.wantStatus {
+				t.Errorf("AdminHandler() status = %v, want %v, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantBody != "" && strings.TrimSpace(w.Body.String()) != tt.wantBody {
+				t.Errorf("AdminHandler() body = %s, want %s", w.Body, tt.wantBody)
+			}
+			if w.Code >= http.StatusBadRequest {
+				var body map[string]string
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body["error"] == "" {
+					t.Errorf("AdminHandler() error body = %v, want an error message", body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package flashx
+
+import (
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backend holds the state of a URL that
+// the Engine routes requests to
+type backend struct {
+	url *url.URL
+
+	// down is set to 1 while health checks
+	// report the URL as unhealthy
+	down int32
+
+	healthMu       sync.Mutex
+	healthPasses   int
+	healthFailures int
+
+	// ejectedUntil holds the time, in Unix nanoseconds,
+	// until which outlier detection ejected the URL
+	ejectedUntil int64
+
+	outlierMu           sync.Mutex
+	ejections           int
+	consecutiveFailures int
+	windowStart         time.Time
+	windowRequests      int
+	windowFailures      int
+
+	circuit *circuit
+
+	retryBudget *retryBudget
+
+	// weight holds the weight of the URL
+	weight int64
+
+	// active holds the number of requests in flight
+	active int64
+
+	// requests and failures count the requests the URL
+	// served, and the ones it failed to serve
+	requests int64
+	failures int64
+
+	// draining is set to 1 while the URL is being drained,
+	// and drained is closed once it has been removed
+	draining  int32
+	drained   chan struct{}
+	drainOnce sync.Once
+
+	// source holds the discovery entry that found the URL,
+	// it is empty for the URLs that were listed directly
+	source string
+
+	// metadata holds the labels the discovery found along
+	// with the URL, it is guarded by the mu of the Engine
+	metadata map[string]string
+}
+
+// available reports whether the backend is able to serve requests.
+// A nil backend is always available.
+func (b *backend) available() bool {
+	if b == nil {
+		return true
+	}
+	if atomic.LoadInt32(&b.draining) == 1 {
+		return false
+	}
+	now := time.Now()
+	return b.up(now) && b.circuit.allow(now)
+}
+
+// up reports whether the backend is neither
+// down nor ejected by outlier detection
+func (b *backend) up(now time.Time) bool {
+	return b == nil || (atomic.LoadInt32(&b.down) == 0 && !b.ejected(now))
+}
+
+// ejected reports whether outlier detection ejected the backend
+func (b *backend) ejected(now time.Time) bool {
+	return b != nil && now.UnixNano() < atomic.LoadInt64(&b.ejectedUntil)
+}
+
+func (e *Engine) populateBackends() {
+	e.backends = make(map[*url.URL]*backend)
+	for _, v := range e.urls {
+		e.backends[v] = e.newBackend(v)
+	}
+}
+
+func (e *Engine) newBackend(routeURL *url.URL) *backend {
+	return &backend{
+		url:         routeURL,
+		circuit:     newCircuit(e.circuitBreaker),
+		retryBudget: e.newRetryBudget(),
+		weight:      1,
+		drained:     make(chan struct{}),
+	}
+}
+
+// pool returns the URLs and their backends.
+// They are replaced rather than modified when the pool changes,
+// so they can be used without holding mu
+func (e *Engine) pool() ([]*url.URL, map[*url.URL]*backend) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.urls, e.backends
+}
+
+// backend returns the backend of routeURL,
+// or nil if routeURL is not in the pool
+func (e *Engine) backend(routeURL *url.URL) *backend {
+	_, backends := e.pool()
+	return backends[routeURL]
+}
+
+// acquireURL reports whether the circuit of routeURL lets a request
+// through, taking one of its probes if it is half-open
+func (e *Engine) acquireURL(routeURL *url.URL) bool {
+	b := e.backend(routeURL)
+	return b == nil || b.circuit.acquire(time.Now())
+}
+
+// releaseURL gives back the probe taken by acquireURL
+// for a request that is not routed to routeURL after all
+func (e *Engine) releaseURL(routeURL *url.URL) {
+	if b := e.backend(routeURL); b != nil {
+		b.circuit.release()
+	}
+}
+
+// recordStart records that a request is about to be routed to routeURL
+func (e *Engine) recordStart(routeURL *url.URL) {
+	if b := e.backend(routeURL); b != nil {
+		atomic.AddInt64(&b.active, 1)
+	}
+}
+
+// recordOutcome records whether routeURL failed to serve a request
+func (e *Engine) recordOutcome(routeURL *url.URL, failed bool) {
+	b := e.backend(routeURL)
+	if b == nil {
+		return
+	}
+	atomic.AddInt64(&b.requests, 1)
+	if failed {
+		atomic.AddInt64(&b.failures, 1)
+	}
+	if atomic.AddInt64(&b.active, -1) == 0 && atomic.LoadInt32(&b.draining) == 1 {
+		e.finishDrain(b)
+	}
+	now := time.Now()
+	b.circuit.finished(failed, now)
+	e.detectOutlier(b, failed, now)
+	if !failed {
+		b.retryBudget.succeeded(now)
+		e.retryBudget.succeeded(now)
+	}
+}
+
+// availableURLs returns the URLs that are able to serve requests
+func (e *Engine) availableURLs() []*url.URL {
+	urls, backends := e.pool()
+	for index, v := range urls {
+		if backends[v].available() {
+			continue
+		}
+		// at least one URL is unavailable, filter the rest
+		available := make([]*url.URL, index, len(urls))
+		copy(available, urls[:index])
+		for _, w := range urls[index+1:] {
+			if backends[w].available() {
+				available = append(available, w)
+			}
+		}
+		return available
+	}
+	return urls
+}
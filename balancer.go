@@ -0,0 +1,634 @@
+package flashx
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// responseTimeDecay is the weight given to the latest
+// response time sample in the moving average of each URL
+const responseTimeDecay = 0.3
+
+// Balancer decides which URL a request will be routed to.
+// Implement this interface to plug a custom load balancing
+// algorithm into the Engine.
+// Implementations must be safe for concurrent use.
+type Balancer interface {
+	// Pick returns the URL that the request should be routed to.
+	// urls holds the URLs that are able to serve requests
+	// and is never empty.
+	Pick(urls []*url.URL, request *http.Request) *url.URL
+
+	// RequestStarted is called right before a request
+	// is routed to the URL returned by Pick
+	RequestStarted(routeURL *url.URL)
+
+	// RequestFinished is called once the URL has
+	// finished serving a request, along with the
+	// time it took to serve it
+	RequestFinished(routeURL *url.URL, elapsed time.Duration)
+}
+
+// FailureAwareBalancer is a Balancer that tells the requests
+// that were served successfully apart from the other ones
+type FailureAwareBalancer interface {
+	Balancer
+
+	// RequestFailed is called instead of RequestFinished once
+	// the URL has failed to serve a request, either because it
+	// could not be reached or responded with a 5xx status code,
+	// or once the request has been cancelled
+	RequestFailed(routeURL *url.URL)
+}
+
+// ForgettingBalancer is a Balancer that keeps state for each URL,
+// which it drops once the URL is removed from the pool
+type ForgettingBalancer interface {
+	Balancer
+
+	// Forget is called once the URL has been removed from the pool,
+	// and again after each request that was in flight to it finishes
+	Forget(routeURL *url.URL)
+}
+
+// WeightedBalancer is a Balancer that takes the
+// weight of each URL into account.
+// The Engine calls SetWeight for each URL during Setup,
+// using the weights specified in RoundRobinWeights.
+type WeightedBalancer interface {
+	Balancer
+
+	// SetWeight sets the weight for a URL
+	SetWeight(routeURL *url.URL, weight int)
+}
+
+// NewRoundRobinBalancer returns a Balancer that picks
+// URLs one after the other
+func NewRoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{currentIndex: -1}
+}
+
+// NewWeightedRoundRobinBalancer returns a WeightedBalancer that picks
+// URLs one by one based on their weights
+func NewWeightedRoundRobinBalancer() WeightedBalancer {
+	return &weightedRoundRobinBalancer{
+		weights: make(map[*url.URL]int),
+		current: make(map[*url.URL]int),
+	}
+}
+
+// NewLeastConnectionsBalancer returns a Balancer that picks
+// the URL with the least number of active connections
+func NewLeastConnectionsBalancer() Balancer {
+	return &leastConnectionsBalancer{
+		connections: make(map[*url.URL]int),
+	}
+}
+
+// NewWeightedLeastConnectionsBalancer returns a WeightedBalancer that
+// picks the URL with the lowest ratio of active connections to weight
+func NewWeightedLeastConnectionsBalancer() WeightedBalancer {
+	return &weightedLeastConnectionsBalancer{
+		leastConnectionsBalancer: leastConnectionsBalancer{
+			connections: make(map[*url.URL]int),
+		},
+		weights: make(map[*url.URL]int),
+	}
+}
+
+// NewWeightedResponseTimeBalancer returns a Balancer that picks URLs
+// at random, with faster URLs being more likely to be picked.
+// Only the successful responses are timed, and the URLs that have
+// not responded yet are expected to respond in the mean time of the
+// other URLs
+func NewWeightedResponseTimeBalancer() Balancer {
+	return &weightedResponseTimeBalancer{
+		responseTimes: make(map[*url.URL]float64),
+	}
+}
+
+// NewPowerOfTwoChoicesBalancer returns a Balancer that samples two
+// random URLs and picks the one with fewer requests in flight
+func NewPowerOfTwoChoicesBalancer() Balancer {
+	return &powerOfTwoChoicesBalancer{}
+}
+
+// strategyNames maps the names used by the admin API
+// and the config file to the load balancing strategies
+var strategyNames = map[string]int{
+	"none":                       Nil,
+	"round_robin":                RoundRobin,
+	"weighted_round_robin":       WeightedRoundRobin,
+	"least_connections":          LeastConnections,
+	"weighted_least_connections": WeightedLeastConnections,
+	"weighted_response_time":     WeightedResponseTime,
+	"consistent_hash":            ConsistentHash,
+	"power_of_two_choices":       PowerOfTwoChoices,
+}
+
+// newBalancer returns the built-in Balancer for a load balancing strategy
+func newBalancer(strategy int, hashKey func(*http.Request) string) Balancer {
+	switch strategy {
+	case RoundRobin:
+		return NewRoundRobinBalancer()
+	case WeightedRoundRobin:
+		return NewWeightedRoundRobinBalancer()
+	case LeastConnections:
+		return NewLeastConnectionsBalancer()
+	case WeightedLeastConnections:
+		return NewWeightedLeastConnectionsBalancer()
+	case WeightedResponseTime:
+		return NewWeightedResponseTimeBalancer()
+	case ConsistentHash:
+		return NewConsistentHashBalancer(hashKey, defaultHashReplicas)
+	case PowerOfTwoChoices:
+		return NewPowerOfTwoChoicesBalancer()
+	}
+	return nil
+}
+
+func (e *Engine) currentBalancer() Balancer {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.balancer
+}
+
+// SetStrategy switches the Engine to another built-in load balancing
+// strategy while it is serving requests. The weights of the URLs
+// are carried over to weighted strategies
+func (e *Engine) SetStrategy(strategy int) error {
+	balancer := newBalancer(strategy, e.HashKey)
+	if balancer == nil && strategy != Nil {
+		return ErrUnknownStrategy
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.setStrategyLocked(strategy, balancer)
+	return nil
+}
+
+// setStrategyLocked switches the Engine to the balancer of a strategy.
+// It must be called while holding mu
+func (e *Engine) setStrategyLocked(strategy int, balancer Balancer) {
+	if weightedBalancer, ok := balancer.(WeightedBalancer); ok {
+		for _, v := range e.urls {
+			weightedBalancer.SetWeight(v, int(atomic.LoadInt64(&e.backends[v].weight)))
+		}
+	}
+	e.balancer = balancer
+	e.LoadBalancingStrategy = strategy
+}
+
+type roundRobinBalancer struct {
+	currentIndex int64
+}
+
+func (b *roundRobinBalancer) Pick(urls []*url.URL, request *http.Request) *url.URL {
+	nextURLIndex := int(atomic.AddInt64(&b.currentIndex, int64(1)) % int64(len(urls)))
+	return urls[nextURLIndex]
+}
+
+func (b *roundRobinBalancer) RequestStarted(routeURL *url.URL) {}
+
+func (b *roundRobinBalancer) RequestFinished(routeURL *url.URL, elapsed time.Duration) {}
+
+// weightedRoundRobinBalancer implements the smooth weighted round robin
+// algorithm used by nginx. On every pick, each URL's current weight grows
+// by its weight, the URL with the highest current weight is picked and
+// its current weight is lowered by the total weight.
+// This interleaves the picks and only keeps O(N) state.
+type weightedRoundRobinBalancer struct {
+	mu      sync.Mutex
+	weights map[*url.URL]int
+	current map[*url.URL]int
+}
+
+func (b *weightedRoundRobinBalancer) Pick(urls []*url.URL, request *http.Request) *url.URL {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total := 0
+	var picked *url.URL
+	for _, v := range urls {
+		weight := b.weight(v)
+		b.current[v] += weight
+		total += weight
+		if picked == nil || b.current[v] > b.current[picked] {
+			picked = v
+		}
+	}
+	b.current[picked] -= total
+	return picked
+}
+
+func (b *weightedRoundRobinBalancer) RequestStarted(routeURL *url.URL) {}
+
+func (b *weightedRoundRobinBalancer) RequestFinished(routeURL *url.URL, elapsed time.Duration) {}
+
+func (b *weightedRoundRobinBalancer) Forget(routeURL *url.URL) {
+	b.mu.Lock()
+	delete(b.weights, routeURL)
+	delete(b.current, routeURL)
+	b.mu.Unlock()
+}
+
+func (b *weightedRoundRobinBalancer) SetWeight(routeURL *url.URL, weight int) {
+	b.mu.Lock()
+	b.weights[routeURL] = weight
+	b.current[routeURL] = 0
+	b.mu.Unlock()
+}
+
+func (b *weightedRoundRobinBalancer) weight(routeURL *url.URL) int {
+	if weight, ok := b.weights[routeURL]; ok {
+		return weight
+	}
+	return 1
+}
+
+type leastConnectionsBalancer struct {
+	mu          sync.Mutex
+	connections map[*url.URL]int
+}
+
+func (b *leastConnectionsBalancer) Pick(urls []*url.URL, request *http.Request) *url.URL {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	leastConnections := -1
+	leastConnectionsURL := urls[0]
+	for _, v := range urls {
+		if connections := b.connections[v]; leastConnections < 0 || connections < leastConnections {
+			leastConnections = connections
+			leastConnectionsURL = v
+		}
+	}
+	return leastConnectionsURL
+}
+
+func (b *leastConnectionsBalancer) RequestStarted(routeURL *url.URL) {
+	b.mu.Lock()
+	b.connections[routeURL]++
+	b.mu.Unlock()
+}
+
+func (b *leastConnectionsBalancer) RequestFinished(routeURL *url.URL, elapsed time.Duration) {
+	b.mu.Lock()
+	b.connections[routeURL]--
+	b.mu.Unlock()
+}
+
+func (b *leastConnectionsBalancer) Forget(routeURL *url.URL) {
+	b.mu.Lock()
+	delete(b.connections, routeURL)
+	b.mu.Unlock()
+}
+
+type weightedLeastConnectionsBalancer struct {
+	leastConnectionsBalancer
+	weights map[*url.URL]int
+}
+
+func (b *weightedLeastConnectionsBalancer) Pick(urls []*url.URL, request *http.Request) *url.URL {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	leastConnections, leastConnectionsWeight := -1, 1
+	leastConnectionsURL := urls[0]
+	for _, v := range urls {
+		connections, weight := b.connections[v], b.weight(v)
+		// compare connections/weight ratios without dividing
+		if leastConnections < 0 || connections*leastConnectionsWeight < leastConnections*weight {
+			leastConnections = connections
+			leastConnectionsWeight = weight
+			leastConnectionsURL = v
+		}
+	}
+	return leastConnectionsURL
+}
+
+func (b *weightedLeastConnectionsBalancer) SetWeight(routeURL *url.URL, weight int) {
+	b.mu.Lock()
+	b.weights[routeURL] = weight
+	b.mu.Unlock()
+}
+
+func (b *weightedLeastConnectionsBalancer) Forget(routeURL *url.URL) {
+	b.mu.Lock()
+	delete(b.connections, routeURL)
+	delete(b.weights, routeURL)
+	b.mu.Unlock()
+}
+
+func (b *weightedLeastConnectionsBalancer) weight(routeURL *url.URL) int {
+	if weight, ok := b.weights[routeURL]; ok {
+		return weight
+	}
+	return 1
+}
+
+type weightedResponseTimeBalancer struct {
+	mu            sync.Mutex
+	responseTimes map[*url.URL]float64
+}
+
+func (b *weightedResponseTimeBalancer) Pick(urls []*url.URL, request *http.Request) *url.URL {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	mean, measured := 0.0, 0
+	for _, v := range urls {
+		if responseTime := b.responseTimes[v]; responseTime > 0 {
+			mean += responseTime
+			measured++
+		}
+	}
+	if measured == 0 {
+		return urls[rand.Intn(len(urls))]
+	}
+	mean /= float64(measured)
+
+	speeds := make([]float64, len(urls))
+	totalSpeed := 0.0
+	for index, v := range urls {
+		responseTime := b.responseTimes[v]
+		if responseTime <= 0 {
+			responseTime = mean
+		}
+		speeds[index] = 1 / responseTime
+		totalSpeed += speeds[index]
+	}
+	pick := rand.Float64() * totalSpeed
+	for index, v := range urls {
+		pick -= speeds[index]
+		if pick < 0 {
+			return v
+		}
+	}
+	return urls[len(urls)-1]
+}
+
+func (b *weightedResponseTimeBalancer) RequestStarted(routeURL *url.URL) {}
+
+// RequestFailed leaves the response time of the URL as is, since a URL
+// failing fast would otherwise look faster than the healthy ones
+func (b *weightedResponseTimeBalancer) RequestFailed(routeURL *url.URL) {}
+
+func (b *weightedResponseTimeBalancer) RequestFinished(routeURL *url.URL, elapsed time.Duration) {
+	sample := float64(elapsed)
+	if sample <= 0 {
+		sample = 1
+	}
+	b.mu.Lock()
+	if average := b.responseTimes[routeURL]; average > 0 {
+		sample = responseTimeDecay*sample + (1-responseTimeDecay)*average
+	}
+	b.responseTimes[routeURL] = sample
+	b.mu.Unlock()
+}
+
+func (b *weightedResponseTimeBalancer) Forget(routeURL *url.URL) {
+	b.mu.Lock()
+	delete(b.responseTimes, routeURL)
+	b.mu.Unlock()
+}
+
+type powerOfTwoChoicesBalancer struct {
+	// inFlight maps each URL to a pointer to its
+	// number of requests in flight
+	inFlight sync.Map
+}
+
+func (b *powerOfTwoChoicesBalancer) Pick(urls []*url.URL, request *http.Request) *url.URL {
+	if len(urls) == 1 {
+		return urls[0]
+	}
+	i := rand.Intn(len(urls))
+	j := rand.Intn(len(urls) - 1)
+	if j >= i {
+		j++
+	}
+	if atomic.LoadInt64(b.counter(urls[j])) < atomic.LoadInt64(b.counter(urls[i])) {
+		return urls[j]
+	}
+	return urls[i]
+}
+
+func (b *powerOfTwoChoicesBalancer) RequestStarted(routeURL *url.URL) {
+	atomic.AddInt64(b.counter(routeURL), 1)
+}
+
+func (b *powerOfTwoChoicesBalancer) RequestFinished(routeURL *url.URL, elapsed time.Duration) {
+	atomic.AddInt64(b.counter(routeURL), -1)
+}
+
+func (b *powerOfTwoChoicesBalancer) Forget(routeURL *url.URL) {
+	b.inFlight.Delete(routeURL)
+}
+
+func (b *powerOfTwoChoicesBalancer) counter(routeURL *url.URL) *int64 {
+	if counter, ok := b.inFlight.Load(routeURL); ok {
+		return counter.(*int64)
+	}
+	counter, _ := b.inFlight.LoadOrStore(routeURL, new(int64))
+	return counter.(*int64)
+}
+
+// defaultHashReplicas is the number of virtual nodes
+// placed on the hash ring for every URL
+const defaultHashReplicas = 160
+
+// NewConsistentHashBalancer returns a Balancer that maps the key
+// returned by hashKey onto a hash ring, so that requests with the same
+// key keep being routed to the same URL.
+// Every URL is placed on the ring replicas times, which keeps the keys
+// evenly spread and makes only about 1/N of them move whenever a URL
+// is added or removed.
+// If hashKey is nil or returns an empty key, the client IP is used.
+// If replicas is not greater than 0, a default value will be picked up
+func NewConsistentHashBalancer(hashKey func(*http.Request) string, replicas int) Balancer {
+	if hashKey == nil {
+		hashKey = HashByClientIP
+	}
+	if replicas <= 0 {
+		replicas = defaultHashReplicas
+	}
+	return &consistentHashBalancer{
+		hashKey:  hashKey,
+		replicas: replicas,
+	}
+}
+
+// HashByClientIP returns the client IP of the request, as
+// returned by ClientIP, or its remote address if it has no IP
+func HashByClientIP(request *http.Request) string {
+	if ip := ClientIP(request); ip != nil {
+		return ip.String()
+	}
+	return request.RemoteAddr
+}
+
+// HashByHeader returns a hash key function that
+// uses the value of the named request header
+func HashByHeader(name string) func(*http.Request) string {
+	return func(request *http.Request) string {
+		return request.Header.Get(name)
+	}
+}
+
+// HashByCookie returns a hash key function that
+// uses the value of the named cookie
+func HashByCookie(name string) func(*http.Request) string {
+	return func(request *http.Request) string {
+		cookie, err := request.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+}
+
+// HashByPathSegment returns a hash key function that uses
+// the path segment at index, counting from 0.
+// For example, index 1 of "/users/42/orders" is "42"
+func HashByPathSegment(index int) func(*http.Request) string {
+	return func(request *http.Request) string {
+		if request.URL == nil {
+			return ""
+		}
+		segments := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+		if index < 0 || index >= len(segments) {
+			return ""
+		}
+		return segments[index]
+	}
+}
+
+type consistentHashBalancer struct {
+	hashKey  func(*http.Request) string
+	replicas int
+
+	// mu guards ring, which is replaced rather than changed,
+	// so that a Pick can keep walking a ring it has read
+	mu   sync.RWMutex
+	ring *hashRing
+}
+
+// hashRing holds the points of a set of URLs on the hash ring
+type hashRing struct {
+	// members holds the strings of the URLs on the ring
+	members map[string]bool
+
+	// hashes holds the points in order, and owners the URL of each point
+	hashes []uint32
+	owners []string
+}
+
+func (b *consistentHashBalancer) Pick(urls []*url.URL, request *http.Request) *url.URL {
+	key := b.hashKey(request)
+	if key == "" {
+		key = HashByClientIP(request)
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+
+	candidates := make(map[string]*url.URL, len(urls))
+	for _, u := range urls {
+		candidates[u.String()] = u
+	}
+	ring := b.currentRing(candidates)
+
+	// the URLs of the ring that are not candidates are skipped, which
+	// picks the same URL as a ring holding the candidates only
+	index := sort.Search(len(ring.hashes), func(i int) bool {
+		return ring.hashes[i] >= hash
+	})
+	for i := 0; i < len(ring.hashes); i++ {
+		if u, ok := candidates[ring.owners[(index+i)%len(ring.hashes)]]; ok {
+			return u
+		}
+	}
+	return urls[0]
+}
+
+func (b *consistentHashBalancer) RequestStarted(routeURL *url.URL) {}
+
+func (b *consistentHashBalancer) RequestFinished(routeURL *url.URL, elapsed time.Duration) {}
+
+// currentRing returns a ring holding every candidate. The ring is only
+// rebuilt when a URL that is not on it shows up, so the URLs that are
+// left out of a Pick for a while, such as the ones that are down or
+// already tried, keep their points
+func (b *consistentHashBalancer) currentRing(candidates map[string]*url.URL) *hashRing {
+	b.mu.RLock()
+	ring := b.ring
+	b.mu.RUnlock()
+	if ring.holds(candidates) {
+		return ring
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ring.holds(candidates) {
+		return b.ring
+	}
+	members := make(map[string]bool, len(candidates))
+	for member := range candidates {
+		members[member] = true
+	}
+	// the URLs that left the pool are dropped once they
+	// make up more than half of the ring
+	if b.ring != nil && len(b.ring.members) < 2*len(candidates) {
+		for member := range b.ring.members {
+			members[member] = true
+		}
+	}
+	b.ring = newHashRing(members, b.replicas)
+	return b.ring
+}
+
+func (r *hashRing) holds(candidates map[string]*url.URL) bool {
+	if r == nil {
+		return false
+	}
+	for member := range candidates {
+		if !r.members[member] {
+			return false
+		}
+	}
+	return true
+}
+
+func newHashRing(members map[string]bool, replicas int) *hashRing {
+	owners := make(map[uint32]string, len(members)*replicas)
+	for member := range members {
+		for i := 0; i < replicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + member))
+			// a colliding point goes to the same URL whatever the
+			// order of the members, so every ring of them agrees
+			if owner, ok := owners[hash]; ok && owner < member {
+				continue
+			}
+			owners[hash] = member
+		}
+	}
+	r := &hashRing{
+		members: members,
+		hashes:  make([]uint32, 0, len(owners)),
+		owners:  make([]string, 0, len(owners)),
+	}
+	for hash := range owners {
+		r.hashes = append(r.hashes, hash)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+	for _, hash := range r.hashes {
+		r.owners = append(r.owners, owners[hash])
+	}
+	return r
+}
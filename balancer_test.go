@@ -0,0 +1,528 @@
+package flashx
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testURLs() []*url.URL {
+	return []*url.URL{
+		{
+			Scheme: "http",
+			Host:   "localhost:3000",
+		},
+		{
+			Scheme: "http",
+			Host:   "localhost:4000",
+		},
+		{
+			Scheme: "http",
+			Host:   "localhost:5000",
+		},
+	}
+}
+
+func TestRoundRobinBalancer_Pick(t *testing.T) {
+	urls := testURLs()
+	b := NewRoundRobinBalancer()
+	for i := 0; i < 2*len(urls); i++ {
+		if got, want := b.Pick(urls, &http.Request{}), urls[i%len(urls)]; got != want {
+			t.Errorf("roundRobinBalancer.Pick() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestWeightedRoundRobinBalancer_Pick(t *testing.T) {
+	urls := testURLs()
+	b := NewWeightedRoundRobinBalancer()
+	b.SetWeight(urls[0], 1)
+	b.SetWeight(urls[1], 2)
+	b.SetWeight(urls[2], 3)
+
+	counts := make(map[*url.URL]int)
+	for i := 0; i < 60; i++ {
+		counts[b.Pick(urls, &http.Request{})]++
+	}
+	for index, want := range []int{10, 20, 30} {
+		if got := counts[urls[index]]; got != want {
+			t.Errorf("weightedRoundRobinBalancer.Pick() picked %v %d times, want %d", urls[index], got, want)
+		}
+	}
+}
+
+func TestWeightedRoundRobinBalancer_interleaving(t *testing.T) {
+	urls := testURLs()[:2]
+	tests := []struct {
+		name       string
+		weights    []int
+		maxInARow  int
+		rounds     int
+		wantCounts []int
+	}{
+		{
+			name:       "light and heavy URLs",
+			weights:    []int{1, 100},
+			maxInARow:  51,
+			rounds:     101,
+			wantCounts: []int{1, 100},
+		},
+		{
+			name:       "large weights",
+			weights:    []int{10000, 20000},
+			maxInARow:  2,
+			rounds:     30000,
+			wantCounts: []int{10000, 20000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewWeightedRoundRobinBalancer()
+			for index, weight := range tt.weights {
+				b.SetWeight(urls[index], weight)
+			}
+			counts := make(map[*url.URL]int)
+			var previous *url.URL
+			inARow := 0
+			for i := 0; i < tt.rounds; i++ {
+				got := b.Pick(urls, &http.Request{})
+				counts[got]++
+				if got == previous {
+					inARow++
+				} else {
+					inARow = 1
+				}
+				previous = got
+				if inARow > tt.maxInARow {
+					t.Fatalf("weightedRoundRobinBalancer.Pick() picked %v %d times in a row", got, inARow)
+				}
+			}
+			for index, want := range tt.wantCounts {
+				if got := counts[urls[index]]; got != want {
+					t.Errorf("weightedRoundRobinBalancer.Pick() picked %v %d times, want %d", urls[index], got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLeastConnectionsBalancer_Pick(t *testing.T) {
+	urls := testURLs()
+	tests := []struct {
+		name    string
+		started []*url.URL
+		want    *url.URL
+	}{
+		{
+			name:    "no active connections",
+			started: nil,
+			want:    urls[0],
+		},
+		{
+			name:    "first two URLs busy",
+			started: []*url.URL{urls[0], urls[1]},
+			want:    urls[2],
+		},
+		{
+			name:    "second URL least busy",
+			started: []*url.URL{urls[0], urls[0], urls[2]},
+			want:    urls[1],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewLeastConnectionsBalancer()
+			for _, u := range tt.started {
+				b.RequestStarted(u)
+			}
+			if got := b.Pick(urls, &http.Request{}); got != tt.want {
+				t.Errorf("leastConnectionsBalancer.Pick() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeastConnectionsBalancer_RequestFinished(t *testing.T) {
+	urls := testURLs()
+	b := NewLeastConnectionsBalancer()
+	b.RequestStarted(urls[0])
+	b.RequestStarted(urls[1])
+	b.RequestFinished(urls[0], time.Millisecond)
+	if got := b.Pick(urls[:2], &http.Request{}); got != urls[0] {
+		t.Errorf("leastConnectionsBalancer.Pick() = %v, want %v", got, urls[0])
+	}
+}
+
+func TestWeightedLeastConnectionsBalancer_Pick(t *testing.T) {
+	urls := testURLs()[:2]
+	tests := []struct {
+		name    string
+		weights []int
+		started []*url.URL
+		want    *url.URL
+	}{
+		{
+			name:    "default weights behave like least connections",
+			weights: nil,
+			started: []*url.URL{urls[0]},
+			want:    urls[1],
+		},
+		{
+			name:    "heavier URL takes more connections",
+			weights: []int{1, 4},
+			started: []*url.URL{urls[0], urls[1], urls[1], urls[1]},
+			want:    urls[1],
+		},
+		{
+			name:    "heavier URL above its share",
+			weights: []int{1, 4},
+			started: []*url.URL{urls[1], urls[1], urls[1], urls[1], urls[1]},
+			want:    urls[0],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewWeightedLeastConnectionsBalancer()
+			for index, weight := range tt.weights {
+				b.SetWeight(urls[index], weight)
+			}
+			for _, u := range tt.started {
+				b.RequestStarted(u)
+			}
+			if got := b.Pick(urls, &http.Request{}); got != tt.want {
+				t.Errorf("weightedLeastConnectionsBalancer.Pick() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeightedResponseTimeBalancer_Pick(t *testing.T) {
+	urls := testURLs()[:2]
+	b := NewWeightedResponseTimeBalancer()
+	b.RequestFinished(urls[0], 20*time.Millisecond)
+	// the unmeasured URL is expected to be as fast as the measured one
+	counts := make(map[*url.URL]int)
+	for i := 0; i < 1000; i++ {
+		counts[b.Pick(urls, &http.Request{})]++
+	}
+	if counts[urls[0]] < 400 || counts[urls[1]] < 400 {
+		t.Errorf("weightedResponseTimeBalancer.Pick() = %v, want an even spread", counts)
+	}
+
+	b.RequestFinished(urls[1], 180*time.Millisecond)
+	counts = make(map[*url.URL]int)
+	for i := 0; i < 1000; i++ {
+		counts[b.Pick(urls, &http.Request{})]++
+	}
+	if counts[urls[0]] <= counts[urls[1]] {
+		t.Errorf("weightedResponseTimeBalancer.Pick() favoured the slower URL: %v", counts)
+	}
+}
+
+func TestEngine_route_failedResponseTime(t *testing.T) {
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+	healthy := newTestBackend("healthy")
+	defer healthy.Close()
+
+	b := NewWeightedResponseTimeBalancer().(*weightedResponseTimeBalancer)
+	e := &Engine{
+		URLs:         []string{refused.URL, healthy.URL},
+		Balancer:     b,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {},
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	for _, routeURL := range e.urls {
+		e.route(httptest.NewRecorder(), httptest.NewRequest("GET", "http://flashx/", nil), routeURL, nil)
+	}
+	if got := b.responseTimes[e.urls[0]]; got != 0 {
+		t.Errorf("weightedResponseTimeBalancer timed the refused URL at %v, want it unmeasured", got)
+	}
+	if got := b.responseTimes[e.urls[1]]; got <= 0 {
+		t.Errorf("weightedResponseTimeBalancer timed the healthy URL at %v, want it measured", got)
+	}
+}
+
+func TestWeightedResponseTimeBalancer_RequestFinished(t *testing.T) {
+	routeURL := &url.URL{
+		Scheme: "http",
+		Host:   "localhost:3000",
+	}
+	tests := []struct {
+		name     string
+		average  float64
+		elapsed  time.Duration
+		wantTime float64
+	}{
+		{
+			name:     "first sample is used as is",
+			average:  0,
+			elapsed:  100 * time.Millisecond,
+			wantTime: float64(100 * time.Millisecond),
+		},
+		{
+			name:     "later samples decay into the average",
+			average:  float64(100 * time.Millisecond),
+			elapsed:  200 * time.Millisecond,
+			wantTime: responseTimeDecay*float64(200*time.Millisecond) + (1-responseTimeDecay)*float64(100*time.Millisecond),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &weightedResponseTimeBalancer{
+				responseTimes: map[*url.URL]float64{routeURL: tt.average},
+			}
+			b.RequestFinished(routeURL, tt.elapsed)
+			if got := b.responseTimes[routeURL]; got != tt.wantTime {
+				t.Errorf("weightedResponseTimeBalancer.RequestFinished() = %v, want %v", got, tt.wantTime)
+			}
+		})
+	}
+}
+
+func TestPowerOfTwoChoicesBalancer_Pick(t *testing.T) {
+	urls := testURLs()
+	tests := []struct {
+		name    string
+		urls    []*url.URL
+		started []*url.URL
+		want    *url.URL
+	}{
+		{
+			name: "single URL",
+			urls: urls[:1],
+			want: urls[0],
+		},
+		{
+			name:    "two URLs, first busy",
+			urls:    urls[:2],
+			started: []*url.URL{urls[0]},
+			want:    urls[1],
+		},
+		{
+			name:    "two URLs, second busy",
+			urls:    urls[:2],
+			started: []*url.URL{urls[1], urls[1]},
+			want:    urls[0],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewPowerOfTwoChoicesBalancer()
+			for _, u := range tt.started {
+				b.RequestStarted(u)
+			}
+			for i := 0; i < 10; i++ {
+				if got := b.Pick(tt.urls, &http.Request{}); got != tt.want {
+					t.Errorf("powerOfTwoChoicesBalancer.Pick() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPowerOfTwoChoicesBalancer_RequestFinished(t *testing.T) {
+	urls := testURLs()
+	b := NewPowerOfTwoChoicesBalancer()
+	b.RequestStarted(urls[0])
+	b.RequestStarted(urls[1])
+	b.RequestStarted(urls[1])
+	b.RequestFinished(urls[1], time.Millisecond)
+	b.RequestFinished(urls[1], time.Millisecond)
+
+	picks := make(map[*url.URL]int)
+	for i := 0; i < 100; i++ {
+		picks[b.Pick(urls[:2], &http.Request{})]++
+	}
+	if picks[urls[1]] != 100 {
+		t.Errorf("powerOfTwoChoicesBalancer.Pick() = %v, want only %v", picks, urls[1])
+	}
+}
+
+// balancerStateSize returns the number of entries
+// a built-in Balancer keeps for the URLs
+func balancerStateSize(b Balancer) int {
+	switch b := b.(type) {
+	case *weightedRoundRobinBalancer:
+		return len(b.weights) + len(b.current)
+	case *leastConnectionsBalancer:
+		return len(b.connections)
+	case *weightedLeastConnectionsBalancer:
+		return len(b.connections) + len(b.weights)
+	case *weightedResponseTimeBalancer:
+		return len(b.responseTimes)
+	case *powerOfTwoChoicesBalancer:
+		size := 0
+		b.inFlight.Range(func(key, value interface{}) bool {
+			size++
+			return true
+		})
+		return size
+	}
+	return 0
+}
+
+func TestForgettingBalancer_Forget(t *testing.T) {
+	tests := []struct {
+		name     string
+		balancer Balancer
+	}{
+		{name: "weighted round robin", balancer: NewWeightedRoundRobinBalancer()},
+		{name: "least connections", balancer: NewLeastConnectionsBalancer()},
+		{name: "weighted least connections", balancer: NewWeightedLeastConnectionsBalancer()},
+		{name: "weighted response time", balancer: NewWeightedResponseTimeBalancer()},
+		{name: "power of two choices", balancer: NewPowerOfTwoChoicesBalancer()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			urls := testURLs()
+			for _, v := range urls {
+				if weightedBalancer, ok := tt.balancer.(WeightedBalancer); ok {
+					weightedBalancer.SetWeight(v, 2)
+				}
+				tt.balancer.RequestStarted(v)
+				tt.balancer.RequestFinished(v, time.Millisecond)
+			}
+			tt.balancer.Pick(urls, &http.Request{})
+			if balancerStateSize(tt.balancer) == 0 {
+				t.Fatal("balancer keeps no state for the URLs")
+			}
+
+			forgetting, ok := tt.balancer.(ForgettingBalancer)
+			if !ok {
+				t.Fatal("balancer does not implement ForgettingBalancer")
+			}
+			for _, v := range urls {
+				forgetting.Forget(v)
+			}
+			if got := balancerStateSize(tt.balancer); got != 0 {
+				t.Errorf("balancer keeps %v entries once every URL is forgotten, want 0", got)
+			}
+		})
+	}
+}
+
+func TestConsistentHashBalancer_Pick(t *testing.T) {
+	urls := testURLs()
+	b := NewConsistentHashBalancer(HashByHeader("X-User"), 0)
+
+	picks := make(map[string]*url.URL)
+	for i := 0; i < 1000; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		request := &http.Request{Header: http.Header{"X-User": []string{user}}}
+		picks[user] = b.Pick(urls, request)
+		if again := b.Pick(urls, request); again != picks[user] {
+			t.Fatalf("consistentHashBalancer.Pick() = %v, want %v for the same key", again, picks[user])
+		}
+	}
+
+	moved := 0
+	for user, previous := range picks {
+		request := &http.Request{Header: http.Header{"X-User": []string{user}}}
+		got := b.Pick(urls[:2], request)
+		if previous != urls[2] && got != previous {
+			moved++
+		}
+		if got == urls[2] {
+			t.Fatalf("consistentHashBalancer.Pick() = %v, which has been removed", got)
+		}
+	}
+	if moved > 0 {
+		t.Errorf("consistentHashBalancer.Pick() moved %d keys that were not on the removed URL", moved)
+	}
+}
+
+func TestConsistentHashBalancer_Pick_concurrentSubsets(t *testing.T) {
+	urls := testURLs()
+	b := NewConsistentHashBalancer(HashByHeader("X-User"), 0).(*consistentHashBalancer)
+	subsets := [][]*url.URL{urls[:2], urls[1:]}
+
+	var wg sync.WaitGroup
+	var outside int64
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				subset := subsets[(g+i)%2]
+				request := &http.Request{Header: http.Header{"X-User": []string{fmt.Sprintf("user-%d", i)}}}
+				got := b.Pick(subset, request)
+				if got != subset[0] && got != subset[1] {
+					atomic.AddInt64(&outside, 1)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if outside > 0 {
+		t.Errorf("consistentHashBalancer.Pick() returned a URL outside of urls %d times", outside)
+	}
+	if got := len(b.ring.members); got != len(urls) {
+		t.Errorf("consistentHashBalancer ring holds %d URLs, want %d", got, len(urls))
+	}
+}
+
+func TestHashKeys(t *testing.T) {
+	request, _ := http.NewRequest("GET", "http://localhost/users/42/orders", nil)
+	request.RemoteAddr = "192.168.1.7:52431"
+	request.Header.Set("X-User", "alice")
+	request.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+
+	tests := []struct {
+		name    string
+		hashKey func(*http.Request) string
+		want    string
+	}{
+		{
+			name:    "client IP",
+			hashKey: HashByClientIP,
+			want:    "192.168.1.7",
+		},
+		{
+			name:    "header",
+			hashKey: HashByHeader("X-User"),
+			want:    "alice",
+		},
+		{
+			name:    "missing header",
+			hashKey: HashByHeader("X-Tenant"),
+			want:    "",
+		},
+		{
+			name:    "cookie",
+			hashKey: HashByCookie("session"),
+			want:    "abc",
+		},
+		{
+			name:    "missing cookie",
+			hashKey: HashByCookie("tracking"),
+			want:    "",
+		},
+		{
+			name:    "path segment",
+			hashKey: HashByPathSegment(1),
+			want:    "42",
+		},
+		{
+			name:    "path segment out of range",
+			hashKey: HashByPathSegment(5),
+			want:    "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hashKey(request); got != tt.want {
+				t.Errorf("hash key = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package flashx
+
+import (
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCircuitFailureRatio     = 0.5
+	defaultCircuitMinRequests      = 20
+	defaultCircuitInterval         = 10 * time.Second
+	defaultCircuitOpenDuration     = 30 * time.Second
+	defaultCircuitHalfOpenRequests = 1
+)
+
+const (
+	circuitClosed int32 = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// CircuitBreaker provides configuration options for the circuit
+// breaker that wraps every URL.
+// While the circuit of a URL is closed, requests flow normally.
+// Once the ratio of failed requests crosses FailureRatio, the circuit
+// opens and the URL is skipped for OpenDuration.
+// The circuit then turns half-open and lets up to HalfOpenRequests probe
+// requests through at a time: the circuit closes once HalfOpenRequests
+// of them succeed, and opens again as soon as one of them fails
+type CircuitBreaker struct {
+	// FailureRatio is the ratio of failed requests,
+	// between 0 and 1, that opens the circuit
+	// If not set, a default value will be picked up
+	FailureRatio float64
+
+	// MinRequests is the number of requests a URL needs to serve
+	// within Interval before its FailureRatio is checked
+	// If not set, a default value will be picked up
+	MinRequests int
+
+	// Interval is the window over which the
+	// failed requests are counted
+	// If not set, a default value will be picked up
+	Interval time.Duration
+
+	// OpenDuration is the time the circuit stays open
+	// before probe requests are let through
+	// If not set, a default value will be picked up
+	OpenDuration time.Duration
+
+	// HalfOpenRequests is the number of probe requests let
+	// through at a time while the circuit is half-open
+	// If not set, a default value will be picked up
+	HalfOpenRequests int
+}
+
+// CircuitOpenError is passed to the ErrorHandler when the circuit
+// breaker is open for every URL that is up
+type CircuitOpenError struct {
+	// URLs holds the URLs whose circuit is open
+	URLs []*url.URL
+}
+
+func (err *CircuitOpenError) Error() string {
+	return "flashx: circuit breaker is open for every URL"
+}
+
+func (c *CircuitBreaker) setDefaults() {
+	if c.FailureRatio <= 0 {
+		c.FailureRatio = defaultCircuitFailureRatio
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = defaultCircuitMinRequests
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultCircuitInterval
+	}
+	if c.OpenDuration <= 0 {
+		c.OpenDuration = defaultCircuitOpenDuration
+	}
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = defaultCircuitHalfOpenRequests
+	}
+}
+
+func (e *Engine) setupCircuitBreaker() {
+	if e.CircuitBreaker == nil {
+		return
+	}
+	circuitBreaker := *e.CircuitBreaker
+	circuitBreaker.setDefaults()
+	e.circuitBreaker = &circuitBreaker
+}
+
+// circuit holds the circuit breaker state of a single URL.
+// A nil circuit is always closed.
+type circuit struct {
+	config *CircuitBreaker
+
+	// state is only written while holding mu, but can be
+	// read atomically to skip locking while the circuit is closed
+	state int32
+
+	mu          sync.Mutex
+	openUntil   time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	probes      int
+	successes   int
+}
+
+func newCircuit(config *CircuitBreaker) *circuit {
+	if config == nil {
+		return nil
+	}
+	return &circuit{config: config}
+}
+
+// allow reports whether the circuit lets a request through,
+// without taking one of the probes of a half-open circuit
+func (c *circuit) allow(now time.Time) bool {
+	if c == nil || atomic.LoadInt32(&c.state) == circuitClosed {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.allowLocked(now)
+}
+
+// acquire reports whether the circuit lets a request through, and takes
+// one of the probes if the circuit is half-open. The check and the probe
+// being taken are done at once, so that concurrent requests cannot take
+// more than HalfOpenRequests probes. The probe is given back by finished,
+// or by release if the request is not sent after all
+func (c *circuit) acquire(now time.Time) bool {
+	if c == nil || atomic.LoadInt32(&c.state) == circuitClosed {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.allowLocked(now) {
+		return false
+	}
+	if c.state == circuitHalfOpen {
+		c.probes++
+	}
+	return true
+}
+
+// allowLocked turns an open circuit half-open once OpenDuration
+// has elapsed, and reports whether a request may be let through.
+// It must be called while holding mu
+func (c *circuit) allowLocked(now time.Time) bool {
+	switch c.state {
+	case circuitOpen:
+		if now.Before(c.openUntil) {
+			return false
+		}
+		c.probes = 0
+		c.successes = 0
+		atomic.StoreInt32(&c.state, circuitHalfOpen)
+		return true
+	case circuitHalfOpen:
+		return c.probes < c.config.HalfOpenRequests
+	}
+	return true
+}
+
+// release gives back the probe taken by acquire
+// for a request that is not sent after all
+func (c *circuit) release() {
+	if c == nil || atomic.LoadInt32(&c.state) == circuitClosed {
+		return
+	}
+	c.mu.Lock()
+	c.releaseLocked()
+	c.mu.Unlock()
+}
+
+// releaseLocked gives back a probe of a half-open circuit.
+// It must be called while holding mu
+func (c *circuit) releaseLocked() {
+	if c.state == circuitHalfOpen && c.probes > 0 {
+		c.probes--
+	}
+}
+
+// finished records the outcome of a request
+func (c *circuit) finished(failed bool, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case circuitClosed:
+		if now.Sub(c.windowStart) >= c.config.Interval {
+			c.windowStart = now
+			c.requests = 0
+			c.failures = 0
+		}
+		c.requests++
+		if failed {
+			c.failures++
+		}
+		if c.requests >= c.config.MinRequests && float64(c.failures) >= c.config.FailureRatio*float64(c.requests) {
+			c.open(now)
+		}
+	case circuitHalfOpen:
+		c.releaseLocked()
+		if failed {
+			c.open(now)
+			return
+		}
+		c.successes++
+		if c.successes >= c.config.HalfOpenRequests {
+			c.windowStart = now
+			c.requests = 0
+			c.failures = 0
+			atomic.StoreInt32(&c.state, circuitClosed)
+		}
+	}
+}
+
+// stateName returns the name of the state of the circuit
+func (c *circuit) stateName() string {
+	if c == nil {
+		return "closed"
+	}
+	switch atomic.LoadInt32(&c.state) {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+func (c *circuit) open(now time.Time) {
+	c.openUntil = now.Add(c.config.OpenDuration)
+	atomic.StoreInt32(&c.state, circuitOpen)
+}
+
+// unavailableError returns the error passed to the
+// ErrorHandler when none of the URLs is available
+func (e *Engine) unavailableError() error {
+	now := time.Now()
+	var open []*url.URL
+	urls, backends := e.pool()
+	for _, v := range urls {
+		if b := backends[v]; b != nil && b.circuit != nil && b.up(now) {
+			open = append(open, v)
+		}
+	}
+	if len(open) > 0 {
+		return &CircuitOpenError{URLs: open}
+	}
+	return ErrNoAvailableURL
+}
@@ -0,0 +1,186 @@
+package flashx
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuit(t *testing.T) {
+	config := &CircuitBreaker{
+		FailureRatio:     0.5,
+		MinRequests:      4,
+		Interval:         time.Minute,
+		OpenDuration:     time.Second,
+		HalfOpenRequests: 2,
+	}
+	now := time.Now()
+	c := newCircuit(config)
+
+	for _, failed := range []bool{true, false, false} {
+		c.acquire(now)
+		c.finished(failed, now)
+	}
+	if !c.allow(now) {
+		t.Fatal("circuit.allow() = false below MinRequests, want true")
+	}
+	for _, failed := range []bool{false, true} {
+		c.acquire(now)
+		c.finished(failed, now)
+	}
+	if !c.allow(now) {
+		t.Fatal("circuit.allow() = false below FailureRatio, want true")
+	}
+	c.acquire(now)
+	c.finished(true, now)
+	if c.allow(now) {
+		t.Fatal("circuit.allow() = true after crossing FailureRatio, want false")
+	}
+
+	// half-open: two probes are let through, then the circuit
+	// opens again as soon as one of them fails
+	now = now.Add(config.OpenDuration)
+	for i := 0; i < config.HalfOpenRequests; i++ {
+		if !c.acquire(now) {
+			t.Fatalf("circuit.acquire() = false for half-open probe %d, want true", i)
+		}
+	}
+	if c.allow(now) || c.acquire(now) {
+		t.Fatal("circuit.acquire() = true once all half-open probes are in flight, want false")
+	}
+	// a probe that is not sent after all is given back
+	c.release()
+	if !c.acquire(now) {
+		t.Fatal("circuit.acquire() = false after a probe is released, want true")
+	}
+	c.finished(true, now)
+	if c.allow(now) {
+		t.Fatal("circuit.allow() = true after a failed half-open probe, want false")
+	}
+
+	// half-open probes succeeding close the circuit
+	now = now.Add(config.OpenDuration)
+	for i := 0; i < config.HalfOpenRequests; i++ {
+		c.acquire(now)
+	}
+	for i := 0; i < config.HalfOpenRequests; i++ {
+		c.finished(false, now)
+	}
+	if !c.allow(now) || !c.allow(now) || !c.allow(now) {
+		t.Fatal("circuit.allow() = false after successful half-open probes, want true")
+	}
+}
+
+func TestEngine_circuitBreaker(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	var gotErr error
+	e := &Engine{
+		URLs:                  []string{broken.URL},
+		LoadBalancingStrategy: RoundRobin,
+		CircuitBreaker: &CircuitBreaker{
+			MinRequests:  2,
+			OpenDuration: time.Minute,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			gotErr = err
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	codes := make([]int, 0)
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		e.Initiate(w, httptest.NewRequest("GET", "http://flashx/", nil))
+		codes = append(codes, w.Code)
+	}
+	want := []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusServiceUnavailable}
+	for index := range want {
+		if codes[index] != want[index] {
+			t.Fatalf("Engine.Initiate() status codes = %v, want %v", codes, want)
+		}
+	}
+
+	var circuitOpenError *CircuitOpenError
+	if !errors.As(gotErr, &circuitOpenError) {
+		t.Fatalf("Engine.Initiate() error = %v, want a *CircuitOpenError", gotErr)
+	}
+	if len(circuitOpenError.URLs) != 1 || circuitOpenError.URLs[0].String() != broken.URL {
+		t.Errorf("CircuitOpenError.URLs = %v, want [%v]", circuitOpenError.URLs, broken.URL)
+	}
+}
+
+func TestEngine_circuitBreaker_halfOpen(t *testing.T) {
+	var recovered int32
+	var probes int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&recovered) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		atomic.AddInt32(&probes, 1)
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer backend.Close()
+
+	e := &Engine{
+		URLs: []string{backend.URL},
+		CircuitBreaker: &CircuitBreaker{
+			MinRequests:      2,
+			OpenDuration:     20 * time.Millisecond,
+			HalfOpenRequests: 2,
+		},
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	for i := 0; i < 2; i++ {
+		e.Initiate(httptest.NewRecorder(), httptest.NewRequest("GET", "http://flashx/", nil))
+	}
+	atomic.StoreInt32(&recovered, 1)
+	time.Sleep(30 * time.Millisecond)
+
+	// the probes are taken as the URL is picked,
+	// before any of the requests is sent
+	var picked []*url.URL
+	for i := 0; i < 5; i++ {
+		if routeURL := e.getURL(httptest.NewRequest("GET", "http://flashx/", nil)); routeURL != nil {
+			picked = append(picked, routeURL)
+		}
+	}
+	if len(picked) != 2 {
+		t.Fatalf("Engine.getURL() picked the half-open URL %v times, want 2", len(picked))
+	}
+	for _, routeURL := range picked {
+		e.releaseURL(routeURL)
+	}
+
+	// the requests arriving at once while the circuit is
+	// half-open share the probes, the others are not routed
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.Initiate(httptest.NewRecorder(), httptest.NewRequest("GET", "http://flashx/", nil))
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&probes); got < 1 || got > 2 {
+		t.Errorf("probes sent to the half-open URL = %v, want 1 or 2", got)
+	}
+}
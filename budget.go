@@ -0,0 +1,190 @@
+package flashx
+
+import (
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRetryBudgetRatio               = 0.2
+	defaultRetryBudgetMinRetriesPerSecond = 10
+	defaultRetryBudgetWindow              = 10 * time.Second
+)
+
+// RetryBudget provides configuration options to bound the number of
+// retries, so that retries do not pile up on top of an outage.
+// Within Window, retries may be at most Ratio of the requests that
+// succeeded, plus MinRetriesPerSecond for every second of the Window.
+// The budget is tracked for the Engine as a whole, and for every URL
+// for the retries of requests that failed on it.
+// A retry is only allowed if both budgets allow it
+type RetryBudget struct {
+	// Ratio is the ratio of retries to successful
+	// requests, between 0 and 1, that is allowed
+	// If not set, a default value will be picked up
+	Ratio float64
+
+	// MinRetriesPerSecond is the number of retries per
+	// second that is allowed regardless of Ratio
+	// If not set, a default value will be picked up
+	MinRetriesPerSecond int
+
+	// Window is the period over which the
+	// requests and retries are counted
+	// If not set, a default value will be picked up
+	Window time.Duration
+}
+
+// RetryStats holds the number of retries that
+// the retry budget allowed and denied
+type RetryStats struct {
+	Allowed int64
+	Denied  int64
+}
+
+func (b *RetryBudget) setDefaults() {
+	if b.Ratio <= 0 {
+		b.Ratio = defaultRetryBudgetRatio
+	}
+	if b.MinRetriesPerSecond <= 0 {
+		b.MinRetriesPerSecond = defaultRetryBudgetMinRetriesPerSecond
+	}
+	if b.Window < time.Second {
+		b.Window = defaultRetryBudgetWindow
+	}
+}
+
+// budgetBucket counts the requests of a single second
+type budgetBucket struct {
+	second    int64
+	successes int
+	retries   int
+}
+
+// retryBudget tracks the retries of the Engine or of a single URL.
+// A nil retryBudget allows every retry.
+type retryBudget struct {
+	config *RetryBudget
+
+	mu      sync.Mutex
+	buckets []budgetBucket
+
+	allowed int64
+	denied  int64
+}
+
+func newRetryBudget(config *RetryBudget) *retryBudget {
+	if config == nil {
+		return nil
+	}
+	return &retryBudget{
+		config:  config,
+		buckets: make([]budgetBucket, int(config.Window/time.Second)),
+	}
+}
+
+// bucket returns the bucket of the current second.
+// It must be called while holding mu
+func (b *retryBudget) bucket(now time.Time) *budgetBucket {
+	second := now.Unix()
+	bucket := &b.buckets[second%int64(len(b.buckets))]
+	if bucket.second != second {
+		*bucket = budgetBucket{second: second}
+	}
+	return bucket
+}
+
+// balance returns the number of retries left in the window.
+// It must be called while holding mu
+func (b *retryBudget) balance(now time.Time) float64 {
+	second := now.Unix()
+	successes, retries := 0, 0
+	for _, bucket := range b.buckets {
+		if second-bucket.second < int64(len(b.buckets)) {
+			successes += bucket.successes
+			retries += bucket.retries
+		}
+	}
+	return b.config.Ratio*float64(successes) +
+		float64(b.config.MinRetriesPerSecond*len(b.buckets)) -
+		float64(retries)
+}
+
+// succeeded records a request that succeeded
+func (b *retryBudget) succeeded(now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.bucket(now).successes++
+	b.mu.Unlock()
+}
+
+func (b *retryBudget) stats() RetryStats {
+	return RetryStats{
+		Allowed: atomic.LoadInt64(&b.allowed),
+		Denied:  atomic.LoadInt64(&b.denied),
+	}
+}
+
+// spendRetry withdraws a retry from every budget and reports whether
+// they all allowed it. Nothing is withdrawn unless they all did
+func spendRetry(now time.Time, budgets ...*retryBudget) bool {
+	allowed := true
+	for _, b := range budgets {
+		if b == nil {
+			continue
+		}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.balance(now) < 1 {
+			allowed = false
+		}
+	}
+	for _, b := range budgets {
+		if b == nil {
+			continue
+		}
+		if allowed {
+			b.bucket(now).retries++
+			atomic.AddInt64(&b.allowed, 1)
+		} else {
+			atomic.AddInt64(&b.denied, 1)
+		}
+	}
+	return allowed
+}
+
+// allowRetry reports whether the retry of a request that failed
+// on routeURL fits within the retry budgets
+func (e *Engine) allowRetry(routeURL *url.URL) bool {
+	var budget *retryBudget
+	if b := e.backend(routeURL); b != nil {
+		budget = b.retryBudget
+	}
+	return spendRetry(time.Now(), e.retryBudget, budget)
+}
+
+// RetryStats returns the number of retries that
+// the retry budget of the Engine allowed and denied
+func (e *Engine) RetryStats() RetryStats {
+	if e.retryBudget == nil {
+		return RetryStats{}
+	}
+	return e.retryBudget.stats()
+}
+
+// URLRetryStats returns the number of retries of requests
+// that failed on each URL that the retry budget allowed and denied
+func (e *Engine) URLRetryStats() map[string]RetryStats {
+	stats := make(map[string]RetryStats)
+	urls, backends := e.pool()
+	for _, v := range urls {
+		if b := backends[v]; b != nil && b.retryBudget != nil {
+			stats[v.String()] = b.retryBudget.stats()
+		}
+	}
+	return stats
+}
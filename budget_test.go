@@ -0,0 +1,108 @@
+package flashx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSpendRetry(t *testing.T) {
+	config := &RetryBudget{
+		Ratio:               0.5,
+		MinRetriesPerSecond: 1,
+		Window:              time.Second,
+	}
+	now := time.Now()
+	engineBudget := newRetryBudget(config)
+	urlBudget := newRetryBudget(config)
+
+	if !spendRetry(now, engineBudget, urlBudget) {
+		t.Fatal("spendRetry() = false within MinRetriesPerSecond, want true")
+	}
+	if spendRetry(now, engineBudget, urlBudget) {
+		t.Fatal("spendRetry() = true once the budget is spent, want false")
+	}
+
+	// successful requests only refill the budgets they are recorded on
+	for i := 0; i < 4; i++ {
+		engineBudget.succeeded(now)
+	}
+	if spendRetry(now, engineBudget, urlBudget) {
+		t.Fatal("spendRetry() = true while the URL budget is spent, want false")
+	}
+	for i := 0; i < 4; i++ {
+		urlBudget.succeeded(now)
+	}
+	for i := 0; i < 2; i++ {
+		if !spendRetry(now, engineBudget, urlBudget) {
+			t.Fatalf("spendRetry() = false for retry %d within Ratio, want true", i)
+		}
+	}
+	if spendRetry(now, engineBudget, urlBudget) {
+		t.Fatal("spendRetry() = true once Ratio is crossed, want false")
+	}
+
+	// the window moves on
+	if !spendRetry(now.Add(config.Window), engineBudget, urlBudget) {
+		t.Fatal("spendRetry() = false in a new window, want true")
+	}
+
+	want := RetryStats{Allowed: 4, Denied: 3}
+	if got := engineBudget.stats(); got != want {
+		t.Errorf("retryBudget.stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestEngine_retryBudget(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	backend := newTestBackend("backend")
+	defer backend.Close()
+
+	e := &Engine{
+		URLs:                  []string{unavailable.URL, backend.URL},
+		LoadBalancingStrategy: RoundRobin,
+		Retry: &Retry{
+			Backoff: time.Millisecond,
+			Budget: &RetryBudget{
+				Ratio:               0.01,
+				MinRetriesPerSecond: 1,
+				Window:              time.Second,
+			},
+		},
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	// round robin sends every other request to the unavailable URL,
+	// which is retried until the budget runs out
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatal("Engine.Initiate() kept retrying, want the retry budget to run out")
+		}
+		w := httptest.NewRecorder()
+		e.Initiate(w, httptest.NewRequest("GET", "http://flashx/", nil))
+		if w.Code == http.StatusServiceUnavailable {
+			break
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("Engine.Initiate() status = %v, want %v", w.Code, http.StatusOK)
+		}
+	}
+
+	stats := e.RetryStats()
+	if stats.Allowed < 1 || stats.Denied != 1 {
+		t.Errorf("Engine.RetryStats() = %+v, want at least 1 allowed and 1 denied", stats)
+	}
+	if got := e.URLRetryStats()[unavailable.URL]; got != stats {
+		t.Errorf("Engine.URLRetryStats()[%v] = %+v, want %+v", unavailable.URL, got, stats)
+	}
+	if got := e.URLRetryStats()[backend.URL]; got != (RetryStats{}) {
+		t.Errorf("Engine.URLRetryStats()[%v] = %+v, want no retries", backend.URL, got)
+	}
+}
@@ -0,0 +1,160 @@
+package flashx
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIPKey is the context key of the client IP of a request
+type clientIPKey struct{}
+
+// ClientIP returns the IP of the client that sent the request.
+// For the requests routed by an Engine, a Router or a Split with
+// TrustedProxies, such as the ones passed to ModifyRequest,
+// ErrorHandler, HashKey or OnAccessDenied, it is the IP the trusted
+// proxies forwarded the request for. Otherwise it is the IP of the
+// remote address
+func ClientIP(request *http.Request) net.IP {
+	if ip, ok := request.Context().Value(clientIPKey{}).(net.IP); ok {
+		return ip
+	}
+	return remoteIP(request)
+}
+
+// Headers the trusted proxies can write the client IP into
+const (
+	headerForwarded     = "Forwarded"
+	headerXForwardedFor = "X-Forwarded-For"
+	headerXRealIP       = "X-Real-Ip"
+)
+
+var errUnknownForwardedHeader = errors.New("Forwarded header needs to be X-Forwarded-For, Forwarded or X-Real-IP")
+
+// clientIPResolver resolves the client IP of the requests
+// coming from the trusted proxies from the header they write
+type clientIPResolver struct {
+	trustedSet *ipSet
+
+	header string
+}
+
+// newClientIPResolver returns the resolver of the client IPs forwarded by
+// trustedProxies in header, or nil if trustedProxies is empty
+func newClientIPResolver(trustedProxies []string, header string) (*clientIPResolver, error) {
+	header = http.CanonicalHeaderKey(header)
+	switch header {
+	case "":
+		header = headerXForwardedFor
+	case headerForwarded, headerXForwardedFor, headerXRealIP:
+	default:
+		return nil, errUnknownForwardedHeader
+	}
+	trustedSet, err := newIPListSet(trustedProxies)
+	if err != nil || trustedSet == nil {
+		return nil, err
+	}
+	return &clientIPResolver{trustedSet: trustedSet, header: header}, nil
+}
+
+// withClientIP resolves the client IP of the request and returns a copy
+// of the request carrying it. A nil resolver returns the request as is
+func (r *clientIPResolver) withClientIP(request *http.Request) *http.Request {
+	if r == nil {
+		return request
+	}
+	ip := r.resolve(request)
+	return request.WithContext(context.WithValue(request.Context(), clientIPKey{}, ip))
+}
+
+// withClientIP returns a copy of the request carrying
+// its client IP, as forwarded by TrustedProxies
+func (e *Engine) withClientIP(request *http.Request) *http.Request {
+	e.mu.RLock()
+	clientIPs := e.clientIPs
+	e.mu.RUnlock()
+	return clientIPs.withClientIP(request)
+}
+
+// resolve returns the client IP of a request. If the request comes
+// from a trusted proxy, the addresses the request went through are
+// read from the header the proxies write, and walked from the closest
+// one. The other headers are ignored, since the proxies pass them on
+// as the client sent them. The client IP is the first address that is
+// not trusted, since the addresses before it may have been written by
+// the client itself
+func (r *clientIPResolver) resolve(request *http.Request) net.IP {
+	ip := remoteIP(request)
+	if !r.trustedSet.contains(ip) {
+		return ip
+	}
+
+	var hops []net.IP
+	switch values := request.Header.Values(r.header); r.header {
+	case headerForwarded:
+		hops = forwardedHops(values)
+	case headerXForwardedFor:
+		hops = forwardedForHops(values)
+	case headerXRealIP:
+		if len(values) > 0 {
+			hops = []net.IP{parseNode(values[len(values)-1])}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i] == nil {
+			// an unknown or obfuscated address hides the ones before it
+			break
+		}
+		ip = hops[i]
+		if !r.trustedSet.contains(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedHops returns the for parameters of the
+// elements of the RFC 7239 Forwarded header values
+func forwardedHops(values []string) []net.IP {
+	var hops []net.IP
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				index := strings.Index(pair, "=")
+				if index < 0 || !strings.EqualFold(strings.TrimSpace(pair[:index]), "for") {
+					continue
+				}
+				hops = append(hops, parseNode(pair[index+1:]))
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedForHops returns the addresses of the X-Forwarded-For header values
+func forwardedForHops(values []string) []net.IP {
+	var hops []net.IP
+	for _, value := range values {
+		for _, node := range strings.Split(value, ",") {
+			hops = append(hops, parseNode(node))
+		}
+	}
+	return hops
+}
+
+// parseNode parses a node such as 192.0.2.60, "192.0.2.60:4711"
+// or "[2001:db8::17]:4711", and returns nil for the nodes
+// that are not an IP, such as unknown or _hidden
+func parseNode(node string) net.IP {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if strings.HasPrefix(node, "[") {
+		if index := strings.Index(node, "]"); index > 0 {
+			node = node[1:index]
+		}
+	} else if strings.Count(node, ":") == 1 {
+		node = node[:strings.Index(node, ":")]
+	}
+	return net.ParseIP(node)
+}
@@ -0,0 +1,166 @@
+package flashx
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientIPResolver_resolve(t *testing.T) {
+	tests := []struct {
+		name            string
+		forwardedHeader string
+		remoteAddr      string
+		header          http.Header
+		want            string
+	}{
+		{
+			name:       "untrusted remote address",
+			remoteAddr: "192.0.2.1:5678",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.7"}},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "trusted proxy without a header",
+			remoteAddr: "10.0.0.1:5678",
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "X-Forwarded-For",
+			remoteAddr: "10.0.0.1:5678",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.3, 203.0.113.7, 10.0.0.2"}},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "X-Forwarded-For over several lines",
+			remoteAddr: "10.0.0.1:5678",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.7", "10.0.0.2"}},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "X-Forwarded-For of trusted proxies only",
+			remoteAddr: "10.0.0.1:5678",
+			header:     http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "invalid X-Forwarded-For",
+			remoteAddr: "10.0.0.1:5678",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.7, garbage"}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "Forwarded sent by the client",
+			remoteAddr: "10.0.0.1:5678",
+			header: http.Header{
+				"Forwarded":       {"for=1.2.3.4"},
+				"X-Real-Ip":       {"1.2.3.4"},
+				"X-Forwarded-For": {"198.51.100.9"},
+			},
+			want: "198.51.100.9",
+		},
+		{
+			name:            "Forwarded",
+			forwardedHeader: "forwarded",
+			remoteAddr:      "[2001:db8::1]:5678",
+			header: http.Header{
+				"Forwarded":       {`for=192.0.2.60;proto=http, For="[2001:db8:cafe::17]:4711"`},
+				"X-Forwarded-For": {"203.0.113.7"},
+			},
+			want: "192.0.2.60",
+		},
+		{
+			name:            "Forwarded with an obfuscated node",
+			forwardedHeader: "Forwarded",
+			remoteAddr:      "10.0.0.1:5678",
+			header:          http.Header{"Forwarded": {`for=192.0.2.60, for=_hidden, for="10.0.0.2:80"`}},
+			want:            "10.0.0.2",
+		},
+		{
+			name:            "X-Real-IP",
+			forwardedHeader: "X-Real-IP",
+			remoteAddr:      "10.0.0.1:5678",
+			header: http.Header{
+				"X-Real-Ip":       {"203.0.113.7"},
+				"X-Forwarded-For": {"198.51.100.9"},
+			},
+			want: "203.0.113.7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "http://flashx/", nil)
+			request.RemoteAddr = tt.remoteAddr
+			request.Header = tt.header
+			if request.Header == nil {
+				request.Header = http.Header{}
+			}
+			r, err := newClientIPResolver([]string{"10.0.0.0/8", "2001:db8::/32"}, tt.forwardedHeader)
+			if err != nil {
+				t.Fatalf("newClientIPResolver() error = %v", err)
+			}
+			if got := r.resolve(request); got.String() != tt.want {
+				t.Errorf("clientIPResolver.resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngine_Initiate_clientIP(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	var logs bytes.Buffer
+	var hashKeys []string
+	e := &Engine{
+		URLs:           []string{server.URL},
+		TrustedProxies: []string{"10.0.0.0/8"},
+		BlacklistIPs:   []string{"203.0.113.0/24"},
+		HashKey: func(request *http.Request) string {
+			hashKeys = append(hashKeys, HashByClientIP(request))
+			return ""
+		},
+		LoadBalancingStrategy: ConsistentHash,
+		ErrorLog:              log.New(&logs, "", 0),
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	// the load balancer is not blacklisted, the client is
+	request := httptest.NewRequest("GET", "http://flashx/", nil)
+	request.RemoteAddr = "10.0.0.1:5678"
+	request.Header.Set("X-Forwarded-For", "203.0.113.7")
+	w := httptest.NewRecorder()
+	e.Initiate(w, request)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Engine.Initiate() status = %v, want %v", w.Code, http.StatusForbidden)
+	}
+
+	request = httptest.NewRequest("GET", "http://flashx/", nil)
+	request.RemoteAddr = "10.0.0.1:5678"
+	request.Header.Set("X-Forwarded-For", "198.51.100.3")
+	e.Initiate(httptest.NewRecorder(), request)
+	if len(hashKeys) != 1 || hashKeys[0] != "198.51.100.3" {
+		t.Errorf("HashByClientIP() = %v, want [198.51.100.3]", hashKeys)
+	}
+	if !strings.Contains(logs.String(), "proxy error for 198.51.100.3") {
+		t.Errorf("Engine.Initiate() logged %q, want the client IP", logs.String())
+	}
+	if got := ClientIP(request); got.String() != "10.0.0.1" {
+		t.Errorf("ClientIP() = %v outside of the Engine, want 10.0.0.1", got)
+	}
+}
+
+func TestNewClientIPResolver(t *testing.T) {
+	if r, err := newClientIPResolver(nil, ""); r != nil || err != nil {
+		t.Errorf("newClientIPResolver() = %v, %v without trusted proxies, want nil, nil", r, err)
+	}
+	if _, err := newClientIPResolver([]string{"10.0.0.0/8"}, "X-Client-IP"); err != errUnknownForwardedHeader {
+		t.Errorf("newClientIPResolver() error = %v, want %v", err, errUnknownForwardedHeader)
+	}
+}
@@ -0,0 +1,91 @@
+package flashx
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// clientLimiter holds a token bucket per client IP, refilled at rate
+// tokens per second up to rate tokens. Buckets that are full again
+// are swept away, so idle clients do not hold on to memory
+type clientLimiter struct {
+	rate float64
+
+	mu sync.Mutex
+
+	buckets map[string]*tokenBucket
+
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newClientLimiter returns a limiter of numberOfRequestsPerSecond per
+// client, or nil if numberOfRequestsPerSecond is not positive
+func newClientLimiter(numberOfRequestsPerSecond int) *clientLimiter {
+	if numberOfRequestsPerSecond <= 0 {
+		return nil
+	}
+	return &clientLimiter{
+		rate:      float64(numberOfRequestsPerSecond),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of the client and reports
+// whether there was one. A nil limiter allows every request
+func (l *clientLimiter) allow(client string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// a bucket is full once it has been idle for a second
+	if now.Sub(l.lastSweep) >= time.Second {
+		for key, bucket := range l.buckets {
+			if now.Sub(bucket.last) >= time.Second {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.rate, last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.rate {
+		bucket.tokens = l.rate
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// limitClient denies the request if its client IP has gone over
+// NumberOfRequestsPerSecondPerClient, and reports whether it was denied
+func (e *Engine) limitClient(writer http.ResponseWriter, request *http.Request) bool {
+	e.mu.RLock()
+	limiter := e.clientLimiter
+	e.mu.RUnlock()
+	if limiter == nil {
+		return false
+	}
+	ip := ClientIP(request)
+	if limiter.allow(ip.String(), time.Now()) {
+		return false
+	}
+	e.deny(writer, request, AccessDenial{IP: ip, Reason: DenialRateLimited})
+	return true
+}
@@ -0,0 +1,74 @@
+package flashx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientLimiter_allow(t *testing.T) {
+	l := newClientLimiter(2)
+	now := time.Now()
+	steps := []struct {
+		name    string
+		client  string
+		elapsed time.Duration
+		want    bool
+	}{
+		{name: "first request", client: "a", want: true},
+		{name: "burst", client: "a", want: true},
+		{name: "over the limit", client: "a", want: false},
+		{name: "another client", client: "b", want: true},
+		{name: "refilled token", client: "a", elapsed: 500 * time.Millisecond, want: true},
+		{name: "over the limit again", client: "a", want: false},
+	}
+	for _, tt := range steps {
+		now = now.Add(tt.elapsed)
+		if got := l.allow(tt.client, now); got != tt.want {
+			t.Errorf("clientLimiter.allow() %v = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// idle clients are swept away
+	l.allow("c", now.Add(2*time.Second))
+	if len(l.buckets) != 1 {
+		t.Errorf("clientLimiter holds %v buckets, want 1", len(l.buckets))
+	}
+
+	var unlimited *clientLimiter
+	if !unlimited.allow("a", now) {
+		t.Error("clientLimiter.allow() = false for a nil limiter, want true")
+	}
+}
+
+func TestEngine_Initiate_rateLimitedClient(t *testing.T) {
+	backend := newTestBackend("backend")
+	defer backend.Close()
+
+	var denials []AccessDenial
+	e := &Engine{
+		URLs:                               []string{backend.URL},
+		NumberOfRequestsPerSecondPerClient: 1,
+		OnAccessDenied: func(request *http.Request, denial AccessDenial) {
+			denials = append(denials, denial)
+		},
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		request := httptest.NewRequest("GET", "http://flashx/", nil)
+		request.RemoteAddr = "192.0.2.1:5678"
+		w := httptest.NewRecorder()
+		e.Initiate(w, request)
+		if w.Code != want {
+			t.Errorf("Engine.Initiate() status = %v, want %v", w.Code, want)
+		}
+	}
+	if len(denials) != 1 || denials[0].Reason != DenialRateLimited {
+		t.Errorf("OnAccessDenied() denials = %+v, want one rate limited", denials)
+	}
+}
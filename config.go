@@ -0,0 +1,428 @@
+package flashx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const defaultConfigWatchInterval = 2 * time.Second
+
+var errWatchBeforeSetup = errors.New("flashx: WatchConfig needs to be called after Setup")
+
+// Config describes an Engine in a YAML or JSON file, or a Router
+// along with the Engines of its pools when it has routes.
+// Durations are written as strings such as "500ms" or "10s".
+//
+//	strategy: weighted_round_robin
+//	requests_per_second: 100
+//	urls:
+//	  - http://localhost:3000
+//	  - url: http://localhost:4000
+//	    weight: 2
+//	  - dnssrv+http://_web._tcp.backend.internal
+//	blacklist_ips:
+//	  - 192.168.1.7
+//	  - 10.20.0.0/16
+//	trusted_proxies:
+//	  - 10.0.0.0/8
+//	timeouts:
+//	  dial: 5s
+//	  response_header: 30s
+//	pools:
+//	  api:
+//	    strategy: round_robin
+//	    urls: [http://localhost:5000, http://localhost:5001]
+//	routes:
+//	  - host: api.example.com
+//	    path_prefix: /v1
+//	    strip_prefix: true
+//	    pool: api
+type Config struct {
+	// URLs holds the URLs to route requests to, either as plain
+	// strings or along with their weight
+	// The dns+ and dnssrv+ URLs of Engine.URLs are accepted as well
+	URLs []URLConfig `yaml:"urls"`
+
+	// Strategy holds the name of the load balancing strategy, such as
+	// round_robin, weighted_round_robin, least_connections,
+	// weighted_least_connections, weighted_response_time,
+	// consistent_hash or power_of_two_choices
+	// If not set, requests are routed to the first URL
+	Strategy string `yaml:"strategy"`
+
+	// RequestsPerSecond is the number of requests per second
+	// that are allowed through
+	// If not set, requests are not rate limited
+	RequestsPerSecond int `yaml:"requests_per_second"`
+
+	// RequestsPerSecondPerClient is the number of requests
+	// per second that are allowed through for each client IP
+	// If not set, clients are not rate limited
+	RequestsPerSecondPerClient int `yaml:"requests_per_second_per_client"`
+
+	// BlacklistIPs holds the IPs and CIDR ranges that need to be blacklisted
+	BlacklistIPs []string `yaml:"blacklist_ips"`
+
+	// WhitelistIPs holds the IPs and CIDR ranges that are allowed
+	// If set, requests from any other IP are forbidden
+	WhitelistIPs []string `yaml:"whitelist_ips"`
+
+	// TrustedProxies holds the IPs and CIDR ranges of the proxies
+	// that are trusted to forward the client IP
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// ForwardedHeader is the header the trusted proxies write the
+	// client IP into, either X-Forwarded-For, Forwarded or X-Real-IP
+	// If not set, X-Forwarded-For is used
+	ForwardedHeader string `yaml:"forwarded_header"`
+
+	// Timeouts holds the timeouts of the connections to the URLs
+	Timeouts TimeoutConfig `yaml:"timeouts"`
+
+	// Pools holds named pools of URLs that routes send requests to,
+	// each described like the Engine of the top level URLs
+	// The top level fields only apply to the top level URLs,
+	// except trusted_proxies and forwarded_header, which the
+	// Router uses to resolve the client IP of every request
+	Pools map[string]*Config `yaml:"pools"`
+
+	// Routes holds the routes of a Router. The requests that do
+	// not match any route are routed to the top level URLs, if any
+	Routes []RouteConfig `yaml:"routes"`
+}
+
+// URLConfig describes a URL in a config file
+type URLConfig struct {
+	URL string `yaml:"url"`
+
+	// Weight is the weight of the URL
+	// If not set, the URL has a weight of 1
+	Weight int `yaml:"weight"`
+}
+
+// UnmarshalYAML lets a URL be written either as a plain
+// string or as an object with a url and a weight
+func (u *URLConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var rawURL string
+	if err := unmarshal(&rawURL); err == nil {
+		*u = URLConfig{URL: rawURL}
+		return nil
+	}
+	type plain URLConfig
+	return unmarshal((*plain)(u))
+}
+
+// TimeoutConfig describes the timeouts of the
+// connections to the URLs in a config file.
+// If any of them is set, the Transport of the
+// Engine is replaced by one using them
+type TimeoutConfig struct {
+	// Dial is the time allowed to connect to a URL
+	Dial time.Duration `yaml:"dial"`
+
+	// TLSHandshake is the time allowed for the TLS handshake
+	TLSHandshake time.Duration `yaml:"tls_handshake"`
+
+	// ResponseHeader is the time allowed for a URL to
+	// respond with its headers once the request is sent
+	ResponseHeader time.Duration `yaml:"response_header"`
+
+	// IdleConn is the time an idle connection is kept open
+	IdleConn time.Duration `yaml:"idle_conn"`
+}
+
+// LoadConfig reads and validates a YAML or JSON config file
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+func parseConfig(data []byte) (*Config, error) {
+	config := &Config{}
+	// JSON documents are valid YAML documents
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	seen := make(map[string]bool)
+	for index := range c.URLs {
+		u := &c.URLs[index]
+		if isDiscoveryURL(u.URL) {
+			if _, err := newDNSDiscovery(u.URL, nil); err != nil {
+				return err
+			}
+		}
+		parsedURL, err := url.Parse(u.URL)
+		if err != nil {
+			return err
+		}
+		if parsedURL.Scheme == "" || parsedURL.Host == "" {
+			return fmt.Errorf("flashx: URL %q needs a scheme and a host", u.URL)
+		}
+		if seen[parsedURL.String()] {
+			return fmt.Errorf("flashx: URL %q is listed more than once", u.URL)
+		}
+		seen[parsedURL.String()] = true
+		if u.Weight == 0 {
+			u.Weight = 1
+		}
+		if u.Weight < 0 {
+			return errNonPositiveWeight
+		}
+	}
+	strategy, ok := strategyNames[c.Strategy]
+	if c.Strategy != "" && !ok {
+		return fmt.Errorf("%v: %q", ErrUnknownStrategy, c.Strategy)
+	}
+	if strategy != Nil && len(c.URLs) == 0 {
+		return errEmptyURLArrayWithLoadBalancer
+	}
+	if c.RequestsPerSecond < 0 {
+		return errors.New("flashx: requests_per_second cannot be negative")
+	}
+	if c.RequestsPerSecondPerClient < 0 {
+		return errors.New("flashx: requests_per_second_per_client cannot be negative")
+	}
+	for _, ips := range [][]string{c.BlacklistIPs, c.WhitelistIPs, c.TrustedProxies} {
+		for _, ip := range ips {
+			if _, err := parseIPEntry(ip); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := newClientIPResolver(nil, c.ForwardedHeader); err != nil {
+		return err
+	}
+	if c.Timeouts.Dial < 0 || c.Timeouts.TLSHandshake < 0 ||
+		c.Timeouts.ResponseHeader < 0 || c.Timeouts.IdleConn < 0 {
+		return errors.New("flashx: timeouts cannot be negative")
+	}
+	return c.validateRoutes()
+}
+
+func (c *Config) strategy() int {
+	return strategyNames[c.Strategy]
+}
+
+// transport returns a Transport using the configured
+// timeouts, or nil if none of them is set
+func (c *Config) transport() http.RoundTripper {
+	if c.Timeouts == (TimeoutConfig{}) {
+		return nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.Timeouts.Dial > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   c.Timeouts.Dial,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	if c.Timeouts.TLSHandshake > 0 {
+		transport.TLSHandshakeTimeout = c.Timeouts.TLSHandshake
+	}
+	if c.Timeouts.ResponseHeader > 0 {
+		transport.ResponseHeaderTimeout = c.Timeouts.ResponseHeader
+	}
+	if c.Timeouts.IdleConn > 0 {
+		transport.IdleConnTimeout = c.Timeouts.IdleConn
+	}
+	return transport
+}
+
+// Configure fills the fields of an Engine from the config.
+// Call it before Setup, and use ApplyConfig for an
+// Engine that is already serving requests.
+// Pools and routes are left out, use ConfigureRouter for them
+func (c *Config) Configure(e *Engine) {
+	e.URLs = make([]string, 0, len(c.URLs))
+	e.RoundRobinWeights = make([]int, 0, len(c.URLs))
+	for _, u := range c.URLs {
+		e.URLs = append(e.URLs, u.URL)
+		e.RoundRobinWeights = append(e.RoundRobinWeights, u.Weight)
+	}
+	e.LoadBalancingStrategy = c.strategy()
+	e.NumberOfRequestsPerSecond = c.RequestsPerSecond
+	e.NumberOfRequestsPerSecondPerClient = c.RequestsPerSecondPerClient
+	e.BlacklistIPs = c.BlacklistIPs
+	e.WhitelistIPs = c.WhitelistIPs
+	e.TrustedProxies = c.TrustedProxies
+	e.ForwardedHeader = c.ForwardedHeader
+	if transport := c.transport(); transport != nil {
+		e.Transport = transport
+	}
+	e.config = c
+}
+
+// ApplyConfig applies the config to an Engine that is serving requests.
+// The changes are applied at once, while holding the requests that are
+// about to pick a URL. URLs that are no longer listed are drained, so
+// the requests in flight to them are not dropped, and drained URLs that
+// are listed again are put back in rotation.
+// A custom Balancer is only replaced if the strategy changes
+func (e *Engine) ApplyConfig(config *Config) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	if config.hasRoutes() {
+		return errConfigWithRoutes
+	}
+
+	var drained []*backend
+	e.mu.Lock()
+	if e.discoveries == nil {
+		e.discoveries = make(map[string]*discoverySource)
+	}
+	listed := make(map[string]bool)
+	for _, u := range config.URLs {
+		if isDiscoveryURL(u.URL) {
+			listed[u.URL] = true
+			if source, ok := e.discoveries[u.URL]; ok {
+				source.weight = u.Weight
+				continue
+			}
+			source, err := e.newDiscoverySource(u.URL, u.Weight)
+			if err != nil {
+				e.mu.Unlock()
+				return err
+			}
+			e.discoveries[u.URL] = source
+			e.startDiscoveryLocked(source)
+			continue
+		}
+		routeURL, _ := url.Parse(u.URL)
+		listed[routeURL.String()] = true
+		if existing := e.findURL(routeURL.String()); existing != nil {
+			atomic.StoreInt32(&e.backends[existing].draining, 0)
+			e.setWeightLocked(existing, u.Weight)
+			continue
+		}
+		e.addLocked(routeURL, u.Weight)
+	}
+	for _, v := range e.urls {
+		if b := e.backends[v]; b.source == "" && !listed[v.String()] {
+			atomic.StoreInt32(&b.draining, 1)
+			drained = append(drained, b)
+		}
+	}
+	for key, source := range e.discoveries {
+		// the sources of Discoveries are not part of the config
+		if isDiscoveryURL(key) && !listed[key] {
+			drained = append(drained, e.stopDiscoveryLocked(source)...)
+			delete(e.discoveries, key)
+		}
+	}
+
+	previous := e.config
+	if previous == nil {
+		previous = &Config{}
+	}
+	if strategy := config.strategy(); previous.Strategy != config.Strategy || (e.balancer == nil && strategy != Nil) {
+		e.setStrategyLocked(strategy, newBalancer(strategy, e.HashKey))
+	}
+	if previous.RequestsPerSecond != config.RequestsPerSecond || e.limiter == nil {
+		e.limiter = newLimiter(config.RequestsPerSecond)
+		e.NumberOfRequestsPerSecond = config.RequestsPerSecond
+	}
+	if previous.RequestsPerSecondPerClient != config.RequestsPerSecondPerClient {
+		e.clientLimiter = newClientLimiter(config.RequestsPerSecondPerClient)
+		e.NumberOfRequestsPerSecondPerClient = config.RequestsPerSecondPerClient
+	}
+	if previous.Timeouts != config.Timeouts {
+		if transport, ok := e.Transport.(*http.Transport); ok && previous.Timeouts != (TimeoutConfig{}) {
+			transport.CloseIdleConnections()
+		}
+		e.Transport = config.transport()
+	}
+	e.BlacklistIPs = config.BlacklistIPs
+	e.WhitelistIPs = config.WhitelistIPs
+	e.blacklistSet, _ = newIPListSet(config.BlacklistIPs)
+	e.whitelistSet, _ = newIPListSet(config.WhitelistIPs)
+	e.TrustedProxies = config.TrustedProxies
+	e.ForwardedHeader = config.ForwardedHeader
+	e.clientIPs, _ = newClientIPResolver(config.TrustedProxies, config.ForwardedHeader)
+	e.config = config
+	e.mu.Unlock()
+
+	for _, b := range drained {
+		e.finishDrain(b)
+	}
+	return nil
+}
+
+// WatchConfig polls the config file every interval and applies it
+// whenever its content changes, until the Engine is closed.
+// A file that cannot be read or fails validation is logged and
+// rejected, and the config that was applied last stays active.
+// If interval is not set, a default value will be picked up.
+// It returns an error if the Engine has not been set up
+func (e *Engine) WatchConfig(path string, interval time.Duration) error {
+	return watchConfig(path, interval, e.done, e.logf, e.ApplyConfig)
+}
+
+// watchConfig polls the config file every interval
+// and applies it whenever its content changes, until done
+func watchConfig(path string, interval time.Duration, done <-chan struct{}, logf func(string, ...interface{}), apply func(*Config) error) error {
+	if done == nil {
+		// the watch could never be stopped
+		return errWatchBeforeSetup
+	}
+	if interval <= 0 {
+		interval = defaultConfigWatchInterval
+	}
+	last, _ := ioutil.ReadFile(path)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		readFailed := false
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				// the file may be in the middle of being replaced,
+				// only log the first failure
+				if !readFailed {
+					logf("flashx: config %s rejected: %v", path, err)
+				}
+				readFailed = true
+				continue
+			}
+			readFailed = false
+			if bytes.Equal(data, last) {
+				continue
+			}
+			last = data
+			config, err := parseConfig(data)
+			if err == nil {
+				err = apply(config)
+			}
+			if err != nil {
+				logf("flashx: config %s rejected: %v", path, err)
+				continue
+			}
+			logf("flashx: config %s applied", path)
+		}
+	}()
+	return nil
+}
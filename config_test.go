@@ -0,0 +1,219 @@
+package flashx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    *Config
+		wantErr bool
+	}{
+		{
+			name: "YAML",
+			data: `
+strategy: weighted_round_robin
+requests_per_second: 100
+urls:
+  - http://localhost:3000
+  - url: http://localhost:4000
+    weight: 2
+blacklist_ips:
+  - 192.168.1.7
+timeouts:
+  dial: 5s
+  response_header: 500ms
+`,
+			want: &Config{
+				URLs: []URLConfig{
+					{URL: "http://localhost:3000", Weight: 1},
+					{URL: "http://localhost:4000", Weight: 2},
+				},
+				Strategy:          "weighted_round_robin",
+				RequestsPerSecond: 100,
+				BlacklistIPs:      []string{"192.168.1.7"},
+				Timeouts: TimeoutConfig{
+					Dial:           5 * time.Second,
+					ResponseHeader: 500 * time.Millisecond,
+				},
+			},
+		},
+		{
+			name: "JSON",
+			data: `{"strategy": "round_robin", "urls": ["http://localhost:3000", {"url": "http://localhost:4000", "weight": 3}]}`,
+			want: &Config{
+				URLs: []URLConfig{
+					{URL: "http://localhost:3000", Weight: 1},
+					{URL: "http://localhost:4000", Weight: 3},
+				},
+				Strategy: "round_robin",
+			},
+		},
+		{
+			name:    "unknown field",
+			data:    "url: http://localhost:3000",
+			wantErr: true,
+		},
+		{
+			name:    "URL without a host",
+			data:    "urls: [localhost]",
+			wantErr: true,
+		},
+		{
+			name:    "URL listed more than once",
+			data:    "urls: [http://localhost:3000, http://localhost:3000]",
+			wantErr: true,
+		},
+		{
+			name:    "negative weight",
+			data:    "urls: [{url: http://localhost:3000, weight: -1}]",
+			wantErr: true,
+		},
+		{
+			name:    "unknown strategy",
+			data:    "strategy: random\nurls: [http://localhost:3000]",
+			wantErr: true,
+		},
+		{
+			name:    "strategy without URLs",
+			data:    "strategy: round_robin",
+			wantErr: true,
+		},
+		{
+			name: "trusted proxies",
+			data: "trusted_proxies: [10.0.0.0/8]\nrequests_per_second_per_client: 5",
+			want: &Config{
+				RequestsPerSecondPerClient: 5,
+				TrustedProxies:             []string{"10.0.0.0/8"},
+			},
+		},
+		{
+			name:    "invalid trusted proxy",
+			data:    "trusted_proxies: [10.0.0.0/33]",
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration",
+			data:    "timeouts: {dial: soon}",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConfig([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngine_ApplyConfig(t *testing.T) {
+	config, err := parseConfig([]byte("strategy: round_robin\nurls: [http://localhost:3000, http://localhost:4000]"))
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	e := &Engine{}
+	config.Configure(e)
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	config, err = parseConfig([]byte(`
+strategy: weighted_round_robin
+requests_per_second: 10
+urls:
+  - url: http://localhost:4000
+    weight: 2
+  - http://localhost:5000
+blacklist_ips: [192.168.1.7]
+`))
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	if err := e.ApplyConfig(config); err != nil {
+		t.Fatalf("Engine.ApplyConfig() error = %v", err)
+	}
+
+	want := map[string]int{"http://localhost:4000": 2, "http://localhost:5000": 1}
+	got := make(map[string]int)
+	for _, status := range e.Backends() {
+		got[status.URL] = status.Weight
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Engine.Backends() weights = %v, want %v", got, want)
+	}
+	if got := e.strategyName(); got != "weighted_round_robin" {
+		t.Errorf("Engine.strategyName() = %v, want %v", got, "weighted_round_robin")
+	}
+	if got := e.blacklistIPs(); !reflect.DeepEqual(got, []string{"192.168.1.7"}) {
+		t.Errorf("Engine.blacklistIPs() = %v, want [192.168.1.7]", got)
+	}
+	if e.NumberOfRequestsPerSecond != 10 {
+		t.Errorf("Engine.NumberOfRequestsPerSecond = %v, want 10", e.NumberOfRequestsPerSecond)
+	}
+
+	invalid := &Config{Strategy: "random", URLs: []URLConfig{{URL: "http://localhost:6000"}}}
+	if err := e.ApplyConfig(invalid); err == nil {
+		t.Fatal("Engine.ApplyConfig() error = nil for an invalid config, want an error")
+	}
+	if urls, _ := e.pool(); len(urls) != 2 {
+		t.Errorf("Engine.urls = %v after an invalid config, want it unchanged", urls)
+	}
+}
+
+func TestEngine_WatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flashx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flashx.yaml")
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("strategy: round_robin\nurls: [http://localhost:3000]")
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	e := &Engine{}
+	config.Configure(e)
+	if err := e.WatchConfig(path, 5*time.Millisecond); err != errWatchBeforeSetup {
+		t.Fatalf("Engine.WatchConfig() error = %v before Setup, want %v", err, errWatchBeforeSetup)
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+	if err := e.WatchConfig(path, 5*time.Millisecond); err != nil {
+		t.Fatalf("Engine.WatchConfig() error = %v", err)
+	}
+
+	write("strategy: round_robin\nurls: [http://localhost:3000, http://localhost:4000]")
+	waitFor(t, func() bool { return len(e.Backends()) == 2 })
+
+	// an invalid file is rejected, and the previous config stays active
+	write("strategy: round_robin\nurls: [http://localhost:3000, http://localhost:4000, localhost]")
+	time.Sleep(50 * time.Millisecond)
+	if got := len(e.Backends()); got != 2 {
+		t.Errorf("Engine.Backends() = %v URLs after an invalid config, want 2", got)
+	}
+
+	write("strategy: round_robin\nurls: [http://localhost:4000]")
+	waitFor(t, func() bool { return len(e.Backends()) == 1 })
+}
@@ -0,0 +1,168 @@
+package flashx
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+)
+
+// Target is a URL found by a Discovery
+type Target struct {
+	URL string
+
+	// Weight is the weight of the URL
+	// If not set, the weight of the discovery entry is used
+	Weight int
+
+	// Metadata holds labels describing the URL, such as its zone
+	Metadata map[string]string
+}
+
+// Discovery finds the URLs to route requests to, and keeps
+// looking for changes until its context is cancelled
+type Discovery interface {
+	// Run calls update with the complete list of URLs every time
+	// it changes, or with an error if the URLs could not be found,
+	// in which case the previous ones are kept
+	Run(ctx context.Context, update func(targets []Target, err error))
+}
+
+// discoverySource holds the state of a discovery entry.
+// The URLs it found are the backends having its key as their source
+type discoverySource struct {
+	key       string
+	discovery Discovery
+
+	// weight is used for the targets that do not have a weight
+	weight int
+
+	cancel  context.CancelFunc
+	stopped bool
+}
+
+func (e *Engine) resolver() Resolver {
+	if e.Resolver != nil {
+		return e.Resolver
+	}
+	return &NetResolver{}
+}
+
+// setupDiscoveries adds the sources of Discoveries,
+// the ones of the URLs are added by validateURLs
+func (e *Engine) setupDiscoveries() {
+	for index, discovery := range e.Discoveries {
+		key := fmt.Sprintf("discoveries[%d]", index)
+		e.discoveries[key] = &discoverySource{key: key, discovery: discovery, weight: 1}
+	}
+}
+
+// newDiscoverySource returns the source of a
+// dns+ or dnssrv+ entry of the URLs
+func (e *Engine) newDiscoverySource(rawURL string, weight int) (*discoverySource, error) {
+	discovery, err := newDNSDiscovery(rawURL, e.resolver())
+	if err != nil {
+		return nil, err
+	}
+	return &discoverySource{key: rawURL, discovery: discovery, weight: weight}, nil
+}
+
+func (e *Engine) startDiscoveries() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, source := range e.discoveries {
+		e.startDiscoveryLocked(source)
+	}
+}
+
+// startDiscoveryLocked runs the discovery of a source until
+// it is stopped or the Engine is closed.
+// It must be called while holding mu
+func (e *Engine) startDiscoveryLocked(source *discoverySource) {
+	ctx, cancel := context.WithCancel(context.Background())
+	source.cancel = cancel
+	go func() {
+		select {
+		case <-e.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go source.discovery.Run(ctx, func(targets []Target, err error) {
+		if err != nil {
+			e.logf("flashx: discovery %s failed: %v", source.key, err)
+			return
+		}
+		e.updateDiscovered(source, targets)
+	})
+}
+
+// stopDiscoveryLocked stops the discovery of a source,
+// and returns its backends once they are marked as draining.
+// It must be called while holding mu
+func (e *Engine) stopDiscoveryLocked(source *discoverySource) []*backend {
+	source.stopped = true
+	if source.cancel != nil {
+		source.cancel()
+	}
+	var drained []*backend
+	for _, v := range e.urls {
+		if b := e.backends[v]; b.source == source.key {
+			atomic.StoreInt32(&b.draining, 1)
+			drained = append(drained, b)
+		}
+	}
+	return drained
+}
+
+// updateDiscovered brings the backends of a source in line with the
+// targets it found. New targets are added, the ones that are still
+// listed are put back in rotation if they were draining, and the
+// ones that are no longer listed are drained.
+// A target that is already in the pool through another entry is skipped
+func (e *Engine) updateDiscovered(source *discoverySource, targets []Target) {
+	var drained []*backend
+	e.mu.Lock()
+	if source.stopped {
+		e.mu.Unlock()
+		return
+	}
+	listed := make(map[string]bool)
+	for _, target := range targets {
+		routeURL, err := url.Parse(target.URL)
+		if err != nil || routeURL.Scheme == "" || routeURL.Host == "" {
+			e.logf("flashx: discovery %s found an invalid URL %q", source.key, target.URL)
+			continue
+		}
+		weight := target.Weight
+		if weight <= 0 {
+			weight = source.weight
+		}
+		listed[routeURL.String()] = true
+		if existing := e.findURL(routeURL.String()); existing != nil {
+			b := e.backends[existing]
+			if b.source != source.key {
+				continue
+			}
+			atomic.StoreInt32(&b.draining, 0)
+			if atomic.LoadInt64(&b.weight) != int64(weight) {
+				e.setWeightLocked(existing, weight)
+			}
+			b.metadata = target.Metadata
+			continue
+		}
+		b := e.addLocked(routeURL, weight)
+		b.source, b.metadata = source.key, target.Metadata
+	}
+	for _, v := range e.urls {
+		if b := e.backends[v]; b.source == source.key && !listed[v.String()] {
+			atomic.StoreInt32(&b.draining, 1)
+			drained = append(drained, b)
+		}
+	}
+	e.mu.Unlock()
+
+	for _, b := range drained {
+		e.finishDrain(b)
+	}
+}
@@ -0,0 +1,554 @@
+package flashx
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// dnsURLPrefix marks a URL whose host is resolved
+	// into the IPs of its A and AAAA records
+	dnsURLPrefix = "dns+"
+
+	// dnsSRVURLPrefix marks a URL whose host is resolved
+	// into the targets of its SRV records
+	dnsSRVURLPrefix = "dnssrv+"
+
+	defaultDNSTimeout = 5 * time.Second
+
+	defaultNetResolverRefresh = 30 * time.Second
+
+	// dnsMaxRefresh is the maximum time between two resolutions,
+	// regardless of the TTL of the records
+	dnsMaxRefresh = 5 * time.Minute
+
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsClassIN  = 1
+
+	dnsRcodeNameError = 3
+)
+
+var (
+	errDNSMalformedMessage = errors.New("flashx: malformed DNS message")
+	errDNSNameNotFound     = errors.New("flashx: DNS name does not exist")
+	errNoDNSServers        = errors.New("flashx: DNSResolver needs Servers")
+
+	// dnsMinRefresh is the minimum time between two resolutions,
+	// regardless of the TTL of the records
+	dnsMinRefresh = time.Second
+
+	// dnsErrorRefresh is the time waited before
+	// resolving again after a failed resolution
+	dnsErrorRefresh = 5 * time.Second
+)
+
+// Resolver looks up the DNS records used to resolve dns+ and dnssrv+ URLs.
+// Implementations return the records along with the time they can be
+// cached for, after which they are looked up again
+type Resolver interface {
+	// LookupIP returns the IPs of the A and AAAA records of a host
+	LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+
+	// LookupSRV returns the SRV records of a name
+	LookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error)
+}
+
+// NetResolver is a Resolver using a net.Resolver, which follows the
+// configuration of the system, such as its hosts file, its search domains
+// and the order of its name services. As the TTL of the records is not
+// known, they are looked up again every Refresh
+type NetResolver struct {
+	// Resolver is the net.Resolver the records are looked up with
+	// If not set, net.DefaultResolver is used
+	Resolver *net.Resolver
+
+	// Refresh is the time the records are cached for
+	// If not set, a default value will be picked up
+	Refresh time.Duration
+}
+
+func (r *NetResolver) resolver() *net.Resolver {
+	if r.Resolver != nil {
+		return r.Resolver
+	}
+	return net.DefaultResolver
+}
+
+func (r *NetResolver) refresh() time.Duration {
+	if r.Refresh > 0 {
+		return r.Refresh
+	}
+	return defaultNetResolverRefresh
+}
+
+// LookupIP returns the IPs of the A and AAAA records of a host
+func (r *NetResolver) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	addrs, err := r.resolver().LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, r.refresh(), nil
+}
+
+// LookupSRV returns the SRV records of a name
+func (r *NetResolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	_, srvs, err := r.resolver().LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return srvs, r.refresh(), nil
+}
+
+// DNSResolver is a Resolver that queries DNS servers directly,
+// so that the records are looked up again as soon as their TTL expires.
+// Names are looked up as they are, without the search domains
+// or the hosts file of the system
+type DNSResolver struct {
+	// Servers are the addresses of the DNS servers, as host:port,
+	// a server being tried when the previous one does not respond
+	// Servers is required
+	Servers []string
+
+	// Timeout is the time allowed for a query to a server
+	// If not set, a default value will be picked up
+	Timeout time.Duration
+}
+
+// LookupIP returns the IPs of the A and AAAA records of a host,
+// along with the lowest TTL of the records
+func (r *DNSResolver) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, dnsMaxRefresh, nil
+	}
+	var records []dnsRecord
+	var lastErr error
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		answers, err := r.query(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		records = append(records, answers...)
+	}
+	if len(records) == 0 && lastErr != nil {
+		return nil, 0, lastErr
+	}
+	ips := make([]net.IP, 0, len(records))
+	for _, record := range records {
+		ips = append(ips, net.IP(record.data))
+	}
+	return ips, lowestTTL(records), nil
+}
+
+// LookupSRV returns the SRV records of a name,
+// along with the lowest TTL of the records
+func (r *DNSResolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	records, err := r.query(ctx, name, dnsTypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	srvs := make([]*net.SRV, 0, len(records))
+	for _, record := range records {
+		srvs = append(srvs, record.srv)
+	}
+	return srvs, lowestTTL(records), nil
+}
+
+// lowestTTL returns the lowest TTL of the records,
+// a TTL of 0 being as valid as any other
+func lowestTTL(records []dnsRecord) time.Duration {
+	var ttl time.Duration
+	set := false
+	for _, record := range records {
+		if !set || record.ttl < ttl {
+			ttl, set = record.ttl, true
+		}
+	}
+	return ttl
+}
+
+// dnsRecord holds an answer of a DNS response
+type dnsRecord struct {
+	ttl  time.Duration
+	data []byte
+	srv  *net.SRV
+}
+
+// query sends a query to each server in turn until one of them
+// responds, over UDP, or over TCP if the response does not fit
+// in a UDP message. A name that does not exist is not looked up
+// on the next servers, as they are expected to agree
+func (r *DNSResolver) query(ctx context.Context, name string, qtype uint16) ([]dnsRecord, error) {
+	if len(r.Servers) == 0 {
+		return nil, errNoDNSServers
+	}
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+	var lastErr error
+	for _, server := range r.Servers {
+		records, err := r.queryServer(ctx, server, name, qtype, timeout)
+		if err == nil || err == errDNSNameNotFound || ctx.Err() != nil {
+			return records, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (r *DNSResolver) queryServer(ctx context.Context, server, name string, qtype uint16, timeout time.Duration) ([]dnsRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	id, err := newDNSQueryID()
+	if err != nil {
+		return nil, err
+	}
+	query, err := buildDNSQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	response, err := exchangeDNS(ctx, "udp", server, query)
+	if err != nil {
+		return nil, err
+	}
+	if response[2]&0x02 != 0 {
+		// the response is truncated
+		if response, err = exchangeDNS(ctx, "tcp", server, query); err != nil {
+			return nil, err
+		}
+	}
+	return parseDNSResponse(response, id, qtype)
+}
+
+// newDNSQueryID returns a random query ID, which cannot
+// be guessed by someone trying to spoof the responses
+func newDNSQueryID() (uint16, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(id[:]), nil
+}
+
+// exchangeDNS sends a query and returns its response.
+// Over UDP, the messages that are not a response
+// to the query are skipped
+func exchangeDNS(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		response := make([]byte, 4096)
+		for {
+			n, err := conn.Read(response)
+			if err != nil {
+				return nil, err
+			}
+			if isDNSResponse(response[:n], query) {
+				return response[:n], nil
+			}
+		}
+	}
+
+	message := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(message, uint16(len(query)))
+	copy(message[2:], query)
+	if _, err := conn.Write(message); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	if !isDNSResponse(response, query) {
+		return nil, errDNSMalformedMessage
+	}
+	return response, nil
+}
+
+// isDNSResponse reports whether a message is a response to the query,
+// having its ID and the same question, the case of the name aside
+func isDNSResponse(message, query []byte) bool {
+	if len(message) < len(query) || message[2]&0x80 == 0 {
+		return false
+	}
+	if message[0] != query[0] || message[1] != query[1] ||
+		binary.BigEndian.Uint16(message[4:]) != 1 {
+		return false
+	}
+	return strings.EqualFold(string(message[12:len(query)]), string(query[12:]))
+}
+
+// buildDNSQuery returns a recursive query for the records of a name
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	query := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(query[0:], id)
+	binary.BigEndian.PutUint16(query[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(query[4:], 1)      // one question
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("flashx: invalid DNS name %q", name)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	return query, nil
+}
+
+// parseDNSResponse returns the answers of the type qtype
+func parseDNSResponse(response []byte, id uint16, qtype uint16) ([]dnsRecord, error) {
+	if len(response) < 12 || binary.BigEndian.Uint16(response) != id {
+		return nil, errDNSMalformedMessage
+	}
+	if rcode := response[3] & 0x0f; rcode == dnsRcodeNameError {
+		return nil, errDNSNameNotFound
+	} else if rcode != 0 {
+		return nil, fmt.Errorf("flashx: DNS server responded with code %d", rcode)
+	}
+	questions := int(binary.BigEndian.Uint16(response[4:]))
+	answers := int(binary.BigEndian.Uint16(response[6:]))
+
+	offset := 12
+	for i := 0; i < questions; i++ {
+		_, next, err := readDNSName(response, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next + 4
+	}
+
+	var records []dnsRecord
+	for i := 0; i < answers; i++ {
+		_, next, err := readDNSName(response, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next
+		if offset+10 > len(response) {
+			return nil, errDNSMalformedMessage
+		}
+		rtype := binary.BigEndian.Uint16(response[offset:])
+		ttl := time.Duration(binary.BigEndian.Uint32(response[offset+4:])) * time.Second
+		length := int(binary.BigEndian.Uint16(response[offset+8:]))
+		offset += 10
+		if offset+length > len(response) {
+			return nil, errDNSMalformedMessage
+		}
+		data := response[offset : offset+length]
+
+		switch {
+		case rtype != qtype:
+			// such as the CNAME records leading to the answers
+		case rtype == dnsTypeA && length == net.IPv4len,
+			rtype == dnsTypeAAAA && length == net.IPv6len:
+			records = append(records, dnsRecord{ttl: ttl, data: append([]byte(nil), data...)})
+		case rtype == dnsTypeSRV && length > 6:
+			target, _, err := readDNSName(response, offset+6)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, dnsRecord{ttl: ttl, srv: &net.SRV{
+				Priority: binary.BigEndian.Uint16(data),
+				Weight:   binary.BigEndian.Uint16(data[2:]),
+				Port:     binary.BigEndian.Uint16(data[4:]),
+				Target:   target,
+			}})
+		}
+		offset += length
+	}
+	return records, nil
+}
+
+// readDNSName reads the possibly compressed name at offset,
+// and returns it along with the offset following it
+func readDNSName(message []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(message) {
+			return "", 0, errDNSMalformedMessage
+		}
+		length := int(message[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(message) || jumps > 32 {
+				return "", 0, errDNSMalformedMessage
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(message[offset:]) & 0x3fff)
+			jumps++
+		default:
+			if offset+1+length > len(message) {
+				return "", 0, errDNSMalformedMessage
+			}
+			labels = append(labels, string(message[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// isDiscoveryURL reports whether the URL is resolved
+// through DNS rather than routed to as is
+func isDiscoveryURL(rawURL string) bool {
+	return strings.HasPrefix(rawURL, dnsURLPrefix) || strings.HasPrefix(rawURL, dnsSRVURLPrefix)
+}
+
+// dnsDiscovery is the Discovery resolving a dns+ or a dnssrv+ URL
+type dnsDiscovery struct {
+	resolver Resolver
+
+	// base holds the URL with the dns+ or dnssrv+ prefix removed,
+	// its host is replaced by the resolved ones
+	base *url.URL
+	srv  bool
+
+	minRefresh   time.Duration
+	errorRefresh time.Duration
+}
+
+func newDNSDiscovery(rawURL string, resolver Resolver) (*dnsDiscovery, error) {
+	d := &dnsDiscovery{resolver: resolver, minRefresh: dnsMinRefresh, errorRefresh: dnsErrorRefresh}
+	if strings.HasPrefix(rawURL, dnsSRVURLPrefix) {
+		d.srv = true
+		rawURL = strings.TrimPrefix(rawURL, dnsSRVURLPrefix)
+	} else {
+		rawURL = strings.TrimPrefix(rawURL, dnsURLPrefix)
+	}
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme == "" || base.Hostname() == "" {
+		return nil, fmt.Errorf("flashx: URL %q needs a scheme and a host", rawURL)
+	}
+	if d.srv && base.Port() != "" {
+		return nil, fmt.Errorf("flashx: URL %q cannot have a port, it is taken from the SRV records", rawURL)
+	}
+	d.base = base
+	return d, nil
+}
+
+// Run resolves the URL every time the records expire
+func (d *dnsDiscovery) Run(ctx context.Context, update func([]Target, error)) {
+	for {
+		targets, ttl, err := d.resolve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			ttl = d.errorRefresh
+		}
+		update(targets, err)
+
+		if ttl < d.minRefresh {
+			ttl = d.minRefresh
+		}
+		if ttl > dnsMaxRefresh {
+			ttl = dnsMaxRefresh
+		}
+		timer := time.NewTimer(ttl)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (d *dnsDiscovery) resolve(ctx context.Context) ([]Target, time.Duration, error) {
+	targets, ttl, err := d.lookup(ctx)
+	if err == nil && len(targets) == 0 {
+		// an empty answer is more likely a DNS hiccup
+		// than every URL going away at once
+		err = fmt.Errorf("flashx: %s has no records", d.base.Hostname())
+	}
+	return targets, ttl, err
+}
+
+func (d *dnsDiscovery) lookup(ctx context.Context) ([]Target, time.Duration, error) {
+	if !d.srv {
+		ips, ttl, err := d.resolver.LookupIP(ctx, d.base.Hostname())
+		if err != nil {
+			return nil, 0, err
+		}
+		targets := make([]Target, 0, len(ips))
+		for _, ip := range ips {
+			host := ip.String()
+			if port := d.base.Port(); port != "" {
+				host = net.JoinHostPort(host, port)
+			} else if ip.To4() == nil {
+				host = "[" + host + "]"
+			}
+			targets = append(targets, Target{URL: d.targetURL(host)})
+		}
+		return targets, ttl, nil
+	}
+
+	srvs, ttl, err := d.resolver.LookupSRV(ctx, d.base.Hostname())
+	if err != nil {
+		return nil, 0, err
+	}
+	// only the targets with the lowest priority are used,
+	// the others are fallbacks
+	sort.Slice(srvs, func(i, j int) bool { return srvs[i].Priority < srvs[j].Priority })
+	targets := make([]Target, 0, len(srvs))
+	for _, srv := range srvs {
+		if srv.Priority != srvs[0].Priority {
+			break
+		}
+		weight := int(srv.Weight)
+		if weight == 0 {
+			weight = 1
+		}
+		host := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+		targets = append(targets, Target{URL: d.targetURL(host), Weight: weight})
+	}
+	return targets, ttl, nil
+}
+
+func (d *dnsDiscovery) targetURL(host string) string {
+	target := *d.base
+	target.Host = host
+	return target.String()
+}
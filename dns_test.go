@@ -0,0 +1,394 @@
+package flashx
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDNSRecord is an answer served by a test DNS server
+type testDNSRecord struct {
+	qtype uint16
+	ttl   uint32
+	data  []byte
+}
+
+// newTestDNSServer starts a UDP DNS server answering the queries
+// for the names of records, and NXDOMAIN for the other names
+func newTestDNSServer(t *testing.T, records map[string][]testDNSRecord) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			query := buffer[:n]
+			name, next, err := readDNSName(query, 12)
+			if err != nil {
+				continue
+			}
+			qtype := binary.BigEndian.Uint16(query[next:])
+
+			response := append([]byte(nil), query[:next+4]...)
+			binary.BigEndian.PutUint16(response[2:], 0x8180)
+			// the additional records of the query, such as EDNS0, are not echoed
+			binary.BigEndian.PutUint32(response[8:], 0)
+			answers, ok := records[name]
+			if !ok {
+				response[3] |= dnsRcodeNameError
+			}
+			count := 0
+			for _, answer := range answers {
+				if answer.qtype != qtype {
+					continue
+				}
+				count++
+				// the name points to the question
+				response = append(response, 0xc0, 12, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+				response = append(response, byte(answer.ttl>>24), byte(answer.ttl>>16), byte(answer.ttl>>8), byte(answer.ttl))
+				response = append(response, byte(len(answer.data)>>8), byte(len(answer.data)))
+				response = append(response, answer.data...)
+			}
+			binary.BigEndian.PutUint16(response[6:], uint16(count))
+			conn.WriteTo(response, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// newClosedDNSServer returns the address of a UDP port nothing listens on
+func newClosedDNSServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func testSRVData(priority, weight, port uint16, target string) []byte {
+	data := make([]byte, 6)
+	binary.BigEndian.PutUint16(data, priority)
+	binary.BigEndian.PutUint16(data[2:], weight)
+	binary.BigEndian.PutUint16(data[4:], port)
+	query, _ := buildDNSQuery(0, target, 0)
+	// the name follows the header of the query
+	return append(data, query[12:len(query)-4]...)
+}
+
+func TestDNSResolver_LookupIP(t *testing.T) {
+	server := newTestDNSServer(t, map[string][]testDNSRecord{
+		"backend.test.": {
+			{qtype: dnsTypeA, ttl: 30, data: net.ParseIP("10.0.0.1").To4()},
+			{qtype: dnsTypeA, ttl: 10, data: net.ParseIP("10.0.0.2").To4()},
+			{qtype: dnsTypeAAAA, ttl: 60, data: net.ParseIP("fd00::1")},
+		},
+		"zero.test.": {
+			{qtype: dnsTypeA, ttl: 30, data: net.ParseIP("10.0.1.1").To4()},
+			{qtype: dnsTypeA, ttl: 0, data: net.ParseIP("10.0.1.2").To4()},
+			{qtype: dnsTypeA, ttl: 20, data: net.ParseIP("10.0.1.3").To4()},
+		},
+	})
+	// the first server does not respond
+	r := &DNSResolver{Servers: []string{newClosedDNSServer(t), server}, Timeout: time.Second}
+
+	tests := []struct {
+		name    string
+		host    string
+		want    []string
+		wantTTL time.Duration
+		wantErr bool
+	}{
+		{name: "A and AAAA records", host: "backend.test", want: []string{"10.0.0.1", "10.0.0.2", "fd00::1"}, wantTTL: 10 * time.Second},
+		{name: "TTL of 0", host: "zero.test", want: []string{"10.0.1.1", "10.0.1.2", "10.0.1.3"}, wantTTL: 0},
+		{name: "IP", host: "10.0.0.3", want: []string{"10.0.0.3"}, wantTTL: dnsMaxRefresh},
+		{name: "unknown host", host: "unknown.test", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips, ttl, err := r.LookupIP(context.Background(), tt.host)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DNSResolver.LookupIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DNSResolver.LookupIP() = %v, want %v", got, tt.want)
+			}
+			if ttl != tt.wantTTL {
+				t.Errorf("DNSResolver.LookupIP() TTL = %v, want %v", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestDNSResolver_LookupSRV(t *testing.T) {
+	server := newTestDNSServer(t, map[string][]testDNSRecord{
+		"_web._tcp.backend.test.": {
+			{qtype: dnsTypeSRV, ttl: 20, data: testSRVData(10, 3, 8080, "one.backend.test.")},
+			{qtype: dnsTypeSRV, ttl: 20, data: testSRVData(10, 1, 8081, "two.backend.test.")},
+		},
+	})
+	r := &DNSResolver{Servers: []string{server}, Timeout: time.Second}
+
+	got, ttl, err := r.LookupSRV(context.Background(), "_web._tcp.backend.test")
+	if err != nil {
+		t.Fatalf("DNSResolver.LookupSRV() error = %v", err)
+	}
+	want := []*net.SRV{
+		{Target: "one.backend.test.", Port: 8080, Priority: 10, Weight: 3},
+		{Target: "two.backend.test.", Port: 8081, Priority: 10, Weight: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DNSResolver.LookupSRV() = %+v, want %+v", got, want)
+	}
+	if ttl != 20*time.Second {
+		t.Errorf("DNSResolver.LookupSRV() TTL = %v, want %v", ttl, 20*time.Second)
+	}
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	header := []byte{0, 1, 0x81, 0x80, 0, 0, 0, 1, 0, 0, 0, 0}
+	tests := []struct {
+		name     string
+		response []byte
+	}{
+		{name: "short", response: header[:8]},
+		{name: "unexpected ID", response: append([]byte{0, 2}, header[2:]...)},
+		{name: "truncated answer", response: append(append([]byte(nil), header...), 0, 0, 1, 0, 1)},
+		{name: "compression loop", response: append(append([]byte(nil), header...), 0xc0, 12)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseDNSResponse(tt.response, 1, dnsTypeA); err == nil {
+				t.Error("parseDNSResponse() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestIsDNSResponse(t *testing.T) {
+	query, _ := buildDNSQuery(1, "backend.test", dnsTypeA)
+	response := func(change func([]byte)) []byte {
+		message := append([]byte(nil), query...)
+		message[2] |= 0x80
+		change(message)
+		return message
+	}
+	tests := []struct {
+		name    string
+		message []byte
+		want    bool
+	}{
+		{name: "response", message: response(func([]byte) {}), want: true},
+		{name: "mixed case name", message: response(func(m []byte) { m[13] = 'B' }), want: true},
+		{name: "query", message: query},
+		{name: "unexpected ID", message: response(func(m []byte) { m[1] = 2 })},
+		{name: "other name", message: response(func(m []byte) { m[13] = 'x' })},
+		{name: "other type", message: response(func(m []byte) { m[len(m)-3] = dnsTypeAAAA })},
+		{name: "short", message: response(func([]byte) {})[:12]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDNSResponse(tt.message, query); got != tt.want {
+				t.Errorf("isDNSResponse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSResolver_noServers(t *testing.T) {
+	r := &DNSResolver{}
+	if _, _, err := r.LookupIP(context.Background(), "backend.test"); err != errNoDNSServers {
+		t.Errorf("DNSResolver.LookupIP() error = %v, want %v", err, errNoDNSServers)
+	}
+}
+
+func TestNetResolver(t *testing.T) {
+	server := newTestDNSServer(t, map[string][]testDNSRecord{
+		"backend.test.": {
+			{qtype: dnsTypeA, ttl: 30, data: net.ParseIP("10.0.0.1").To4()},
+		},
+		"_web._tcp.backend.test.": {
+			{qtype: dnsTypeSRV, ttl: 20, data: testSRVData(10, 3, 8080, "one.backend.test.")},
+		},
+	})
+	r := &NetResolver{
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "udp", server)
+			},
+		},
+		Refresh: time.Minute,
+	}
+
+	ips, ttl, err := r.LookupIP(context.Background(), "backend.test.")
+	if err != nil {
+		t.Fatalf("NetResolver.LookupIP() error = %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("NetResolver.LookupIP() = %v, want [10.0.0.1]", ips)
+	}
+	if ttl != time.Minute {
+		t.Errorf("NetResolver.LookupIP() TTL = %v, want %v", ttl, time.Minute)
+	}
+
+	srvs, ttl, err := r.LookupSRV(context.Background(), "_web._tcp.backend.test.")
+	if err != nil {
+		t.Fatalf("NetResolver.LookupSRV() error = %v", err)
+	}
+	want := []*net.SRV{{Target: "one.backend.test.", Port: 8080, Priority: 10, Weight: 3}}
+	if !reflect.DeepEqual(srvs, want) {
+		t.Errorf("NetResolver.LookupSRV() = %+v, want %+v", srvs, want)
+	}
+	if ttl != time.Minute {
+		t.Errorf("NetResolver.LookupSRV() TTL = %v, want %v", ttl, time.Minute)
+	}
+
+	if _, _, err := r.LookupIP(context.Background(), "unknown.test."); err == nil {
+		t.Error("NetResolver.LookupIP() error = nil for an unknown host, want an error")
+	}
+}
+
+// testResolver is a Resolver serving records that can be changed
+type testResolver struct {
+	mu   sync.Mutex
+	ips  []net.IP
+	srvs []*net.SRV
+	err  error
+}
+
+func (r *testResolver) set(ips []net.IP, srvs []*net.SRV, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ips, r.srvs, r.err = ips, srvs, err
+}
+
+func (r *testResolver) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ips, 0, r.err
+}
+
+func (r *testResolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.srvs, 0, r.err
+}
+
+// backendWeights returns the weights of the URLs of the pool
+func backendWeights(e *Engine) map[string]int {
+	weights := make(map[string]int)
+	for _, status := range e.Backends() {
+		if !status.Draining {
+			weights[status.URL] = status.Weight
+		}
+	}
+	return weights
+}
+
+func TestEngine_DNSDiscovery(t *testing.T) {
+	defer func(minRefresh, errorRefresh time.Duration) {
+		dnsMinRefresh, dnsErrorRefresh = minRefresh, errorRefresh
+	}(dnsMinRefresh, dnsErrorRefresh)
+	dnsMinRefresh, dnsErrorRefresh = time.Millisecond, time.Millisecond
+
+	resolver := &testResolver{}
+	resolver.set([]net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}, nil, nil)
+	e := &Engine{
+		URLs:                  []string{"http://localhost:3000", "dns+http://backend.test:8080/api"},
+		RoundRobinWeights:     []int{1, 2},
+		LoadBalancingStrategy: WeightedRoundRobin,
+		Resolver:              resolver,
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	want := map[string]int{
+		"http://localhost:3000":     1,
+		"http://10.0.0.1:8080/api":  2,
+		"http://[fd00::1]:8080/api": 2,
+	}
+	waitFor(t, func() bool { return reflect.DeepEqual(backendWeights(e), want) })
+
+	// a failed resolution keeps the URLs that were found last
+	resolver.set(nil, nil, &net.DNSError{Err: "timeout", IsTimeout: true})
+	time.Sleep(20 * time.Millisecond)
+	if got := backendWeights(e); !reflect.DeepEqual(got, want) {
+		t.Errorf("Engine.Backends() = %v after a failed resolution, want %v", got, want)
+	}
+
+	resolver.set([]net.IP{net.ParseIP("10.0.0.2")}, nil, nil)
+	want = map[string]int{
+		"http://localhost:3000":    1,
+		"http://10.0.0.2:8080/api": 2,
+	}
+	waitFor(t, func() bool { return reflect.DeepEqual(backendWeights(e), want) })
+}
+
+func TestEngine_DNSSRVDiscovery(t *testing.T) {
+	defer func(minRefresh, errorRefresh time.Duration) {
+		dnsMinRefresh, dnsErrorRefresh = minRefresh, errorRefresh
+	}(dnsMinRefresh, dnsErrorRefresh)
+	dnsMinRefresh, dnsErrorRefresh = time.Millisecond, time.Millisecond
+
+	resolver := &testResolver{}
+	resolver.set(nil, []*net.SRV{
+		{Target: "one.backend.test.", Port: 8080, Priority: 10, Weight: 3},
+		{Target: "two.backend.test.", Port: 8081, Priority: 10, Weight: 0},
+		{Target: "fallback.backend.test.", Port: 8082, Priority: 20, Weight: 5},
+	}, nil)
+	e := &Engine{
+		URLs:                  []string{"dnssrv+https://_web._tcp.backend.test"},
+		LoadBalancingStrategy: WeightedRoundRobin,
+		RoundRobinWeights:     []int{1},
+		Resolver:              resolver,
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	want := map[string]int{
+		"https://one.backend.test:8080": 3,
+		"https://two.backend.test:8081": 1,
+	}
+	// the fallback target with a higher priority is left out
+	waitFor(t, func() bool { return reflect.DeepEqual(backendWeights(e), want) })
+}
+
+func TestEngine_DNSDiscoveryInvalidURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		rawURL string
+	}{
+		{name: "no scheme", rawURL: "dns+backend.test"},
+		{name: "SRV with a port", rawURL: "dnssrv+http://_web._tcp.backend.test:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Engine{URLs: []string{tt.rawURL}, Resolver: &testResolver{}}
+			if err := e.Setup(); err == nil {
+				e.Close()
+				t.Error("Engine.Setup() error = nil, want an error")
+			}
+		})
+	}
+}
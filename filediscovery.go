@@ -0,0 +1,175 @@
+package flashx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const defaultFileDiscoveryInterval = 5 * time.Second
+
+// FileDiscovery is a Discovery reading the URLs from a YAML or JSON
+// file, or from every .yaml, .yml and .json file of a directory.
+// A file holds a list of groups of URLs sharing a weight and metadata:
+//
+//	# targets.yaml
+//	- targets:
+//	    - http://10.0.0.1:8080
+//	    - http://10.0.0.2:8080
+//	  weight: 2
+//	  metadata:
+//	    zone: eu-west-1a
+//
+// The files are read again every interval, and the pool is updated
+// whenever their content changes. A file that cannot be read or
+// parsed is logged, and the URLs that were found last are kept.
+// So are empty files and files listing no URLs at all, which are more
+// likely being rewritten than meant to remove every URL at once
+type FileDiscovery struct {
+	// Path is the path of the file or the directory
+	Path string
+
+	// Interval is the time between two reads of the files
+	// If not set, a default value will be picked up
+	Interval time.Duration
+}
+
+// fileTargetGroup describes a group of URLs in a discovery file
+type fileTargetGroup struct {
+	Targets []string `yaml:"targets"`
+
+	// Weight is the weight of the URLs
+	// If not set, the weight of the discovery entry is used
+	Weight int `yaml:"weight"`
+
+	Metadata map[string]string `yaml:"metadata"`
+}
+
+// Run reads the files every interval until ctx is cancelled
+func (f *FileDiscovery) Run(ctx context.Context, update func([]Target, error)) {
+	interval := f.Interval
+	if interval <= 0 {
+		interval = defaultFileDiscoveryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last []discoveryFile
+	lastErr := ""
+	for {
+		files, err := f.read()
+		if err == nil && (last == nil || !reflect.DeepEqual(files, last)) {
+			var targets []Target
+			if targets, err = parseDiscoveryFiles(files); err == nil {
+				last = files
+				lastErr = ""
+				update(targets, nil)
+			}
+		}
+		// the files may be in the middle of being replaced,
+		// only report an error once
+		if err != nil && err.Error() != lastErr {
+			lastErr = err.Error()
+			update(nil, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// files returns the paths of the discovery files, in lexical order
+func (f *FileDiscovery) files() ([]string, error) {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{f.Path}, nil
+	}
+	infos, err := ioutil.ReadDir(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, info := range infos {
+		switch strings.ToLower(filepath.Ext(info.Name())) {
+		case ".yaml", ".yml", ".json":
+			if !info.IsDir() {
+				paths = append(paths, filepath.Join(f.Path, info.Name()))
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// discoveryFile holds the content of a discovery file
+type discoveryFile struct {
+	path string
+	data []byte
+}
+
+// read returns the content of the discovery files
+func (f *FileDiscovery) read() ([]discoveryFile, error) {
+	paths, err := f.files()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]discoveryFile, 0, len(paths))
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, discoveryFile{path: path, data: data})
+	}
+	return files, nil
+}
+
+// parseDiscoveryFiles returns the targets of the discovery files,
+// or an error if a file is empty or none of them lists a URL.
+// A URL listed more than once keeps its first weight and metadata
+func parseDiscoveryFiles(files []discoveryFile) ([]Target, error) {
+	targets := make([]Target, 0)
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if len(bytes.TrimSpace(file.data)) == 0 {
+			return nil, fmt.Errorf("flashx: %s is empty", file.path)
+		}
+		var groups []fileTargetGroup
+		// JSON documents are valid YAML documents
+		if err := yaml.UnmarshalStrict(file.data, &groups); err != nil {
+			return nil, fmt.Errorf("%s: %v", file.path, err)
+		}
+		for _, group := range groups {
+			if group.Weight < 0 {
+				return nil, fmt.Errorf("%s: %v", file.path, errNonPositiveWeight)
+			}
+			for _, target := range group.Targets {
+				if seen[target] {
+					continue
+				}
+				seen[target] = true
+				targets = append(targets, Target{URL: target, Weight: group.Weight, Metadata: group.Metadata})
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("flashx: the discovery files list no URLs")
+	}
+	return targets, nil
+}
@@ -0,0 +1,143 @@
+package flashx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDiscoveryFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []discoveryFile
+		want    []Target
+		wantErr bool
+	}{
+		{
+			name: "YAML and JSON",
+			files: []discoveryFile{
+				{path: "a.yaml", data: []byte(`
+- targets: [http://10.0.0.1:8080, http://10.0.0.2:8080]
+  weight: 2
+  metadata:
+    zone: a
+`)},
+				{path: "b.json", data: []byte(`[{"targets": ["http://10.0.0.3:8080", "http://10.0.0.1:8080"]}]`)},
+			},
+			want: []Target{
+				{URL: "http://10.0.0.1:8080", Weight: 2, Metadata: map[string]string{"zone": "a"}},
+				{URL: "http://10.0.0.2:8080", Weight: 2, Metadata: map[string]string{"zone": "a"}},
+				{URL: "http://10.0.0.3:8080"},
+			},
+		},
+		{
+			name: "example of the documentation",
+			files: []discoveryFile{
+				{path: "targets.yaml", data: []byte(`
+# targets.yaml
+- targets:
+    - http://10.0.0.1:8080
+    - http://10.0.0.2:8080
+  weight: 2
+  metadata:
+    zone: eu-west-1a
+`)},
+			},
+			want: []Target{
+				{URL: "http://10.0.0.1:8080", Weight: 2, Metadata: map[string]string{"zone": "eu-west-1a"}},
+				{URL: "http://10.0.0.2:8080", Weight: 2, Metadata: map[string]string{"zone": "eu-west-1a"}},
+			},
+		},
+		{
+			name: "empty file",
+			files: []discoveryFile{
+				{path: "a.yaml", data: []byte("- {targets: [http://10.0.0.1:8080]}")},
+				{path: "b.yaml", data: []byte("\n")},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "no URLs",
+			files:   []discoveryFile{{path: "a.yaml", data: []byte("[]")}, {path: "b.json", data: []byte(`[{"targets": []}]`)}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			files:   []discoveryFile{{path: "a.yaml", data: []byte("- urls: [http://10.0.0.1:8080]")}},
+			wantErr: true,
+		},
+		{
+			name:    "negative weight",
+			files:   []discoveryFile{{path: "a.yaml", data: []byte("- {targets: [http://10.0.0.1:8080], weight: -1}")}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDiscoveryFiles(tt.files)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDiscoveryFiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDiscoveryFiles() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngine_FileDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flashx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, data string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("a.yaml", "- {targets: [http://10.0.0.1:8080], weight: 2, metadata: {zone: a}}")
+	write("b.json", `[{"targets": ["http://10.0.0.2:8080"]}]`)
+	write("notes.txt", "- {targets: [http://10.0.0.3:8080]}")
+	e := &Engine{
+		LoadBalancingStrategy: WeightedRoundRobin,
+		Discoveries:           []Discovery{&FileDiscovery{Path: dir, Interval: 5 * time.Millisecond}},
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	want := map[string]int{"http://10.0.0.1:8080": 2, "http://10.0.0.2:8080": 1}
+	waitFor(t, func() bool { return reflect.DeepEqual(backendWeights(e), want) })
+	for _, status := range e.Backends() {
+		if status.URL == "http://10.0.0.1:8080" && status.Metadata["zone"] != "a" {
+			t.Errorf("Engine.Backends() metadata = %v, want zone a", status.Metadata)
+		}
+	}
+
+	// an invalid file is rejected, and the URLs found last are kept
+	write("b.json", `[{"targets": ["http://10.0.0.2:8080"]`)
+	time.Sleep(50 * time.Millisecond)
+	if got := backendWeights(e); !reflect.DeepEqual(got, want) {
+		t.Errorf("Engine.Backends() = %v after an invalid file, want %v", got, want)
+	}
+
+	// so is a file truncated while it is being rewritten
+	write("b.json", "")
+	time.Sleep(50 * time.Millisecond)
+	if got := backendWeights(e); !reflect.DeepEqual(got, want) {
+		t.Errorf("Engine.Backends() = %v after a truncated file, want %v", got, want)
+	}
+
+	write("b.json", `[{"targets": ["http://10.0.0.4:8080"], "weight": 3}]`)
+	if err := os.Remove(filepath.Join(dir, "a.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]int{"http://10.0.0.4:8080": 3}
+	waitFor(t, func() bool { return reflect.DeepEqual(backendWeights(e), want) })
+}
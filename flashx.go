@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,17 +15,69 @@ import (
 )
 
 var (
-	l                                        = &sync.Mutex{}
+	// ErrNoAvailableURL is passed to the ErrorHandler when
+	// none of the URLs is able to serve a request
+	ErrNoAvailableURL = errors.New("flashx: no URL is available to serve the request")
+
+	// ErrURLExists is returned when adding a URL that is already in the pool
+	ErrURLExists = errors.New("flashx: URL is already in the pool")
+
+	// ErrInvalidURL is returned when adding a URL
+	// that does not have a scheme and a host
+	ErrInvalidURL = errors.New("flashx: URL needs a scheme and a host")
+
+	// ErrURLNotFound is returned when changing a URL that is not in the pool
+	ErrURLNotFound = errors.New("flashx: URL is not in the pool")
+
+	// ErrUnknownStrategy is returned when switching to
+	// a load balancing strategy that does not exist
+	ErrUnknownStrategy = errors.New("flashx: unknown load balancing strategy")
+
 	errEmptyURLArrayWithLoadBalancer         = errors.New("URL array needs to filled if a load balancing strategy is being used")
 	errMismatchArrayLengthWeightedRoundRobin = errors.New("In case of Weighted Round Robin load balancing strategy, URLs array and Round Robin Weights array should have an equal length")
+	errMismatchArrayLengthWeights            = errors.New("If Round Robin Weights are specified, URLs array and Round Robin Weights array should have an equal length")
+	errNonPositiveWeight                     = errors.New("Weights specified for the URLs should be greater than 0")
 )
 
 // Engine provides configuration options to setup and
 // use FlashX
 type Engine struct {
 	// BlacklistIPs is an array of IPs that needs to be blacklisted
+	// It accepts IPv4 and IPv6 addresses as well as CIDR ranges,
+	// such as 10.0.0.0/8, and can be read from a file with ReadIPList
 	BlacklistIPs []string
 
+	// WhitelistIPs is an array of IPs and CIDR ranges that are allowed
+	// If set, requests from any other IP are forbidden
+	// BlacklistIPs still applies to the whitelisted IPs
+	WhitelistIPs []string
+
+	// DeniedResponse is the response written for the requests that are
+	// denied by BlacklistIPs, WhitelistIPs or NumberOfRequestsPerSecondPerClient
+	// If nil, an empty 403 Status Forbidden response is written,
+	// or 429 Status Too Many Requests for the rate limited requests
+	DeniedResponse *DeniedResponse
+
+	// OnAccessDenied is an optional function called with every
+	// request that is denied, for example to audit them
+	// It must not write to the response
+	OnAccessDenied func(*http.Request, AccessDenial)
+
+	// TrustedProxies is an array of the IPs and CIDR ranges of the
+	// proxies FlashX runs behind, such as a cloud load balancer
+	// The client IP of a request coming from one of them is read from
+	// ForwardedHeader, and is the one used by the IP lists, the per
+	// client rate limiting, HashByClientIP and the logs.
+	// It can be retrieved with ClientIP
+	// If not set, the client IP is the IP of the remote address
+	TrustedProxies []string
+
+	// ForwardedHeader is the header the trusted proxies write the client
+	// IP into, either X-Forwarded-For, Forwarded or X-Real-IP
+	// The other ones are ignored, as a client can send them
+	// If not set, X-Forwarded-For is used
+	ForwardedHeader string
+
 	// A BufferPool is an interface for getting and returning temporary
 	// byte slices for use by io.CopyBuffer.
 	BufferPool httputil.BufferPool
@@ -56,7 +109,9 @@ type Engine struct {
 	// ModifyRequest allows you to modify the request before sending it
 	// It accepts a function that alters the request to be sent.
 	// Accepted function must not access the provided request after returning
-	// If not set, a default value will be picked up
+	// If not set, a default value will be picked up, which prepends the
+	// path of the URL, such as /api for http://svc:8080/api, to the path
+	// of the request
 	ModifyRequest func(*http.Request)
 
 	// ModifyResponse allows you to modify the response once it is received
@@ -72,30 +127,147 @@ type Engine struct {
 	// If this value is not set, rate limiting will be disabled
 	NumberOfRequestsPerSecond int
 
+	// NumberOfRequestsPerSecondPerClient states the maximum number
+	// of requests per second from each client IP. The requests
+	// above it are denied instead of being delayed
+	// If this value is not set, clients will not be rate limited
+	NumberOfRequestsPerSecondPerClient int
+
 	// The transport used to perform proxy requests.
 	// If nil, http.DefaultTransport is used.
 	Transport http.RoundTripper
 
 	// URLs is an array of string URLs that need to be configured
+	// A URL prefixed with "dns+", such as dns+http://backend.internal:8080,
+	// is resolved into one URL per IP of its host, and a URL prefixed with
+	// "dnssrv+", such as dnssrv+http://_web._tcp.backend.internal, is
+	// resolved into one URL per target of its SRV records.
+	// They are resolved again whenever their records expire
 	URLs []string
 
+	// Resolver looks up the DNS records of the dns+ and dnssrv+ URLs
+	// If not set, a NetResolver using net.DefaultResolver is used
+	Resolver Resolver
+
+	// Discoveries holds the providers, such as FileDiscovery, that
+	// find URLs to route requests to on top of the ones of URLs
+	// The URLs they find without a weight have a weight of 1
+	Discoveries []Discovery
+
 	// LoadBalancingStrategy holds a load balancing strategy
 	LoadBalancingStrategy int
 
+	// Balancer holds a custom load balancing implementation
+	// If set, it takes precedence over LoadBalancingStrategy
+	Balancer Balancer
+
+	// HashKey returns the key that the Consistent Hash strategy
+	// uses to route a request, such as HashByClientIP,
+	// HashByHeader, HashByCookie or HashByPathSegment
+	// If not set, the client IP will be used
+	HashKey func(*http.Request) string
+
+	// StickySessionCookie holds the name of the cookie used for
+	// session affinity. If set, the URL that served the first request
+	// of a client is stored in a signed cookie, and the later requests
+	// carrying the cookie will be routed to the same URL.
+	// If that URL can no longer serve requests, a new one is picked
+	// and the cookie is rewritten
+	StickySessionCookie string
+
+	// StickySessionSecret holds the key used to sign the sticky session cookie
+	// If not set, a random key is generated during Setup,
+	// in which case cookies are only honoured by the same Engine
+	StickySessionSecret []byte
+
+	// HealthCheck holds the configuration used to actively
+	// probe the health of every URL
+	// If nil, health checking will be disabled
+	HealthCheck *HealthCheck
+
+	// OutlierDetection holds the configuration used to eject
+	// URLs that keep failing to serve the proxied requests
+	// If nil, outlier detection will be disabled
+	OutlierDetection *OutlierDetection
+
+	// CircuitBreaker holds the configuration of the
+	// circuit breaker that wraps every URL
+	// If nil, circuit breaking will be disabled
+	CircuitBreaker *CircuitBreaker
+
+	// Retry holds the configuration used to retry idempotent
+	// requests on another URL when they fail
+	// If nil, requests will not be retried
+	Retry *Retry
+
+	// Hedge holds the configuration used to send a duplicate
+	// of a slow request to a second URL
+	// If nil, requests will not be hedged
+	Hedge *Hedge
+
+	// Mirror holds the configuration used to send a copy of the
+	// requests routed by Initiate to a shadow URL
+	// If nil, requests will not be mirrored
+	Mirror *Mirror
+
 	// RoundRobinWeights holds the weights specified for each URL
+	// It is used by the Weighted Round Robin and the
+	// Weighted Least Connections strategies,
+	// as well as any Balancer that implements WeightedBalancer
 	RoundRobinWeights []int
 
 	limiter ratelimit.Limiter
 
-	proxy *httputil.ReverseProxy
+	clientLimiter *clientLimiter
 
-	currentIndex int64
+	// mu guards urls, backends, the balancer and its weights, the limiters,
+	// the discoveries, LoadBalancingStrategy, BlacklistIPs, WhitelistIPs,
+	// the IP sets and Transport while they are changed at runtime
+	mu sync.RWMutex
 
 	urls []*url.URL
 
-	weightedURLs []*url.URL
+	balancer Balancer
+
+	blacklistSet *ipSet
+
+	whitelistSet *ipSet
+
+	clientIPs *clientIPResolver
+
+	stickySecret []byte
+
+	backends map[*url.URL]*backend
+
+	healthCheck *HealthCheck
+
+	outlierDetection *OutlierDetection
 
-	leastConnectionMap map[*url.URL]int
+	outlierMu sync.Mutex
+
+	circuitBreaker *CircuitBreaker
+
+	retry *Retry
+
+	retryBudget *retryBudget
+
+	hedge *Hedge
+
+	latencies *latencyWindow
+
+	mirror *Mirror
+
+	mirrorStats MirrorStats
+
+	// discoveries holds the discovery entries of the URLs by key
+	discoveries map[string]*discoverySource
+
+	// config holds the config file that was applied last
+	config *Config
+
+	done chan struct{}
+
+	closeOnce sync.Once
 }
 
 const (
@@ -110,6 +282,8 @@ const (
 	// WeightedRoundRobin strategy
 	// In this strategy, URLs will be picked from
 	// the URL array one by one based on the weights specified
+	// Picks are interleaved, so URLs with a higher weight
+	// do not receive all of their requests in a row
 	// By default, weights will be equal to 1 for each URL
 	WeightedRoundRobin
 
@@ -120,36 +294,101 @@ const (
 	// The one with the least number of active
 	// connections will receive the request
 	LeastConnections
+
+	// WeightedLeastConnections strategy
+	// In this strategy, URLs will be picked from
+	// the URL array based on the number of active
+	// connections relative to the weights specified.
+	// The one with the lowest ratio of active connections
+	// to weight will receive the request
+	// By default, weights will be equal to 1 for each URL
+	WeightedLeastConnections
+
+	// WeightedResponseTime strategy
+	// In this strategy, the response time of each URL
+	// is tracked as a decaying moving average of its
+	// successful responses.
+	// URLs will be picked at random, with faster URLs
+	// being more likely to receive the request.
+	// URLs that have not responded yet are expected
+	// to be as fast as the others on average
+	WeightedResponseTime
+
+	// ConsistentHash strategy
+	// In this strategy, the key returned by HashKey
+	// is mapped onto a hash ring of URLs, so requests
+	// with the same key are routed to the same URL.
+	// Adding or removing a URL only moves about
+	// 1/N of the keys to a different URL
+	ConsistentHash
+
+	// PowerOfTwoChoices strategy
+	// In this strategy, two URLs are sampled at random
+	// and the one with fewer requests in flight
+	// will receive the request
+	PowerOfTwoChoices
 )
 
 // Setup creates a reverse proxy for the configured URL
 func (e *Engine) Setup() error {
-	e.currentIndex = -1
-	if e.NumberOfRequestsPerSecond > 0 {
-		e.limiter = ratelimit.New(e.NumberOfRequestsPerSecond)
-	} else {
-		e.limiter = ratelimit.NewUnlimited()
-	}
+	e.limiter = newLimiter(e.NumberOfRequestsPerSecond)
+	e.clientLimiter = newClientLimiter(e.NumberOfRequestsPerSecondPerClient)
 
 	if err := e.validateURLs(); err != nil {
 		return err
 	}
+	if err := e.setupIPLists(); err != nil {
+		return err
+	}
+	e.setupDiscoveries()
+	e.setupCircuitBreaker()
+	e.setupRetry()
+	e.populateBackends()
+
+	e.balancer = e.Balancer
+	if e.balancer == nil {
+		e.balancer = newBalancer(e.LoadBalancingStrategy, e.HashKey)
+	}
 
-	if e.LoadBalancingStrategy != Nil && len(e.URLs) <= 0 {
+	if e.balancer != nil && len(e.URLs)+len(e.Discoveries) <= 0 {
 		return errEmptyURLArrayWithLoadBalancer
 	}
 
-	if e.LoadBalancingStrategy == LeastConnections {
-		e.populateLeastConnectionsMap()
+	if e.Balancer == nil && e.LoadBalancingStrategy == WeightedRoundRobin && len(e.RoundRobinWeights) != len(e.URLs) {
+		return errMismatchArrayLengthWeightedRoundRobin
 	}
 
-	if e.LoadBalancingStrategy == WeightedRoundRobin {
-		if len(e.RoundRobinWeights) != len(e.URLs) {
-			return errMismatchArrayLengthWeightedRoundRobin
+	if weightedBalancer, ok := e.balancer.(WeightedBalancer); ok {
+		if err := e.populateWeights(weightedBalancer); err != nil {
+			return err
 		}
-		e.populateWeightedRoundRobinURLs()
 	}
 
+	if err := e.setupStickySessions(); err != nil {
+		return err
+	}
+
+	e.setupOutlierDetection()
+	e.setupHedge()
+	if err := e.setupMirror(); err != nil {
+		return err
+	}
+
+	e.done = make(chan struct{})
+	e.startHealthChecks()
+	e.startDiscoveries()
+
+	return nil
+}
+
+// Close stops the background work started by Setup,
+// such as health checking and service discovery
+func (e *Engine) Close() error {
+	e.closeOnce.Do(func() {
+		if e.done != nil {
+			close(e.done)
+		}
+	})
 	return nil
 }
 
@@ -158,29 +397,36 @@ func (e *Engine) Setup() error {
 // The function accepts a response writer,
 // a pointer to a request
 func (e *Engine) Initiate(writer http.ResponseWriter, request *http.Request) {
-	routeURL := e.getURL()
-
-	e.limiter.Take()
+	request = e.withClientIP(request)
+	if e.blacklist(writer, request) || e.limitClient(writer, request) {
+		return
+	}
 
-	if e.LoadBalancingStrategy == LeastConnections {
-		l.Lock()
-		e.leastConnectionMap[routeURL]++
-		l.Unlock()
+	routeURL := e.stickyURL(request)
+	if routeURL == nil {
+		routeURL = e.getURL(request)
+		if routeURL == nil {
+			e.handleError(writer, request, e.unavailableError())
+			return
+		}
+		request = e.withStickyCookie(request)
 	}
 
-	e.blacklist(writer, request)
+	e.currentLimiter().Take()
 
-	revProxy := httputil.NewSingleHostReverseProxy(routeURL)
-	e.proxy = revProxy
-	e.setupReverseProxy(routeURL)
-
-	revProxy.ServeHTTP(writer, request)
+	if e.mirror != nil {
+		e.mirrorRequest(request)
+	}
 
-	if e.LoadBalancingStrategy == LeastConnections {
-		l.Lock()
-		e.leastConnectionMap[routeURL]--
-		l.Unlock()
+	if e.hedge != nil && isHedgeable(request) {
+		e.serveHedged(writer, request, routeURL)
+		return
 	}
+	if e.retry != nil && isIdempotent(request) {
+		e.serveWithRetries(writer, request, routeURL)
+		return
+	}
+	e.route(writer, request, routeURL, nil)
 }
 
 // InitiateOverride routes in the requst,
@@ -192,20 +438,97 @@ func (e *Engine) Initiate(writer http.ResponseWriter, request *http.Request) {
 // Use this method if you want to use a custom logic
 // to decide which URL to route to.
 func (e *Engine) InitiateOverride(writer http.ResponseWriter, request *http.Request, routeURL *url.URL) {
-	e.limiter.Take()
+	request = e.withClientIP(request)
+	if e.blacklist(writer, request) || e.limitClient(writer, request) {
+		return
+	}
 
-	e.blacklist(writer, request)
+	e.currentLimiter().Take()
 
+	e.serve(writer, request, routeURL, nil)
+}
+
+// route proxies the request to routeURL while keeping
+// the balancer and the state of routeURL up to date
+func (e *Engine) route(writer http.ResponseWriter, request *http.Request, routeURL *url.URL, a *attempt) {
+	// succeeded is only set once a response is served,
+	// so a panicking request is not reported as a success
+	succeeded := false
+	if balancer := e.currentBalancer(); balancer != nil {
+		balancer.RequestStarted(routeURL)
+		start := time.Now()
+		defer func() {
+			if failureAware, ok := balancer.(FailureAwareBalancer); ok && !succeeded {
+				failureAware.RequestFailed(routeURL)
+			} else {
+				balancer.RequestFinished(routeURL, time.Since(start))
+			}
+			// the URL may have been removed while the request was in flight
+			if forgetting, ok := balancer.(ForgettingBalancer); ok && e.backend(routeURL) == nil {
+				forgetting.Forget(routeURL)
+			}
+		}()
+	}
+
+	e.recordStart(routeURL)
+	failed := e.serve(writer, request, routeURL, a)
+	e.recordOutcome(routeURL, failed)
+	succeeded = !failed && request.Context().Err() == nil
+}
+
+// serve proxies the request to routeURL and reports whether routeURL
+// failed to serve it, either because it could not be reached
+// or because it responded with a 5xx status code.
+// If the attempt is retryable and fails in a retryable way,
+// nothing is written and the attempt is marked to be retried
+func (e *Engine) serve(writer http.ResponseWriter, request *http.Request, routeURL *url.URL, a *attempt) bool {
 	revProxy := httputil.NewSingleHostReverseProxy(routeURL)
-	e.proxy = revProxy
-	e.setupReverseProxy(routeURL)
+	e.setupReverseProxy(revProxy, routeURL)
+
+	failed := false
+	modifyResponse, errorHandler := revProxy.ModifyResponse, revProxy.ErrorHandler
+	revProxy.ModifyResponse = func(response *http.Response) error {
+		a.responseReceived()
+		failed = response.StatusCode >= http.StatusInternalServerError
+		if a.retryStatus(response.StatusCode) {
+			a.err = retryStatusError(response.StatusCode)
+			return errRetryableStatusCode
+		}
+		e.setStickyCookie(response, routeURL)
+		return modifyResponse(response)
+	}
+	revProxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, err error) {
+		failed = a.failed(request)
+		if a.shouldRetry(err) {
+			a.retry = true
+			if a.err == nil {
+				a.err = err
+			}
+			return
+		}
+		errorHandler(writer, request, err)
+	}
 
 	revProxy.ServeHTTP(writer, request)
+	return failed
 }
 
 func (e *Engine) validateURLs() error {
 	parsedURLs := make([]*url.URL, 0)
-	for _, value := range e.URLs {
+	e.discoveries = make(map[string]*discoverySource)
+	for index, value := range e.URLs {
+		if isDiscoveryURL(value) {
+			weight := 1
+			if index < len(e.RoundRobinWeights) && e.RoundRobinWeights[index] > 0 {
+				weight = e.RoundRobinWeights[index]
+			}
+			source, err := e.newDiscoverySource(value, weight)
+			if err != nil {
+				return err
+			}
+			e.discoveries[value] = source
+			continue
+		}
 		parsedURL, err := url.Parse(value)
 		if err != nil {
 			return err
@@ -216,86 +539,275 @@ func (e *Engine) validateURLs() error {
 	return nil
 }
 
-func (e *Engine) populateWeightedRoundRobinURLs() {
-	if len(e.RoundRobinWeights) > 0 {
-		e.weightedURLs = make([]*url.URL, 0)
-		for index, i := range e.urls {
-			weight := e.RoundRobinWeights[index]
-			for j := 0; j < weight; j++ {
-				e.weightedURLs = append(e.weightedURLs, i)
-			}
+func (e *Engine) populateWeights(weightedBalancer WeightedBalancer) error {
+	if len(e.RoundRobinWeights) > 0 && len(e.RoundRobinWeights) != len(e.URLs) {
+		return errMismatchArrayLengthWeights
+	}
+	urls := e.urls
+	for index, value := range e.URLs {
+		weight := 1
+		if len(e.RoundRobinWeights) > 0 {
+			weight = e.RoundRobinWeights[index]
+		}
+		if weight <= 0 {
+			return errNonPositiveWeight
 		}
+		if isDiscoveryURL(value) {
+			// the weight is applied to the URLs once they are found
+			continue
+		}
+		v := urls[0]
+		urls = urls[1:]
+		weightedBalancer.SetWeight(v, weight)
+		atomic.StoreInt64(&e.backends[v].weight, int64(weight))
 	}
+	return nil
 }
 
-func (e *Engine) populateLeastConnectionsMap() {
-	e.leastConnectionMap = make(map[*url.URL]int)
-	for _, v := range e.urls {
-		e.leastConnectionMap[v] = 0
+// getURL returns the URL the request should be routed to,
+// or nil if none of the URLs is available.
+// URLs that have already been tried are skipped.
+// If the circuit of the URL is half-open, one of its probes is
+// taken, and the request needs to be routed to it or released
+func (e *Engine) getURL(request *http.Request, tried ...*url.URL) *url.URL {
+	for {
+		urls := e.untriedURLs(tried)
+		if len(urls) == 0 {
+			return nil
+		}
+		routeURL := urls[0]
+		if balancer := e.currentBalancer(); balancer != nil {
+			routeURL = balancer.Pick(urls, request)
+		}
+		if routeURL == nil || e.acquireURL(routeURL) {
+			return routeURL
+		}
+		// other requests took the last probes of the
+		// half-open circuit since the URL was listed
+		tried = append(tried[:len(tried):len(tried)], routeURL)
 	}
 }
 
-func (e *Engine) getURL() *url.URL {
-	if e.LoadBalancingStrategy == RoundRobin {
-		nextURLIndex := int(atomic.AddInt64(&e.currentIndex, int64(1)) % int64(len(e.urls)))
-		return e.urls[nextURLIndex]
+// untriedURLs returns the available URLs that are not in tried
+func (e *Engine) untriedURLs(tried []*url.URL) []*url.URL {
+	urls := e.availableURLs()
+	if len(tried) == 0 {
+		return urls
 	}
-	if e.LoadBalancingStrategy == WeightedRoundRobin {
-		nextURLIndex := int(atomic.AddInt64(&e.currentIndex, int64(1)) % int64(len(e.weightedURLs)))
-		return e.weightedURLs[nextURLIndex]
+	untried := make([]*url.URL, 0, len(urls))
+	for _, v := range urls {
+		if !containsURL(tried, v) {
+			untried = append(untried, v)
+		}
 	}
+	return untried
+}
 
-	if e.LoadBalancingStrategy == LeastConnections {
-		l.Lock()
-		leastConnections := 9999999999
-		leastConnectionsURL := e.urls[0]
-		for k, v := range e.leastConnectionMap {
-			if v < leastConnections {
-				leastConnections = v
-				leastConnectionsURL = k
-			}
+func containsURL(urls []*url.URL, routeURL *url.URL) bool {
+	for _, v := range urls {
+		if v == routeURL {
+			return true
 		}
-		l.Unlock()
-		return leastConnectionsURL
 	}
-	return e.urls[0]
+	return false
 }
 
-func (e *Engine) blacklist(writer http.ResponseWriter, request *http.Request) {
-	if len(e.BlacklistIPs) > 0 {
-		for _, ip := range e.BlacklistIPs {
-			if ip == request.RemoteAddr {
-				writer.WriteHeader(http.StatusForbidden)
-				return
-			}
+// setupIPLists builds the sets of BlacklistIPs, WhitelistIPs and TrustedProxies
+func (e *Engine) setupIPLists() error {
+	blacklistSet, err := newIPListSet(e.BlacklistIPs)
+	if err != nil {
+		return err
+	}
+	whitelistSet, err := newIPListSet(e.WhitelistIPs)
+	if err != nil {
+		return err
+	}
+	clientIPs, err := newClientIPResolver(e.TrustedProxies, e.ForwardedHeader)
+	if err != nil {
+		return err
+	}
+	e.blacklistSet, e.whitelistSet, e.clientIPs = blacklistSet, whitelistSet, clientIPs
+	return nil
+}
+
+// newIPListSet returns the set of a list of IPs,
+// or nil if the list is empty
+func newIPListSet(entries []string) (*ipSet, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return newIPSet(entries)
+}
+
+func newLimiter(numberOfRequestsPerSecond int) ratelimit.Limiter {
+	if numberOfRequestsPerSecond > 0 {
+		return ratelimit.New(numberOfRequestsPerSecond)
+	}
+	return ratelimit.NewUnlimited()
+}
+
+func (e *Engine) currentLimiter() ratelimit.Limiter {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.limiter
+}
+
+func (e *Engine) currentTransport() http.RoundTripper {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.Transport
+}
+
+func (e *Engine) blacklistIPs() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.BlacklistIPs
+}
+
+func (e *Engine) whitelistIPs() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.WhitelistIPs
+}
+
+// BlacklistIP adds an IP or a CIDR range to BlacklistIPs
+// while the Engine is serving requests
+func (e *Engine) BlacklistIP(ip string) error {
+	if _, err := parseIPEntry(ip); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.BlacklistIPs = addIPEntry(e.BlacklistIPs, ip)
+	e.blacklistSet, _ = newIPListSet(e.BlacklistIPs)
+	return nil
+}
+
+// UnblacklistIP removes an IP or a CIDR range from BlacklistIPs
+// while the Engine is serving requests
+func (e *Engine) UnblacklistIP(ip string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.BlacklistIPs = removeIPEntry(e.BlacklistIPs, ip)
+	e.blacklistSet, _ = newIPListSet(e.BlacklistIPs)
+}
+
+// WhitelistIP adds an IP or a CIDR range to WhitelistIPs
+// while the Engine is serving requests.
+// Once the first IP is whitelisted, requests from
+// any other IP are forbidden
+func (e *Engine) WhitelistIP(ip string) error {
+	if _, err := parseIPEntry(ip); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.WhitelistIPs = addIPEntry(e.WhitelistIPs, ip)
+	e.whitelistSet, _ = newIPListSet(e.WhitelistIPs)
+	return nil
+}
+
+// UnwhitelistIP removes an IP or a CIDR range from WhitelistIPs
+// while the Engine is serving requests.
+// Once the last IP is removed, requests from any IP are allowed
+func (e *Engine) UnwhitelistIP(ip string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.WhitelistIPs = removeIPEntry(e.WhitelistIPs, ip)
+	e.whitelistSet, _ = newIPListSet(e.WhitelistIPs)
+}
+
+// addIPEntry returns a copy of entries with entry added
+func addIPEntry(entries []string, entry string) []string {
+	for _, v := range entries {
+		if v == entry {
+			return entries
 		}
 	}
+	updated := make([]string, len(entries), len(entries)+1)
+	copy(updated, entries)
+	return append(updated, entry)
 }
 
-func (e *Engine) setupReverseProxy(url *url.URL) {
-	e.proxy.BufferPool = e.BufferPool
-	e.proxy.ErrorHandler = e.ErrorHandler
-	e.proxy.ErrorLog = e.ErrorLog
-	e.proxy.FlushInterval = e.FlushInterval
-	e.proxy.Transport = e.Transport
+// removeIPEntry returns a copy of entries without entry
+func removeIPEntry(entries []string, entry string) []string {
+	updated := make([]string, 0, len(entries))
+	for _, v := range entries {
+		if v != entry {
+			updated = append(updated, v)
+		}
+	}
+	return updated
+}
+
+func (e *Engine) setupReverseProxy(proxy *httputil.ReverseProxy, url *url.URL) {
+	proxy.BufferPool = e.BufferPool
+	proxy.ErrorHandler = e.handleError
+	proxy.ErrorLog = e.ErrorLog
+	proxy.FlushInterval = e.FlushInterval
+	proxy.Transport = e.currentTransport()
 
 	if e.ModifyRequest == nil {
-		e.proxy.Director = defaultDirector(url)
+		proxy.Director = defaultDirector(url)
 	} else {
-		e.proxy.Director = e.ModifyRequest
+		proxy.Director = e.ModifyRequest
 	}
 
 	if e.ModifyResponse == nil {
-		e.proxy.ModifyResponse = defaultModifyResponse()
+		proxy.ModifyResponse = defaultModifyResponse()
 	} else {
-		e.proxy.ModifyResponse = e.ModifyResponse
+		proxy.ModifyResponse = e.ModifyResponse
 	}
 }
 
+// handleError passes err to the ErrorHandler if one is set,
+// otherwise it logs err and returns a 502 Status Bad Gateway response
+func (e *Engine) handleError(writer http.ResponseWriter, request *http.Request, err error) {
+	if e.ErrorHandler != nil {
+		e.ErrorHandler(writer, request, err)
+		return
+	}
+	e.logf("http: proxy error for %v: %v", ClientIP(request), err)
+	writer.WriteHeader(http.StatusBadGateway)
+}
+
+func (e *Engine) logf(format string, args ...interface{}) {
+	if e.ErrorLog != nil {
+		e.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// defaultDirector routes the request to url, prepending the path
+// of url to the path of the request and merging their queries
 func defaultDirector(url *url.URL) func(req *http.Request) {
 	return func(req *http.Request) {
 		req.URL.Host = url.Host
 		req.URL.Scheme = url.Scheme
+		if url.Path != "" {
+			if url.RawPath != "" || req.URL.RawPath != "" {
+				req.URL.RawPath = singleJoiningSlash(url.EscapedPath(), req.URL.EscapedPath())
+			}
+			req.URL.Path = singleJoiningSlash(url.Path, req.URL.Path)
+		}
+		if url.RawQuery == "" || req.URL.RawQuery == "" {
+			req.URL.RawQuery = url.RawQuery + req.URL.RawQuery
+		} else {
+			req.URL.RawQuery = url.RawQuery + "&" + req.URL.RawQuery
+		}
 		req.Host = url.Host
 	}
 }
@@ -26,13 +26,11 @@ func TestEngine_Setup(t *testing.T) {
 		Transport                 http.RoundTripper
 		URLs                      []string
 		LoadBalancingStrategy     int
+		Balancer                  Balancer
 		RoundRobinWeights         []int
 		limiter                   ratelimit.Limiter
-		proxy                     *httputil.ReverseProxy
-		currentIndex              int64
 		urls                      []*url.URL
-		weightedURLs              []*url.URL
-		leastConnectionMap        map[*url.URL]int
+		balancer                  Balancer
 	}
 	tests := []struct {
 		name    string
@@ -105,6 +103,56 @@ func TestEngine_Setup(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "weighted least connections load balancing strategy, no weights : no error",
+			fields: fields{
+				URLs:                  []string{"http://localhost:3000", "http://localhost:4000"},
+				LoadBalancingStrategy: WeightedLeastConnections,
+			},
+			wantErr: false,
+		},
+		{
+			name: "weighted least connections load balancing strategy with weights : no error",
+			fields: fields{
+				URLs:                  []string{"http://localhost:3000", "http://localhost:4000"},
+				LoadBalancingStrategy: WeightedLeastConnections,
+				RoundRobinWeights:     []int{1, 4},
+			},
+			wantErr: false,
+		},
+		{
+			name: "weighted least connections load balancing strategy, mismatched weights : throws error",
+			fields: fields{
+				URLs:                  []string{"http://localhost:3000", "http://localhost:4000"},
+				LoadBalancingStrategy: WeightedLeastConnections,
+				RoundRobinWeights:     []int{1},
+			},
+			wantErr: true,
+		},
+		{
+			name: "weighted least connections load balancing strategy, zero weight : throws error",
+			fields: fields{
+				URLs:                  []string{"http://localhost:3000", "http://localhost:4000"},
+				LoadBalancingStrategy: WeightedLeastConnections,
+				RoundRobinWeights:     []int{1, 0},
+			},
+			wantErr: true,
+		},
+		{
+			name: "custom balancer with urls : no error",
+			fields: fields{
+				URLs:     []string{"http://localhost:3000", "http://localhost:4000"},
+				Balancer: NewWeightedRoundRobinBalancer(),
+			},
+			wantErr: false,
+		},
+		{
+			name: "custom balancer without urls : throws error",
+			fields: fields{
+				Balancer: NewRoundRobinBalancer(),
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -120,13 +168,11 @@ func TestEngine_Setup(t *testing.T) {
 				Transport:                 tt.fields.Transport,
 				URLs:                      tt.fields.URLs,
 				LoadBalancingStrategy:     tt.fields.LoadBalancingStrategy,
+				Balancer:                  tt.fields.Balancer,
 				RoundRobinWeights:         tt.fields.RoundRobinWeights,
 				limiter:                   tt.fields.limiter,
-				proxy:                     tt.fields.proxy,
-				currentIndex:              tt.fields.currentIndex,
 				urls:                      tt.fields.urls,
-				weightedURLs:              tt.fields.weightedURLs,
-				leastConnectionMap:        tt.fields.leastConnectionMap,
+				balancer:                  tt.fields.balancer,
 			}
 			if err := e.Setup(); (err != nil) != tt.wantErr {
 				t.Errorf("Engine.Setup() error = %v, wantErr %v", err, tt.wantErr)
@@ -148,13 +194,11 @@ func TestEngine_validateURLs(t *testing.T) {
 		Transport                 http.RoundTripper
 		URLs                      []string
 		LoadBalancingStrategy     int
+		Balancer                  Balancer
 		RoundRobinWeights         []int
 		limiter                   ratelimit.Limiter
-		proxy                     *httputil.ReverseProxy
-		currentIndex              int64
 		urls                      []*url.URL
-		weightedURLs              []*url.URL
-		leastConnectionMap        map[*url.URL]int
+		balancer                  Balancer
 	}
 	tests := []struct {
 		name    string
@@ -202,13 +246,11 @@ func TestEngine_validateURLs(t *testing.T) {
 				Transport:                 tt.fields.Transport,
 				URLs:                      tt.fields.URLs,
 				LoadBalancingStrategy:     tt.fields.LoadBalancingStrategy,
+				Balancer:                  tt.fields.Balancer,
 				RoundRobinWeights:         tt.fields.RoundRobinWeights,
 				limiter:                   tt.fields.limiter,
-				proxy:                     tt.fields.proxy,
-				currentIndex:              tt.fields.currentIndex,
 				urls:                      tt.fields.urls,
-				weightedURLs:              tt.fields.weightedURLs,
-				leastConnectionMap:        tt.fields.leastConnectionMap,
+				balancer:                  tt.fields.balancer,
 			}
 			if err := e.validateURLs(); (err != nil) != tt.wantErr {
 				t.Errorf("Engine.validateURLs() error = %v, wantErr %v", err, tt.wantErr)
@@ -230,16 +272,15 @@ func TestEngine_setupReverseProxy(t *testing.T) {
 		Transport                 http.RoundTripper
 		URLs                      []string
 		LoadBalancingStrategy     int
+		Balancer                  Balancer
 		RoundRobinWeights         []int
 		limiter                   ratelimit.Limiter
-		proxy                     *httputil.ReverseProxy
-		currentIndex              int64
 		urls                      []*url.URL
-		weightedURLs              []*url.URL
-		leastConnectionMap        map[*url.URL]int
+		balancer                  Balancer
 	}
 	type args struct {
-		url *url.URL
+		proxy *httputil.ReverseProxy
+		url   *url.URL
 	}
 	validURL := &url.URL{
 		Scheme: "http",
@@ -261,41 +302,41 @@ func TestEngine_setupReverseProxy(t *testing.T) {
 		{
 			name: "modify request is nil",
 			fields: fields{
-				proxy:         &httputil.ReverseProxy{},
 				ModifyRequest: nil,
 			},
 			args: args{
-				url: validURL,
+				proxy: &httputil.ReverseProxy{},
+				url:   validURL,
 			},
 		},
 		{
 			name: "modify response is nil",
 			fields: fields{
-				proxy:          &httputil.ReverseProxy{},
 				ModifyResponse: nil,
 			},
 			args: args{
-				url: validURL,
+				proxy: &httputil.ReverseProxy{},
+				url:   validURL,
 			},
 		},
 		{
 			name: "modify request is not nil",
 			fields: fields{
-				proxy:         &httputil.ReverseProxy{},
 				ModifyRequest: modifyRequestFunc,
 			},
 			args: args{
-				url: validURL,
+				proxy: &httputil.ReverseProxy{},
+				url:   validURL,
 			},
 		},
 		{
 			name: "modify response is not nil",
 			fields: fields{
-				proxy:          &httputil.ReverseProxy{},
 				ModifyResponse: modifyResponseFunc,
 			},
 			args: args{
-				url: validURL,
+				proxy: &httputil.ReverseProxy{},
+				url:   validURL,
 			},
 		},
 	}
@@ -313,15 +354,13 @@ func TestEngine_setupReverseProxy(t *testing.T) {
 				Transport:                 tt.fields.Transport,
 				URLs:                      tt.fields.URLs,
 				LoadBalancingStrategy:     tt.fields.LoadBalancingStrategy,
+				Balancer:                  tt.fields.Balancer,
 				RoundRobinWeights:         tt.fields.RoundRobinWeights,
 				limiter:                   tt.fields.limiter,
-				proxy:                     tt.fields.proxy,
-				currentIndex:              tt.fields.currentIndex,
 				urls:                      tt.fields.urls,
-				weightedURLs:              tt.fields.weightedURLs,
-				leastConnectionMap:        tt.fields.leastConnectionMap,
+				balancer:                  tt.fields.balancer,
 			}
-			e.setupReverseProxy(tt.args.url)
+			e.setupReverseProxy(tt.args.proxy, tt.args.url)
 		})
 	}
 }
@@ -339,22 +378,22 @@ func TestEngine_blacklist(t *testing.T) {
 		Transport                 http.RoundTripper
 		URLs                      []string
 		LoadBalancingStrategy     int
+		Balancer                  Balancer
 		RoundRobinWeights         []int
 		limiter                   ratelimit.Limiter
-		proxy                     *httputil.ReverseProxy
-		currentIndex              int64
 		urls                      []*url.URL
-		weightedURLs              []*url.URL
-		leastConnectionMap        map[*url.URL]int
+		balancer                  Balancer
 	}
 	type args struct {
-		writer  http.ResponseWriter
+		writer  *httptest.ResponseRecorder
 		request *http.Request
 	}
 	tests := []struct {
-		name   string
-		fields fields
-		args   args
+		name       string
+		fields     fields
+		args       args
+		want       bool
+		wantStatus int
 	}{
 		{
 			name: "blacklist IPs: allowed IP",
@@ -367,6 +406,8 @@ func TestEngine_blacklist(t *testing.T) {
 					RemoteAddr: "192.168.1.7",
 				},
 			},
+			want:       false,
+			wantStatus: http.StatusOK,
 		},
 		{
 			name: "blacklist IPs: forbidden IP",
@@ -379,6 +420,8 @@ func TestEngine_blacklist(t *testing.T) {
 					RemoteAddr: "192.168.1.7",
 				},
 			},
+			want:       true,
+			wantStatus: http.StatusForbidden,
 		},
 	}
 	for _, tt := range tests {
@@ -395,15 +438,21 @@ func TestEngine_blacklist(t *testing.T) {
 				Transport:                 tt.fields.Transport,
 				URLs:                      tt.fields.URLs,
 				LoadBalancingStrategy:     tt.fields.LoadBalancingStrategy,
+				Balancer:                  tt.fields.Balancer,
 				RoundRobinWeights:         tt.fields.RoundRobinWeights,
 				limiter:                   tt.fields.limiter,
-				proxy:                     tt.fields.proxy,
-				currentIndex:              tt.fields.currentIndex,
 				urls:                      tt.fields.urls,
-				weightedURLs:              tt.fields.weightedURLs,
-				leastConnectionMap:        tt.fields.leastConnectionMap,
+				balancer:                  tt.fields.balancer,
+			}
+			if err := e.setupIPLists(); err != nil {
+				t.Fatalf("Engine.setupIPLists() error = %v", err)
+			}
+			if got := e.blacklist(tt.args.writer, tt.args.request); got != tt.want {
+				t.Errorf("Engine.blacklist() = %v, want %v", got, tt.want)
+			}
+			if got := tt.args.writer.Code; got != tt.wantStatus {
+				t.Errorf("Engine.blacklist() status = %v, want %v", got, tt.wantStatus)
 			}
-			e.blacklist(tt.args.writer, tt.args.request)
 		})
 	}
 }
@@ -421,24 +470,42 @@ func TestEngine_getURL(t *testing.T) {
 		Transport                 http.RoundTripper
 		URLs                      []string
 		LoadBalancingStrategy     int
+		Balancer                  Balancer
 		RoundRobinWeights         []int
 		limiter                   ratelimit.Limiter
-		proxy                     *httputil.ReverseProxy
-		currentIndex              int64
 		urls                      []*url.URL
-		weightedURLs              []*url.URL
-		leastConnectionMap        map[*url.URL]int
+		balancer                  Balancer
 	}
 
-	leastConnectionsMap := make(map[*url.URL]int)
-	leastConnectionsMap[&url.URL{
+	smallNode := &url.URL{
 		Scheme: "http",
 		Host:   "localhost:3000",
-	}] = 1
-	leastConnectionsMap[&url.URL{
+	}
+	bigNode := &url.URL{
 		Scheme: "http",
 		Host:   "localhost:4000",
-	}] = 2
+	}
+
+	weightedRoundRobinBalancer := NewWeightedRoundRobinBalancer()
+	weightedRoundRobinBalancer.SetWeight(smallNode, 1)
+	weightedRoundRobinBalancer.SetWeight(bigNode, 3)
+
+	leastConnectionsBalancer := NewLeastConnectionsBalancer()
+	leastConnectionsBalancer.RequestStarted(smallNode)
+	leastConnectionsBalancer.RequestStarted(bigNode)
+	leastConnectionsBalancer.RequestStarted(bigNode)
+
+	weightedLeastConnectionsBalancer := NewWeightedLeastConnectionsBalancer()
+	weightedLeastConnectionsBalancer.SetWeight(smallNode, 1)
+	weightedLeastConnectionsBalancer.SetWeight(bigNode, 4)
+	weightedLeastConnectionsBalancer.RequestStarted(smallNode)
+	for i := 0; i < 3; i++ {
+		weightedLeastConnectionsBalancer.RequestStarted(bigNode)
+	}
+
+	weightedResponseTimeBalancer := NewWeightedResponseTimeBalancer()
+	weightedResponseTimeBalancer.RequestStarted(smallNode)
+	weightedResponseTimeBalancer.RequestFinished(smallNode, time.Millisecond)
 
 	tests := []struct {
 		name   string
@@ -448,7 +515,6 @@ func TestEngine_getURL(t *testing.T) {
 		{
 			name: "round robin load balancing",
 			fields: fields{
-				currentIndex: -1,
 				urls: []*url.URL{
 					{
 						Scheme: "http",
@@ -460,6 +526,7 @@ func TestEngine_getURL(t *testing.T) {
 					},
 				},
 				LoadBalancingStrategy: RoundRobin,
+				balancer:              NewRoundRobinBalancer(),
 			},
 			want: &url.URL{
 				Scheme: "http",
@@ -469,39 +536,45 @@ func TestEngine_getURL(t *testing.T) {
 		{
 			name: "weighted round robin load balancing",
 			fields: fields{
-				currentIndex: -1,
-				weightedURLs: []*url.URL{
-					{
-						Scheme: "http",
-						Host:   "localhost:3000",
-					},
-					{
-						Scheme: "http",
-						Host:   "localhost:4000",
-					},
-				},
+				urls:                  []*url.URL{smallNode, bigNode},
 				LoadBalancingStrategy: WeightedRoundRobin,
+				balancer:              weightedRoundRobinBalancer,
 			},
 			want: &url.URL{
 				Scheme: "http",
-				Host:   "localhost:3000",
+				Host:   "localhost:4000",
 			},
 		},
 		{
 			name: "least connections load balancing",
 			fields: fields{
-				urls: []*url.URL{
-					{
-						Scheme: "http",
-						Host:   "localhost:3000",
-					},
-					{
-						Scheme: "http",
-						Host:   "localhost:4000",
-					},
-				},
+				urls:                  []*url.URL{bigNode, smallNode},
 				LoadBalancingStrategy: LeastConnections,
-				leastConnectionMap:    leastConnectionsMap,
+				balancer:              leastConnectionsBalancer,
+			},
+			want: &url.URL{
+				Scheme: "http",
+				Host:   "localhost:3000",
+			},
+		},
+		{
+			name: "weighted least connections load balancing",
+			fields: fields{
+				urls:                  []*url.URL{smallNode, bigNode},
+				LoadBalancingStrategy: WeightedLeastConnections,
+				balancer:              weightedLeastConnectionsBalancer,
+			},
+			want: &url.URL{
+				Scheme: "http",
+				Host:   "localhost:4000",
+			},
+		},
+		{
+			name: "weighted response time load balancing, single URL",
+			fields: fields{
+				urls:                  []*url.URL{smallNode},
+				LoadBalancingStrategy: WeightedResponseTime,
+				balancer:              weightedResponseTimeBalancer,
 			},
 			want: &url.URL{
 				Scheme: "http",
@@ -542,15 +615,13 @@ func TestEngine_getURL(t *testing.T) {
 				Transport:                 tt.fields.Transport,
 				URLs:                      tt.fields.URLs,
 				LoadBalancingStrategy:     tt.fields.LoadBalancingStrategy,
+				Balancer:                  tt.fields.Balancer,
 				RoundRobinWeights:         tt.fields.RoundRobinWeights,
 				limiter:                   tt.fields.limiter,
-				proxy:                     tt.fields.proxy,
-				currentIndex:              tt.fields.currentIndex,
 				urls:                      tt.fields.urls,
-				weightedURLs:              tt.fields.weightedURLs,
-				leastConnectionMap:        tt.fields.leastConnectionMap,
+				balancer:                  tt.fields.balancer,
 			}
-			if got := e.getURL(); !reflect.DeepEqual(got, tt.want) {
+			if got := e.getURL(&http.Request{}); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Engine.getURL() = %v, want %v", got, tt.want)
 			}
 		})
@@ -570,13 +641,11 @@ func TestEngine_Initiate(t *testing.T) {
 		Transport                 http.RoundTripper
 		URLs                      []string
 		LoadBalancingStrategy     int
+		Balancer                  Balancer
 		RoundRobinWeights         []int
 		limiter                   ratelimit.Limiter
-		proxy                     *httputil.ReverseProxy
-		currentIndex              int64
 		urls                      []*url.URL
-		weightedURLs              []*url.URL
-		leastConnectionMap        map[*url.URL]int
+		balancer                  Balancer
 	}
 	type args struct {
 		writer  http.ResponseWriter
@@ -600,9 +669,6 @@ func TestEngine_Initiate(t *testing.T) {
 	w := httptest.NewRecorder()
 	parsedFrontendURL, _ := url.Parse(frontend.URL)
 
-	leastConnectionsMap := make(map[*url.URL]int)
-	leastConnectionsMap[parsedFrontendURL] = 1
-
 	tests := []struct {
 		name   string
 		fields fields
@@ -624,7 +690,7 @@ func TestEngine_Initiate(t *testing.T) {
 			fields: fields{
 				urls:                  []*url.URL{parsedFrontendURL},
 				limiter:               ratelimit.NewUnlimited(),
-				leastConnectionMap:    leastConnectionsMap,
+				balancer:              NewLeastConnectionsBalancer(),
 				LoadBalancingStrategy: LeastConnections,
 			},
 			args: args{
@@ -632,6 +698,19 @@ func TestEngine_Initiate(t *testing.T) {
 				request: getReq,
 			},
 		},
+		{
+			name: "initiate reverse proxy, weighted response time load balancer",
+			fields: fields{
+				urls:                  []*url.URL{parsedFrontendURL},
+				limiter:               ratelimit.NewUnlimited(),
+				balancer:              NewWeightedResponseTimeBalancer(),
+				LoadBalancingStrategy: WeightedResponseTime,
+			},
+			args: args{
+				writer:  w,
+				request: getReq,
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -647,13 +726,11 @@ func TestEngine_Initiate(t *testing.T) {
 				Transport:                 tt.fields.Transport,
 				URLs:                      tt.fields.URLs,
 				LoadBalancingStrategy:     tt.fields.LoadBalancingStrategy,
+				Balancer:                  tt.fields.Balancer,
 				RoundRobinWeights:         tt.fields.RoundRobinWeights,
 				limiter:                   tt.fields.limiter,
-				proxy:                     tt.fields.proxy,
-				currentIndex:              tt.fields.currentIndex,
 				urls:                      tt.fields.urls,
-				weightedURLs:              tt.fields.weightedURLs,
-				leastConnectionMap:        tt.fields.leastConnectionMap,
+				balancer:                  tt.fields.balancer,
 			}
 			e.Initiate(tt.args.writer, tt.args.request)
 		})
@@ -673,13 +750,11 @@ func TestEngine_InitiateOverride(t *testing.T) {
 		Transport                 http.RoundTripper
 		URLs                      []string
 		LoadBalancingStrategy     int
+		Balancer                  Balancer
 		RoundRobinWeights         []int
 		limiter                   ratelimit.Limiter
-		proxy                     *httputil.ReverseProxy
-		currentIndex              int64
 		urls                      []*url.URL
-		weightedURLs              []*url.URL
-		leastConnectionMap        map[*url.URL]int
+		balancer                  Balancer
 	}
 	type args struct {
 		writer   http.ResponseWriter
@@ -704,9 +779,6 @@ func TestEngine_InitiateOverride(t *testing.T) {
 	w := httptest.NewRecorder()
 	parsedFrontendURL, _ := url.Parse(frontend.URL)
 
-	leastConnectionsMap := make(map[*url.URL]int)
-	leastConnectionsMap[parsedFrontendURL] = 1
-
 	tests := []struct {
 		name   string
 		fields fields
@@ -738,15 +810,41 @@ func TestEngine_InitiateOverride(t *testing.T) {
 				Transport:                 tt.fields.Transport,
 				URLs:                      tt.fields.URLs,
 				LoadBalancingStrategy:     tt.fields.LoadBalancingStrategy,
+				Balancer:                  tt.fields.Balancer,
 				RoundRobinWeights:         tt.fields.RoundRobinWeights,
 				limiter:                   tt.fields.limiter,
-				proxy:                     tt.fields.proxy,
-				currentIndex:              tt.fields.currentIndex,
 				urls:                      tt.fields.urls,
-				weightedURLs:              tt.fields.weightedURLs,
-				leastConnectionMap:        tt.fields.leastConnectionMap,
+				balancer:                  tt.fields.balancer,
 			}
 			e.InitiateOverride(tt.args.writer, tt.args.request, tt.args.routeURL)
 		})
 	}
 }
+
+func Test_defaultDirector(t *testing.T) {
+	tests := []struct {
+		name     string
+		routeURL string
+		target   string
+		want     string
+	}{
+		{name: "no base path", routeURL: "http://svc:8080", target: "http://flashx/users?page=2", want: "http://svc:8080/users?page=2"},
+		{name: "base path", routeURL: "http://svc:8080/api", target: "http://flashx/users", want: "http://svc:8080/api/users"},
+		{name: "base path with a trailing slash", routeURL: "http://svc:8080/api/", target: "http://flashx/users", want: "http://svc:8080/api/users"},
+		{name: "escaped path", routeURL: "http://svc:8080/api", target: "http://flashx/a%2Fb", want: "http://svc:8080/api/a%2Fb"},
+		{name: "queries", routeURL: "http://svc:8080/api?key=1", target: "http://flashx/users?page=2", want: "http://svc:8080/api/users?key=1&page=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routeURL, _ := url.Parse(tt.routeURL)
+			request := httptest.NewRequest("GET", tt.target, nil)
+			defaultDirector(routeURL)(request)
+			if got := request.URL.String(); got != tt.want {
+				t.Errorf("defaultDirector() URL = %v, want %v", got, tt.want)
+			}
+			if request.Host != routeURL.Host {
+				t.Errorf("defaultDirector() Host = %v, want %v", request.Host, routeURL.Host)
+			}
+		})
+	}
+}
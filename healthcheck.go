@@ -0,0 +1,182 @@
+package flashx
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHealthCheckPath               = "/"
+	defaultHealthCheckInterval           = 10 * time.Second
+	defaultHealthCheckTimeout            = 2 * time.Second
+	defaultHealthCheckMinStatusCode      = 200
+	defaultHealthCheckMaxStatusCode      = 399
+	defaultHealthCheckHealthyThreshold   = 2
+	defaultHealthCheckUnhealthyThreshold = 3
+
+	// maxHealthCheckBodySize is the maximum number of bytes
+	// of a health check response that are searched for BodyContains
+	maxHealthCheckBodySize = 1 << 20
+)
+
+// HealthCheck provides configuration options
+// to actively probe the health of every URL.
+// URLs that are down are skipped by every load balancing strategy
+type HealthCheck struct {
+	// Path is the path that is probed on every URL
+	// If not set, a default value will be picked up
+	Path string
+
+	// Interval is the time between two probes of a URL
+	// If not set, a default value will be picked up
+	Interval time.Duration
+
+	// Timeout is the time after which a probe is considered failed
+	// If not set, a default value will be picked up
+	Timeout time.Duration
+
+	// MinStatusCode and MaxStatusCode hold the range of
+	// status codes a healthy URL responds with
+	// If not set, any 2xx or 3xx status code is accepted
+	MinStatusCode int
+	MaxStatusCode int
+
+	// BodyContains, if set, must be found in the
+	// response body of a healthy URL
+	BodyContains string
+
+	// HealthyThreshold is the number of consecutive passing
+	// probes needed to mark a URL that is down as up again
+	// If not set, a default value will be picked up
+	HealthyThreshold int
+
+	// UnhealthyThreshold is the number of consecutive
+	// failing probes needed to mark a URL as down
+	// If not set, a default value will be picked up
+	UnhealthyThreshold int
+
+	// Transport is used to send the probes
+	// If nil, the Transport of the Engine is used
+	Transport http.RoundTripper
+
+	client *http.Client
+}
+
+func (h *HealthCheck) setDefaults(transport http.RoundTripper) {
+	if h.Path == "" {
+		h.Path = defaultHealthCheckPath
+	}
+	if h.Interval <= 0 {
+		h.Interval = defaultHealthCheckInterval
+	}
+	if h.Timeout <= 0 {
+		h.Timeout = defaultHealthCheckTimeout
+	}
+	if h.MinStatusCode <= 0 {
+		h.MinStatusCode = defaultHealthCheckMinStatusCode
+	}
+	if h.MaxStatusCode <= 0 {
+		h.MaxStatusCode = defaultHealthCheckMaxStatusCode
+	}
+	if h.HealthyThreshold <= 0 {
+		h.HealthyThreshold = defaultHealthCheckHealthyThreshold
+	}
+	if h.UnhealthyThreshold <= 0 {
+		h.UnhealthyThreshold = defaultHealthCheckUnhealthyThreshold
+	}
+	if h.Transport == nil {
+		h.Transport = transport
+	}
+	h.client = &http.Client{
+		Transport: h.Transport,
+		Timeout:   h.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// probe reports whether routeURL passes the health check
+func (h *HealthCheck) probe(routeURL *url.URL) bool {
+	probeURL := *routeURL
+	probeURL.Path = singleJoiningSlash(routeURL.Path, h.Path)
+	probeURL.RawPath = ""
+
+	response, err := h.client.Get(probeURL.String())
+	if err != nil {
+		return false
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < h.MinStatusCode || response.StatusCode > h.MaxStatusCode {
+		return false
+	}
+	if h.BodyContains == "" {
+		return true
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxHealthCheckBodySize))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(body), h.BodyContains)
+}
+
+func (e *Engine) startHealthChecks() {
+	if e.HealthCheck == nil {
+		return
+	}
+	healthCheck := *e.HealthCheck
+	healthCheck.setDefaults(e.Transport)
+	e.healthCheck = &healthCheck
+	go func() {
+		ticker := time.NewTicker(e.healthCheck.Interval)
+		defer ticker.Stop()
+		for {
+			e.checkHealth()
+			select {
+			case <-e.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// checkHealth probes every URL once and
+// updates the state of their backends
+func (e *Engine) checkHealth() {
+	_, backends := e.pool()
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			e.recordHealth(b, e.healthCheck.probe(b.url))
+		}(b)
+	}
+	wg.Wait()
+}
+
+func (e *Engine) recordHealth(b *backend, healthy bool) {
+	b.healthMu.Lock()
+	defer b.healthMu.Unlock()
+	if healthy {
+		b.healthFailures = 0
+		b.healthPasses++
+		if b.healthPasses >= e.healthCheck.HealthyThreshold && atomic.CompareAndSwapInt32(&b.down, 1, 0) {
+			e.logf("flashx: %s passed its health checks and is up", b.url)
+		}
+		return
+	}
+	b.healthPasses = 0
+	b.healthFailures++
+	if b.healthFailures >= e.healthCheck.UnhealthyThreshold && atomic.CompareAndSwapInt32(&b.down, 0, 1) {
+		e.logf("flashx: %s failed its health checks and is down", b.url)
+	}
+}
@@ -0,0 +1,165 @@
+package flashx
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck_probe(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/healthz":
+			w.Write([]byte(`{"status":"ok"}`))
+		case "/api/slow":
+			time.Sleep(100 * time.Millisecond)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL + "/api")
+
+	tests := []struct {
+		name        string
+		healthCheck HealthCheck
+		want        bool
+	}{
+		{
+			name:        "expected status",
+			healthCheck: HealthCheck{Path: "/healthz"},
+			want:        true,
+		},
+		{
+			name:        "unexpected status",
+			healthCheck: HealthCheck{Path: "/missing"},
+			want:        false,
+		},
+		{
+			name:        "custom status range",
+			healthCheck: HealthCheck{Path: "/missing", MinStatusCode: 500, MaxStatusCode: 503},
+			want:        true,
+		},
+		{
+			name:        "body matches",
+			healthCheck: HealthCheck{Path: "/healthz", BodyContains: `"ok"`},
+			want:        true,
+		},
+		{
+			name:        "body does not match",
+			healthCheck: HealthCheck{Path: "/healthz", BodyContains: `"degraded"`},
+			want:        false,
+		},
+		{
+			name:        "timeout",
+			healthCheck: HealthCheck{Path: "/slow", Timeout: 10 * time.Millisecond},
+			want:        false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.healthCheck.setDefaults(nil)
+			if got := tt.healthCheck.probe(backendURL); got != tt.want {
+				t.Errorf("HealthCheck.probe() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngine_recordHealth(t *testing.T) {
+	e := &Engine{
+		healthCheck: &HealthCheck{
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 3,
+		},
+	}
+	b := &backend{url: &url.URL{Scheme: "http", Host: "localhost:3000"}}
+	steps := []struct {
+		healthy bool
+		want    bool
+	}{
+		{healthy: false, want: true},
+		{healthy: false, want: true},
+		{healthy: false, want: false},
+		{healthy: true, want: false},
+		{healthy: false, want: false},
+		{healthy: true, want: false},
+		{healthy: true, want: true},
+	}
+	for index, step := range steps {
+		e.recordHealth(b, step.healthy)
+		if got := b.available(); got != step.want {
+			t.Errorf("step %d: backend.available() = %v, want %v", index, got, step.want)
+		}
+	}
+}
+
+func TestEngine_healthChecks(t *testing.T) {
+	var healthy int32 = 1
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("flaky"))
+	}))
+	defer flaky.Close()
+	stable := newTestBackend("stable")
+	defer stable.Close()
+
+	var gotErr error
+	e := &Engine{
+		URLs:                  []string{flaky.URL, stable.URL},
+		LoadBalancingStrategy: RoundRobin,
+		HealthCheck: &HealthCheck{
+			Interval:           5 * time.Millisecond,
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 1,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			gotErr = err
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	atomic.StoreInt32(&healthy, 0)
+	waitFor(t, func() bool { return len(e.availableURLs()) == 1 })
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		e.Initiate(w, httptest.NewRequest("GET", "http://flashx/", nil))
+		if got := w.Body.String(); got != "stable" {
+			t.Errorf("Engine.Initiate() routed to %q, want stable", got)
+		}
+	}
+
+	stable.Close()
+	waitFor(t, func() bool { return len(e.availableURLs()) == 0 })
+	w := httptest.NewRecorder()
+	e.Initiate(w, httptest.NewRequest("GET", "http://flashx/", nil))
+	if !errors.Is(gotErr, ErrNoAvailableURL) {
+		t.Errorf("Engine.Initiate() error = %v, want %v", gotErr, ErrNoAvailableURL)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	waitFor(t, func() bool { return len(e.availableURLs()) == 1 })
+}
+
+// waitFor fails the test if condition does not become true within a second
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,342 @@
+package flashx
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHedgePercentile = 95
+
+	// hedgeLatencySamples is the number of recent
+	// response times the percentile is computed over
+	hedgeLatencySamples = 1000
+
+	// hedgeMinLatencySamples is the number of response times
+	// needed before the percentile is used
+	hedgeMinLatencySamples = 20
+
+	// hedgePercentileRefresh is the number of response times
+	// recorded before the percentile is computed again
+	hedgePercentileRefresh = 50
+)
+
+// Hedge provides configuration options to send a duplicate of a
+// request to a second URL when the first URL is slow to respond.
+// The response that arrives first is used, and the other request
+// is cancelled. If the first URL fails before the delay elapses,
+// the duplicate is sent right away.
+// Only GET, HEAD and OPTIONS requests without a body or a protocol
+// upgrade are hedged, and hedged requests are not retried.
+// If Retry has a Budget, each hedge is withdrawn from it
+type Hedge struct {
+	// Delay is the time waited for the first URL
+	// to respond before the request is hedged
+	// If Percentile is set, Delay is only used until
+	// enough response times have been measured
+	Delay time.Duration
+
+	// Percentile is the percentile, between 0 and 100, of the
+	// recent response times after which the request is hedged
+	// If neither Delay nor Percentile is set,
+	// a default value will be picked up
+	Percentile float64
+}
+
+func (h *Hedge) setDefaults() {
+	if h.Delay <= 0 && h.Percentile <= 0 {
+		h.Percentile = defaultHedgePercentile
+	}
+	if h.Percentile > 100 {
+		h.Percentile = 100
+	}
+}
+
+func (e *Engine) setupHedge() {
+	if e.Hedge == nil {
+		return
+	}
+	hedge := *e.Hedge
+	hedge.setDefaults()
+	e.hedge = &hedge
+	e.latencies = &latencyWindow{}
+}
+
+// latencyWindow keeps the recent response times
+// to compute the hedging delay from
+type latencyWindow struct {
+	mu         sync.Mutex
+	samples    []time.Duration
+	next       int
+	stale      int
+	percentile time.Duration
+}
+
+func (w *latencyWindow) record(latency time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < hedgeLatencySamples {
+		w.samples = append(w.samples, latency)
+	} else {
+		w.samples[w.next] = latency
+		w.next = (w.next + 1) % hedgeLatencySamples
+	}
+	w.stale++
+}
+
+// get returns the percentile of the recent response times,
+// or false if not enough of them have been measured
+func (w *latencyWindow) get(percentile float64) (time.Duration, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < hedgeMinLatencySamples {
+		return 0, false
+	}
+	if w.percentile == 0 || w.stale >= hedgePercentileRefresh {
+		sorted := make([]time.Duration, len(w.samples))
+		copy(sorted, w.samples)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		index := int(percentile / 100 * float64(len(sorted)-1))
+		w.percentile = sorted[index]
+		w.stale = 0
+	}
+	return w.percentile, true
+}
+
+// hedgeDelay returns the time to wait before the request
+// is hedged, or false if it should not be hedged on time
+func (e *Engine) hedgeDelay() (time.Duration, bool) {
+	if e.hedge.Percentile > 0 {
+		if delay, ok := e.latencies.get(e.hedge.Percentile); ok {
+			return delay, true
+		}
+	}
+	return e.hedge.Delay, e.hedge.Delay > 0
+}
+
+// isHedgeable reports whether the request is safe to be
+// sent to two URLs at the same time
+func isHedgeable(request *http.Request) bool {
+	if isUpgrade(request) {
+		// the connection of the client is handed
+		// over to the URL, it cannot be raced for
+		return false
+	}
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return request.Body == nil || request.Body == http.NoBody
+	}
+	return false
+}
+
+// isUpgrade reports whether the request asks
+// to switch protocols, such as to WebSocket
+func isUpgrade(request *http.Request) bool {
+	for _, value := range request.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hedgeRace decides which of the attempts
+// of a hedged request gets to respond
+type hedgeRace struct {
+	writer http.ResponseWriter
+
+	mu      sync.Mutex
+	winner  *hedgeWriter
+	writers []*hedgeWriter
+}
+
+// add registers a new attempt, and reports
+// false if the race is already won
+func (r *hedgeRace) add(w *hedgeWriter) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.winner != nil {
+		return false
+	}
+	r.writers = append(r.writers, w)
+	return true
+}
+
+// claim reports whether w won the race,
+// cancelling the other attempts if so
+func (r *hedgeRace) claim(w *hedgeWriter) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.winner != nil {
+		return r.winner == w
+	}
+	r.winner = w
+	for _, other := range r.writers {
+		if other != w {
+			atomic.StoreInt32(&other.attempt.cancelled, 1)
+			other.cancel()
+		}
+	}
+	return true
+}
+
+func (r *hedgeRace) getWinner() *hedgeWriter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.winner
+}
+
+// hedgeWriter is the ResponseWriter of a single attempt of a
+// hedged request. The first attempt to write the response headers
+// wins the race and writes through, the writes of the others are dropped
+type hedgeWriter struct {
+	race    *hedgeRace
+	attempt *attempt
+	cancel  context.CancelFunc
+	start   time.Time
+	header  http.Header
+
+	// claimed and won are only accessed
+	// by the goroutine serving the attempt
+	claimed bool
+	won     bool
+
+	// panicked holds the value the attempt panicked with, which is
+	// passed back to the goroutine of the handler to panic again there
+	panicked interface{}
+}
+
+func (w *hedgeWriter) claim() bool {
+	if !w.claimed {
+		w.claimed = true
+		w.won = w.race.claim(w)
+	}
+	return w.won
+}
+
+func (w *hedgeWriter) Header() http.Header {
+	if w.won {
+		return w.race.writer.Header()
+	}
+	return w.header
+}
+
+func (w *hedgeWriter) WriteHeader(statusCode int) {
+	if !w.claimed && w.claim() {
+		header := w.race.writer.Header()
+		for key, values := range w.header {
+			header[key] = values
+		}
+	}
+	if w.won {
+		w.race.writer.WriteHeader(statusCode)
+	}
+}
+
+func (w *hedgeWriter) Write(data []byte) (int, error) {
+	if !w.claimed {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.won {
+		return w.race.writer.Write(data)
+	}
+	return len(data), nil
+}
+
+func (w *hedgeWriter) Flush() {
+	if flusher, ok := w.race.writer.(http.Flusher); ok && w.won {
+		flusher.Flush()
+	}
+}
+
+// serveHedged routes the request to routeURL, and to a second URL picked
+// by the load balancing strategy if routeURL is slow to respond or fails
+func (e *Engine) serveHedged(writer http.ResponseWriter, request *http.Request, routeURL *url.URL) {
+	race := &hedgeRace{writer: writer}
+	attempts := make([]*hedgeWriter, 0, 2)
+	done := make(chan *hedgeWriter, 2)
+
+	start := func(routeURL *url.URL) bool {
+		ctx, cancel := context.WithCancel(request.Context())
+		w := &hedgeWriter{
+			race:    race,
+			attempt: &attempt{hedged: true},
+			cancel:  cancel,
+			start:   time.Now(),
+			header:  make(http.Header),
+		}
+		if !race.add(w) {
+			cancel()
+			return false
+		}
+		attempts = append(attempts, w)
+		go func() {
+			defer func() {
+				w.panicked = recover()
+				cancel()
+				done <- w
+			}()
+			e.route(w, request.WithContext(ctx), routeURL, w.attempt)
+		}()
+		return true
+	}
+
+	var timeout <-chan time.Time
+	if delay, ok := e.hedgeDelay(); ok {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	start(routeURL)
+	denied := false
+	for pending := 1; pending > 0; {
+		hedge := false
+		select {
+		case <-timeout:
+			hedge = true
+		case w := <-done:
+			pending--
+			if w.panicked != nil && w.panicked != http.ErrAbortHandler {
+				for _, attempt := range attempts {
+					attempt.cancel()
+				}
+				panic(w.panicked)
+			}
+			hedge = race.getWinner() == nil
+			if w.won {
+				e.latencies.record(time.Since(w.start))
+			}
+		}
+		if hedge && len(attempts) == 1 && !denied {
+			next := e.getURL(request, routeURL)
+			if next == nil {
+				continue
+			}
+			// a hedge is spent from the retry budget, so that hedges
+			// do not double the load on slow URLs without a bound
+			if denied = !e.allowRetry(routeURL); !denied && start(next) {
+				pending++
+			} else {
+				e.releaseURL(next)
+			}
+		}
+	}
+
+	winner := race.getWinner()
+	if winner == nil {
+		e.handleError(writer, request, attempts[0].attempt.err)
+		return
+	}
+	if winner.panicked != nil {
+		panic(winner.panicked)
+	}
+}
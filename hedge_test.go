@@ -0,0 +1,250 @@
+package flashx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	w := &latencyWindow{}
+	for i := 1; i < hedgeMinLatencySamples; i++ {
+		w.record(time.Duration(i) * time.Millisecond)
+	}
+	if _, ok := w.get(95); ok {
+		t.Fatal("latencyWindow.get() ok = true below hedgeMinLatencySamples, want false")
+	}
+	for i := hedgeMinLatencySamples; i <= 100; i++ {
+		w.record(time.Duration(i) * time.Millisecond)
+	}
+	if got, _ := w.get(95); got != 95*time.Millisecond {
+		t.Errorf("latencyWindow.get() = %v, want %v", got, 95*time.Millisecond)
+	}
+}
+
+func TestIsHedgeable(t *testing.T) {
+	tests := []struct {
+		name    string
+		request *http.Request
+		want    bool
+	}{
+		{
+			name:    "GET",
+			request: httptest.NewRequest("GET", "http://flashx/", nil),
+			want:    true,
+		},
+		{
+			name:    "GET with a body",
+			request: httptest.NewRequest("GET", "http://flashx/", strings.NewReader("body")),
+			want:    false,
+		},
+		{
+			name:    "POST",
+			request: httptest.NewRequest("POST", "http://flashx/", nil),
+			want:    false,
+		},
+		{
+			name: "upgrade",
+			request: func() *http.Request {
+				request := httptest.NewRequest("GET", "http://flashx/", nil)
+				request.Header.Set("Connection", "keep-alive, Upgrade")
+				request.Header.Set("Upgrade", "websocket")
+				return request
+			}(),
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isHedgeable(tt.request); got != tt.want {
+				t.Errorf("isHedgeable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngine_hedging(t *testing.T) {
+	slowCancelled := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			slowCancelled <- struct{}{}
+		case <-time.After(time.Second):
+			w.Write([]byte("slow"))
+		}
+	}))
+	defer slow.Close()
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+	fast := newTestBackend("fast")
+	defer fast.Close()
+
+	tests := []struct {
+		name          string
+		urls          []string
+		method        string
+		wantStatus    int
+		wantBody      string
+		wantCancelled bool
+	}{
+		{
+			name:          "slow URL is hedged",
+			urls:          []string{slow.URL, fast.URL},
+			method:        http.MethodGet,
+			wantStatus:    http.StatusOK,
+			wantBody:      "fast",
+			wantCancelled: true,
+		},
+		{
+			name:       "failed URL is hedged right away",
+			urls:       []string{refused.URL, fast.URL},
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantBody:   "fast",
+		},
+		{
+			name:       "every URL failed",
+			urls:       []string{refused.URL, refused.URL + "/"},
+			method:     http.MethodGet,
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "unsafe method is not hedged",
+			urls:       []string{slow.URL, fast.URL},
+			method:     http.MethodPost,
+			wantStatus: http.StatusOK,
+			wantBody:   "slow",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Engine{
+				URLs:                  tt.urls,
+				LoadBalancingStrategy: RoundRobin,
+				Hedge:                 &Hedge{Delay: 20 * time.Millisecond},
+			}
+			if err := e.Setup(); err != nil {
+				t.Fatalf("Engine.Setup() error = %v", err)
+			}
+			defer e.Close()
+
+			w := httptest.NewRecorder()
+			e.Initiate(w, httptest.NewRequest(tt.method, "http://flashx/", nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("Engine.Initiate() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("Engine.Initiate() body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+			if tt.wantCancelled {
+				select {
+				case <-slowCancelled:
+				case <-time.After(500 * time.Millisecond):
+					t.Error("Engine.Initiate() did not cancel the slow request")
+				}
+			}
+		})
+	}
+}
+
+func TestEngine_hedging_panic(t *testing.T) {
+	fast := newTestBackend("fast")
+	defer fast.Close()
+
+	e := &Engine{
+		URLs:           []string{fast.URL},
+		Hedge:          &Hedge{Delay: 20 * time.Millisecond},
+		ModifyResponse: func(*http.Response) error { panic("boom") },
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	// the panic reaches the goroutine of the handler,
+	// where net/http recovers it
+	defer func() {
+		if got := recover(); got != "boom" {
+			t.Errorf("Engine.Initiate() panicked with %v, want boom", got)
+		}
+	}()
+	e.Initiate(httptest.NewRecorder(), httptest.NewRequest("GET", "http://flashx/", nil))
+	t.Error("Engine.Initiate() did not panic")
+}
+
+func TestEngine_hedging_upgrade(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buffer, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buffer.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+		buffer.Flush()
+	}))
+	defer backend.Close()
+
+	e := &Engine{
+		URLs:  []string{backend.URL},
+		Hedge: &Hedge{Delay: 20 * time.Millisecond},
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(e.Initiate))
+	defer proxy.Close()
+
+	request, _ := http.NewRequest("GET", proxy.URL, nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "test")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Engine.Initiate() error = %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("Engine.Initiate() status = %v, want %v", response.StatusCode, http.StatusSwitchingProtocols)
+	}
+}
+
+func TestEngine_hedging_retryBudget(t *testing.T) {
+	var requests int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(50 * time.Millisecond):
+		}
+	}))
+	defer slow.Close()
+
+	e := &Engine{
+		URLs:                  []string{slow.URL, slow.URL + "/"},
+		LoadBalancingStrategy: RoundRobin,
+		Hedge:                 &Hedge{Delay: 5 * time.Millisecond},
+		Retry: &Retry{Budget: &RetryBudget{
+			Ratio:               0.001,
+			MinRetriesPerSecond: 1,
+			Window:              10 * time.Second,
+		}},
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	// the budget allows one hedge for every second of the window
+	for i := 0; i < 12; i++ {
+		e.Initiate(httptest.NewRecorder(), httptest.NewRequest("GET", "http://flashx/", nil))
+	}
+	if got, want := e.RetryStats(), (RetryStats{Allowed: 10, Denied: 2}); got != want {
+		t.Errorf("Engine.RetryStats() = %+v, want %+v", got, want)
+	}
+	if got := atomic.LoadInt32(&requests); got != 22 {
+		t.Errorf("requests to the URLs = %v, want 22", got)
+	}
+}
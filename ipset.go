@@ -0,0 +1,156 @@
+package flashx
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ipTrieNode is a node of a binary trie of IP prefixes
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+
+	// terminal is set if a prefix ends at the node
+	terminal bool
+}
+
+// ipSet is a set of IPs and CIDR ranges, held in a binary trie per
+// address family so that a lookup costs at most 32 or 128 steps
+// regardless of the number of ranges
+type ipSet struct {
+	v4 *ipTrieNode
+	v6 *ipTrieNode
+}
+
+// newIPSet returns the set of the IPs and CIDR ranges of entries,
+// such as "192.168.1.7", "10.0.0.0/8" or "2001:db8::/32"
+func newIPSet(entries []string) (*ipSet, error) {
+	s := &ipSet{v4: &ipTrieNode{}, v6: &ipTrieNode{}}
+	for _, entry := range entries {
+		ipNet, err := parseIPEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		s.add(ipNet)
+	}
+	return s, nil
+}
+
+// parseIPEntry parses an IP or a CIDR range,
+// an IP being a range of a single address
+func parseIPEntry(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("flashx: invalid IP or CIDR range %q", entry)
+		}
+		return ipNet, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("flashx: invalid IP or CIDR range %q", entry)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func (s *ipSet) add(ipNet *net.IPNet) {
+	ones, _ := ipNet.Mask.Size()
+	node := s.v6
+	ip := ipNet.IP.To16()
+	if ip4 := ipNet.IP.To4(); ip4 != nil {
+		node, ip = s.v4, ip4
+		if len(ipNet.Mask) == net.IPv6len {
+			// an IPv4 range written as an IPv4-mapped IPv6 range
+			ones -= 96
+		}
+	}
+	for i := 0; i < ones; i++ {
+		if node.terminal {
+			// a shorter prefix already covers the range
+			return
+		}
+		bit := ipBit(ip, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &ipTrieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.terminal = true
+	// the range covers any longer prefix
+	node.children = [2]*ipTrieNode{}
+}
+
+// contains reports whether the IP is in one of the ranges of the set.
+// A nil set contains no IP
+func (s *ipSet) contains(ip net.IP) bool {
+	if s == nil || ip == nil {
+		return false
+	}
+	node := s.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		node, ip = s.v4, ip4
+	}
+	for i := 0; node != nil; i++ {
+		if node.terminal {
+			return true
+		}
+		if i == len(ip)*8 {
+			return false
+		}
+		node = node.children[ipBit(ip, i)]
+	}
+	return false
+}
+
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// remoteIP returns the IP of the remote address of the request,
+// which may or may not carry a port
+func remoteIP(request *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// ReadIPList reads a list of IPs and CIDR ranges from a file, with one
+// entry per line. Blank lines and the text following a # are ignored.
+// The list can be used as BlacklistIPs or WhitelistIPs
+func ReadIPList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := scanner.Text()
+		if index := strings.Index(entry, "#"); index >= 0 {
+			entry = entry[:index]
+		}
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, err := parseIPEntry(entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,149 @@
+package flashx
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIPSet_contains(t *testing.T) {
+	s, err := newIPSet([]string{
+		"192.168.1.7",
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"172.16.0.0/12",
+		"2001:db8::/32",
+		"::1",
+		"::ffff:100.64.0.0/106",
+	})
+	if err != nil {
+		t.Fatalf("newIPSet() error = %v", err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "192.168.1.7", want: true},
+		{ip: "192.168.1.8", want: false},
+		{ip: "10.200.3.4", want: true},
+		{ip: "11.0.0.1", want: false},
+		{ip: "172.31.255.255", want: true},
+		{ip: "172.32.0.0", want: false},
+		{ip: "::ffff:10.0.0.1", want: true},
+		{ip: "100.127.0.1", want: true},
+		{ip: "100.128.0.1", want: false},
+		{ip: "2001:db8:1::1", want: true},
+		{ip: "2001:db9::1", want: false},
+		{ip: "::1", want: true},
+		{ip: "::2", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := s.contains(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("ipSet.contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, entry := range []string{"", "192.168.1", "10.0.0.0/33", "example.com"} {
+		if _, err := newIPSet([]string{entry}); err == nil {
+			t.Errorf("newIPSet(%q) error = nil, want an error", entry)
+		}
+	}
+}
+
+func TestReadIPList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flashx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "entries and comments",
+			data: "# office\n192.168.1.7\n\n10.0.0.0/8 # VPN\n  2001:db8::/32\n",
+			want: []string{"192.168.1.7", "10.0.0.0/8", "2001:db8::/32"},
+		},
+		{
+			name:    "invalid entry",
+			data:    "192.168.1.7\n10.0.0.0/40\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "ips.txt")
+			if err := ioutil.WriteFile(path, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadIPList(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadIPList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadIPList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngine_blacklistRanges(t *testing.T) {
+	e := &Engine{
+		URLs:         []string{"http://localhost:3000"},
+		BlacklistIPs: []string{"10.1.0.0/16", "2001:db8::1"},
+		WhitelistIPs: []string{"10.0.0.0/8", "2001:db8::/32"},
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		wantStatus int
+	}{
+		{name: "whitelisted", remoteAddr: "10.2.3.4:5678", wantStatus: http.StatusOK},
+		{name: "whitelisted IPv6", remoteAddr: "[2001:db8::2]:5678", wantStatus: http.StatusOK},
+		{name: "blacklisted", remoteAddr: "10.1.3.4:5678", wantStatus: http.StatusForbidden},
+		{name: "blacklisted IPv6", remoteAddr: "[2001:db8::1]:5678", wantStatus: http.StatusForbidden},
+		{name: "not whitelisted", remoteAddr: "192.168.1.7:5678", wantStatus: http.StatusForbidden},
+		{name: "without a port", remoteAddr: "10.1.3.4", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "http://flashx/", nil)
+			request.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			e.blacklist(w, request)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Engine.blacklist() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	if err := e.BlacklistIP("10.2.0.0/16"); err != nil {
+		t.Fatalf("Engine.BlacklistIP() error = %v", err)
+	}
+	if err := e.BlacklistIP("10.2.0.0/99"); err == nil {
+		t.Error("Engine.BlacklistIP() error = nil for an invalid range, want an error")
+	}
+	request := httptest.NewRequest("GET", "http://flashx/", nil)
+	request.RemoteAddr = "10.2.3.4:5678"
+	w := httptest.NewRecorder()
+	e.blacklist(w, request)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Engine.blacklist() status = %v after blacklisting its range, want %v", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,167 @@
+package flashx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMirrorMaxBodySize = 64 << 10
+	defaultMirrorMaxInFlight = 100
+	defaultMirrorTimeout     = 10 * time.Second
+)
+
+// Mirror provides configuration options to send a copy of the
+// requests to a shadow URL, for example to try a rewritten service
+// against production traffic.
+// Copies are sent in the background and their responses are thrown
+// away, so they never delay or fail the requests they copy
+type Mirror struct {
+	// URL is the URL the copies are sent to
+	URL string
+
+	// Percentage is the percentage, between 0 and 100,
+	// of the requests that are copied
+	// If not set, every request is copied
+	Percentage float64
+
+	// MaxBodySize is the maximum size of a request body that is
+	// buffered to be copied. Requests with a larger body are not copied
+	// If not set, a default value will be picked up
+	MaxBodySize int64
+
+	// MaxInFlight is the maximum number of copies in flight,
+	// the requests arriving while it is reached are not copied
+	// If not set, a default value will be picked up
+	MaxInFlight int
+
+	// Timeout is the time a copy has to complete
+	// If not set, a default value will be picked up
+	Timeout time.Duration
+
+	// Transport is the transport used to send the copies
+	// If nil, http.DefaultTransport is used
+	Transport http.RoundTripper
+
+	url *url.URL
+
+	// inFlight holds a token for every copy in flight
+	inFlight chan struct{}
+}
+
+// MirrorStats counts the copies of the requests sent to the shadow URL
+type MirrorStats struct {
+	// Sent counts the copies that received a response
+	Sent int64
+
+	// Failed counts the copies that did not receive a response
+	Failed int64
+
+	// Dropped counts the requests that were sampled but not copied,
+	// either because their body was too large or because
+	// MaxInFlight copies were already in flight
+	Dropped int64
+}
+
+func (m *Mirror) setDefaults() {
+	if m.Percentage <= 0 || m.Percentage > 100 {
+		m.Percentage = 100
+	}
+	if m.MaxBodySize <= 0 {
+		m.MaxBodySize = defaultMirrorMaxBodySize
+	}
+	if m.MaxInFlight <= 0 {
+		m.MaxInFlight = defaultMirrorMaxInFlight
+	}
+	if m.Timeout <= 0 {
+		m.Timeout = defaultMirrorTimeout
+	}
+	if m.Transport == nil {
+		m.Transport = http.DefaultTransport
+	}
+}
+
+func (e *Engine) setupMirror() error {
+	if e.Mirror == nil {
+		return nil
+	}
+	mirror := *e.Mirror
+	mirror.setDefaults()
+	mirrorURL, err := url.Parse(mirror.URL)
+	if err != nil {
+		return err
+	}
+	if mirrorURL.Scheme == "" || mirrorURL.Host == "" {
+		return fmt.Errorf("flashx: mirror URL %q needs a scheme and a host", mirror.URL)
+	}
+	mirror.url = mirrorURL
+	mirror.inFlight = make(chan struct{}, mirror.MaxInFlight)
+	e.mirror = &mirror
+	return nil
+}
+
+// MirrorStats returns the number of copies sent to the shadow URL
+func (e *Engine) MirrorStats() MirrorStats {
+	return MirrorStats{
+		Sent:    atomic.LoadInt64(&e.mirrorStats.Sent),
+		Failed:  atomic.LoadInt64(&e.mirrorStats.Failed),
+		Dropped: atomic.LoadInt64(&e.mirrorStats.Dropped),
+	}
+}
+
+// mirrorRequest sends a copy of the request to the shadow URL in the
+// background, if the request is sampled. The body of the request is
+// buffered, and left readable from the start for the request itself
+func (e *Engine) mirrorRequest(request *http.Request) {
+	m := e.mirror
+	if m.Percentage < 100 && rand.Float64()*100 >= m.Percentage {
+		return
+	}
+	body, ok := bufferBody(request, m.MaxBodySize)
+	if !ok {
+		atomic.AddInt64(&e.mirrorStats.Dropped, 1)
+		return
+	}
+	if body != nil {
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		atomic.AddInt64(&e.mirrorStats.Dropped, 1)
+		return
+	}
+
+	// the copy outlives the request, so it does not
+	// share its context and is cloned right away
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	shadow := request.Clone(ctx)
+	shadow.RequestURI = ""
+	shadow.Body = nil
+	if body != nil {
+		shadow.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	defaultDirector(m.url)(shadow)
+
+	go func() {
+		defer func() { <-m.inFlight }()
+		defer cancel()
+		response, err := m.Transport.RoundTrip(shadow)
+		if err != nil {
+			atomic.AddInt64(&e.mirrorStats.Failed, 1)
+			return
+		}
+		io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+		atomic.AddInt64(&e.mirrorStats.Sent, 1)
+	}()
+}
@@ -0,0 +1,105 @@
+package flashx
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newEchoBackend returns a server that responds with the request body
+func newEchoBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+}
+
+func TestEngine_mirrorRequest(t *testing.T) {
+	primary := newEchoBackend()
+	defer primary.Close()
+	copies := make(chan string, 10)
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		copies <- r.Method + " " + r.URL.RequestURI() + " " + string(body)
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	e := &Engine{
+		URLs:   []string{primary.URL},
+		Mirror: &Mirror{URL: shadow.URL + "/shadow", MaxBodySize: 8, MaxInFlight: 1},
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	send := func(body string) string {
+		w := httptest.NewRecorder()
+		e.Initiate(w, httptest.NewRequest("POST", "http://flashx/users?page=2", strings.NewReader(body)))
+		return w.Body.String()
+	}
+
+	// the shadow URL holds on to the copy, which does not delay the request
+	start := time.Now()
+	if got := send("hello"); got != "hello" {
+		t.Errorf("Engine.Initiate() body = %v, want hello", got)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Engine.Initiate() took %v while the copy was in flight", elapsed)
+	}
+	select {
+	case got := <-copies:
+		if want := "POST /shadow/users?page=2 hello"; got != want {
+			t.Errorf("mirrored request = %v, want %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the request was not mirrored")
+	}
+
+	// MaxInFlight copies are in flight, and the body is too large
+	if got := send("second"); got != "second" {
+		t.Errorf("Engine.Initiate() body = %v, want second", got)
+	}
+	if got := send("a body larger than MaxBodySize"); got != "a body larger than MaxBodySize" {
+		t.Errorf("Engine.Initiate() body = %v, want the whole body", got)
+	}
+	close(release)
+	waitFor(t, func() bool { return e.MirrorStats() == MirrorStats{Sent: 1, Dropped: 2} })
+}
+
+func TestEngine_mirrorRequest_failure(t *testing.T) {
+	primary := newEchoBackend()
+	defer primary.Close()
+	shadow := httptest.NewServer(http.NotFoundHandler())
+	shadow.Close()
+
+	e := &Engine{
+		URLs:   []string{primary.URL},
+		Mirror: &Mirror{URL: shadow.URL},
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	w := httptest.NewRecorder()
+	e.Initiate(w, httptest.NewRequest("GET", "http://flashx/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Engine.Initiate() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	waitFor(t, func() bool { return e.MirrorStats() == MirrorStats{Failed: 1} })
+}
+
+func TestEngine_setupMirror(t *testing.T) {
+	e := &Engine{URLs: []string{"http://localhost:3000"}, Mirror: &Mirror{URL: "localhost:4000"}}
+	if err := e.Setup(); err == nil {
+		e.Close()
+		t.Error("Engine.Setup() error = nil for a mirror URL without a host, want an error")
+	}
+}
@@ -0,0 +1,176 @@
+package flashx
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultOutlierConsecutiveFailures = 5
+	defaultOutlierMinRequests         = 10
+	defaultOutlierInterval            = 10 * time.Second
+	defaultOutlierBaseEjectionTime    = 30 * time.Second
+	defaultOutlierMaxEjectionTime     = 5 * time.Minute
+	defaultOutlierMaxEjectionPercent  = 50
+)
+
+// OutlierDetection provides configuration options to passively
+// watch the outcome of the proxied requests and temporarily eject
+// the URLs that keep failing.
+// A request fails if the URL cannot be reached or if
+// it responds with a 5xx status code.
+// Every time a URL is ejected, it stays out of the pool
+// twice as long as the previous time, up to MaxEjectionTime
+type OutlierDetection struct {
+	// ConsecutiveFailures is the number of failed requests
+	// in a row after which a URL is ejected
+	// If not set, a default value will be picked up
+	ConsecutiveFailures int
+
+	// ErrorRate is the ratio of failed requests, between 0 and 1,
+	// within Interval after which a URL is ejected
+	// If not set, the error rate will not be checked
+	ErrorRate float64
+
+	// MinRequests is the number of requests a URL needs to
+	// serve within Interval before its ErrorRate is checked
+	// If not set, a default value will be picked up
+	MinRequests int
+
+	// Interval is the window over which ErrorRate is measured
+	// If not set, a default value will be picked up
+	Interval time.Duration
+
+	// BaseEjectionTime is the time a URL is ejected for
+	// the first time it crosses a threshold
+	// If not set, a default value will be picked up
+	BaseEjectionTime time.Duration
+
+	// MaxEjectionTime is the maximum time a URL is ejected for
+	// If not set, a default value will be picked up
+	MaxEjectionTime time.Duration
+
+	// MaxEjectionPercent is the maximum percentage of URLs
+	// that can be ejected at the same time.
+	// One URL can always be ejected as long as the pool
+	// has more than one URL, but the last one never is
+	// If not set, a default value will be picked up
+	MaxEjectionPercent int
+}
+
+func (o *OutlierDetection) setDefaults() {
+	if o.ConsecutiveFailures <= 0 {
+		o.ConsecutiveFailures = defaultOutlierConsecutiveFailures
+	}
+	if o.MinRequests <= 0 {
+		o.MinRequests = defaultOutlierMinRequests
+	}
+	if o.Interval <= 0 {
+		o.Interval = defaultOutlierInterval
+	}
+	if o.BaseEjectionTime <= 0 {
+		o.BaseEjectionTime = defaultOutlierBaseEjectionTime
+	}
+	if o.MaxEjectionTime <= 0 {
+		o.MaxEjectionTime = defaultOutlierMaxEjectionTime
+	}
+	if o.MaxEjectionPercent <= 0 {
+		o.MaxEjectionPercent = defaultOutlierMaxEjectionPercent
+	}
+}
+
+// ejectionTime returns the time a URL is ejected
+// for, the nth time it gets ejected
+func (o *OutlierDetection) ejectionTime(n int) time.Duration {
+	ejectionTime := o.BaseEjectionTime
+	for i := 1; i < n && ejectionTime < o.MaxEjectionTime; i++ {
+		ejectionTime *= 2
+	}
+	if ejectionTime > o.MaxEjectionTime {
+		ejectionTime = o.MaxEjectionTime
+	}
+	return ejectionTime
+}
+
+func (e *Engine) setupOutlierDetection() {
+	if e.OutlierDetection == nil {
+		return
+	}
+	outlierDetection := *e.OutlierDetection
+	outlierDetection.setDefaults()
+	e.outlierDetection = &outlierDetection
+}
+
+// detectOutlier records whether the backend failed to serve
+// a request, and ejects it if it crossed a threshold
+func (e *Engine) detectOutlier(b *backend, failed bool, now time.Time) {
+	o := e.outlierDetection
+	if o == nil {
+		return
+	}
+
+	b.outlierMu.Lock()
+	if now.Sub(b.windowStart) >= o.Interval {
+		// a URL that went a whole window without failures
+		// earns back one step of its ejection time
+		if b.windowFailures == 0 && b.ejections > 0 && !b.ejected(now) {
+			b.ejections--
+		}
+		b.windowStart = now
+		b.windowRequests = 0
+		b.windowFailures = 0
+	}
+	b.windowRequests++
+	if failed {
+		b.windowFailures++
+		b.consecutiveFailures++
+	} else {
+		b.consecutiveFailures = 0
+	}
+	eject := b.consecutiveFailures >= o.ConsecutiveFailures ||
+		(o.ErrorRate > 0 && b.windowRequests >= o.MinRequests &&
+			float64(b.windowFailures) >= o.ErrorRate*float64(b.windowRequests))
+	b.outlierMu.Unlock()
+
+	if eject {
+		e.eject(b, now)
+	}
+}
+
+func (e *Engine) eject(b *backend, now time.Time) {
+	e.outlierMu.Lock()
+	defer e.outlierMu.Unlock()
+	if b.ejected(now) {
+		return
+	}
+
+	_, backends := e.pool()
+	ejected := 0
+	for _, other := range backends {
+		if other.ejected(now) {
+			ejected++
+		}
+	}
+	maxEjected := len(backends) * e.outlierDetection.MaxEjectionPercent / 100
+	if maxEjected < 1 {
+		maxEjected = 1
+	}
+	if maxEjected >= len(backends) {
+		maxEjected = len(backends) - 1
+	}
+	if ejected >= maxEjected {
+		return
+	}
+
+	b.outlierMu.Lock()
+	b.ejections++
+	ejectionTime := e.outlierDetection.ejectionTime(b.ejections)
+	b.consecutiveFailures = 0
+	b.windowStart = now.Add(ejectionTime)
+	b.windowRequests = 0
+	b.windowFailures = 0
+	atomic.StoreInt64(&b.ejectedUntil, now.Add(ejectionTime).UnixNano())
+	b.outlierMu.Unlock()
+
+	e.logf("flashx: %s has been ejected for %v", b.url, ejectionTime)
+}
@@ -0,0 +1,138 @@
+package flashx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOutlierDetection_ejectionTime(t *testing.T) {
+	o := &OutlierDetection{
+		BaseEjectionTime: time.Second,
+		MaxEjectionTime:  10 * time.Second,
+	}
+	tests := []struct {
+		ejections int
+		want      time.Duration
+	}{
+		{ejections: 1, want: time.Second},
+		{ejections: 2, want: 2 * time.Second},
+		{ejections: 4, want: 8 * time.Second},
+		{ejections: 5, want: 10 * time.Second},
+		{ejections: 100, want: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := o.ejectionTime(tt.ejections); got != tt.want {
+			t.Errorf("OutlierDetection.ejectionTime(%d) = %v, want %v", tt.ejections, got, tt.want)
+		}
+	}
+}
+
+func newOutlierTestEngine(urls []*url.URL, outlierDetection OutlierDetection) *Engine {
+	e := &Engine{
+		urls:             urls,
+		OutlierDetection: &outlierDetection,
+	}
+	e.populateBackends()
+	e.setupOutlierDetection()
+	return e
+}
+
+func TestEngine_recordOutcome(t *testing.T) {
+	urls := testURLs()
+	tests := []struct {
+		name             string
+		outlierDetection OutlierDetection
+		outcomes         []bool
+		wantEjected      bool
+	}{
+		{
+			name:             "consecutive failures",
+			outlierDetection: OutlierDetection{ConsecutiveFailures: 3},
+			outcomes:         []bool{true, true, true},
+			wantEjected:      true,
+		},
+		{
+			name:             "failures interrupted by a success",
+			outlierDetection: OutlierDetection{ConsecutiveFailures: 3},
+			outcomes:         []bool{true, true, false, true, true},
+			wantEjected:      false,
+		},
+		{
+			name:             "error rate",
+			outlierDetection: OutlierDetection{ConsecutiveFailures: 100, ErrorRate: 0.5, MinRequests: 4},
+			outcomes:         []bool{true, false, true, false},
+			wantEjected:      true,
+		},
+		{
+			name:             "error rate below min requests",
+			outlierDetection: OutlierDetection{ConsecutiveFailures: 100, ErrorRate: 0.5, MinRequests: 5},
+			outcomes:         []bool{true, false, true, false},
+			wantEjected:      false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newOutlierTestEngine(urls, tt.outlierDetection)
+			for _, failed := range tt.outcomes {
+				e.recordOutcome(urls[0], failed)
+			}
+			if got := e.backends[urls[0]].ejected(time.Now()); got != tt.wantEjected {
+				t.Errorf("backend.ejected() = %v, want %v", got, tt.wantEjected)
+			}
+		})
+	}
+}
+
+func TestEngine_eject_maxEjectionPercent(t *testing.T) {
+	urls := testURLs()
+	e := newOutlierTestEngine(urls, OutlierDetection{ConsecutiveFailures: 1, MaxEjectionPercent: 100})
+	for _, u := range urls {
+		e.recordOutcome(u, true)
+	}
+	if got := len(e.availableURLs()); got != 1 {
+		t.Errorf("Engine.availableURLs() has %d URLs, want the last URL to never be ejected", got)
+	}
+
+	e = newOutlierTestEngine(urls, OutlierDetection{ConsecutiveFailures: 1, MaxEjectionPercent: 10})
+	for _, u := range urls {
+		e.recordOutcome(u, true)
+	}
+	if got := len(e.availableURLs()); got != 2 {
+		t.Errorf("Engine.availableURLs() has %d URLs, want a single URL ejected", got)
+	}
+}
+
+func TestEngine_outlierDetection(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	stable := newTestBackend("stable")
+	defer stable.Close()
+
+	e := &Engine{
+		URLs:                  []string{broken.URL, stable.URL},
+		LoadBalancingStrategy: RoundRobin,
+		OutlierDetection: &OutlierDetection{
+			ConsecutiveFailures: 2,
+			BaseEjectionTime:    time.Minute,
+		},
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	statuses := make(map[int]int)
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		e.Initiate(w, httptest.NewRequest("GET", "http://flashx/", nil))
+		statuses[w.Code]++
+	}
+	if statuses[http.StatusInternalServerError] != 2 || statuses[http.StatusOK] != 8 {
+		t.Errorf("Engine.Initiate() statuses = %v, want the broken URL ejected after 2 failures", statuses)
+	}
+}
@@ -0,0 +1,169 @@
+package flashx
+
+import (
+	"net/url"
+	"sync/atomic"
+)
+
+// AddBackend adds a URL to the pool while the Engine is serving requests.
+// The weight is used by the Weighted Round Robin and the Weighted Least
+// Connections strategies, as well as any Balancer that implements
+// WeightedBalancer. The URL needs a scheme and a host.
+// URLs and RoundRobinWeights are left untouched
+func (e *Engine) AddBackend(rawURL string, weight int) error {
+	if weight <= 0 {
+		return errNonPositiveWeight
+	}
+	routeURL, err := url.Parse(rawURL)
+	if err != nil || routeURL.Scheme == "" || routeURL.Host == "" {
+		return ErrInvalidURL
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.findURL(routeURL.String()) != nil {
+		return ErrURLExists
+	}
+	e.addLocked(routeURL, weight)
+	return nil
+}
+
+// addLocked adds a URL to the pool and returns its backend.
+// It must be called while holding mu
+func (e *Engine) addLocked(routeURL *url.URL, weight int) *backend {
+	b := e.newBackend(routeURL)
+	b.weight = int64(weight)
+	if weightedBalancer, ok := e.balancer.(WeightedBalancer); ok {
+		weightedBalancer.SetWeight(routeURL, weight)
+	}
+
+	urls := make([]*url.URL, len(e.urls), len(e.urls)+1)
+	copy(urls, e.urls)
+	backends := make(map[*url.URL]*backend, len(e.backends)+1)
+	for k, v := range e.backends {
+		backends[k] = v
+	}
+	backends[routeURL] = b
+	e.urls, e.backends = append(urls, routeURL), backends
+	return b
+}
+
+// RemoveBackend removes a URL from the pool right away.
+// The requests in flight to the URL are not interrupted,
+// use DrainBackend to wait for them to finish
+func (e *Engine) RemoveBackend(rawURL string) error {
+	e.mu.RLock()
+	routeURL := e.findURL(rawURL)
+	e.mu.RUnlock()
+	if routeURL == nil {
+		return ErrURLNotFound
+	}
+	e.remove(e.backend(routeURL))
+	return nil
+}
+
+// DrainBackend stops routing new requests to a URL, and removes it
+// from the pool once the requests in flight to it have finished.
+// The returned channel is closed once the URL has been removed
+func (e *Engine) DrainBackend(rawURL string) (<-chan struct{}, error) {
+	e.mu.RLock()
+	routeURL := e.findURL(rawURL)
+	e.mu.RUnlock()
+	if routeURL == nil {
+		return nil, ErrURLNotFound
+	}
+	b := e.backend(routeURL)
+	if b == nil {
+		return nil, ErrURLNotFound
+	}
+	atomic.StoreInt32(&b.draining, 1)
+	e.finishDrain(b)
+	return b.drained, nil
+}
+
+// SetWeight changes the weight of a URL in the pool.
+// The weight is only used by weighted strategies
+func (e *Engine) SetWeight(rawURL string, weight int) error {
+	if weight <= 0 {
+		return errNonPositiveWeight
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	routeURL := e.findURL(rawURL)
+	if routeURL == nil {
+		return ErrURLNotFound
+	}
+	e.setWeightLocked(routeURL, weight)
+	return nil
+}
+
+// setWeightLocked changes the weight of a URL of the pool.
+// It must be called while holding mu
+func (e *Engine) setWeightLocked(routeURL *url.URL, weight int) {
+	atomic.StoreInt64(&e.backends[routeURL].weight, int64(weight))
+	if weightedBalancer, ok := e.balancer.(WeightedBalancer); ok {
+		weightedBalancer.SetWeight(routeURL, weight)
+	}
+}
+
+// findURL returns the URL of the pool matching rawURL, or nil.
+// It must be called while holding mu
+func (e *Engine) findURL(rawURL string) *url.URL {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	for _, v := range e.urls {
+		if v.String() == parsedURL.String() {
+			return v
+		}
+	}
+	return nil
+}
+
+// remove removes the backend from the pool, if it is still
+// in it, and unblocks the callers waiting for it to be drained
+func (e *Engine) remove(b *backend) {
+	if b == nil {
+		return
+	}
+	e.mu.Lock()
+	e.removeLocked(b)
+	e.mu.Unlock()
+}
+
+// finishDrain removes a draining backend once
+// it has no more requests in flight
+func (e *Engine) finishDrain(b *backend) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if atomic.LoadInt32(&b.draining) == 1 && atomic.LoadInt64(&b.active) == 0 {
+		e.removeLocked(b)
+	}
+}
+
+// removeLocked removes the backend from the pool.
+// It must be called while holding mu
+func (e *Engine) removeLocked(b *backend) {
+	if e.backends[b.url] == b {
+		urls := make([]*url.URL, 0, len(e.urls))
+		for _, v := range e.urls {
+			if v != b.url {
+				urls = append(urls, v)
+			}
+		}
+		backends := make(map[*url.URL]*backend, len(e.backends))
+		for k, v := range e.backends {
+			if k != b.url {
+				backends[k] = v
+			}
+		}
+		e.urls, e.backends = urls, backends
+		if forgetting, ok := e.balancer.(ForgettingBalancer); ok {
+			forgetting.Forget(b.url)
+		}
+	}
+	b.drainOnce.Do(func() {
+		close(b.drained)
+	})
+}
@@ -0,0 +1,232 @@
+package flashx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bodies sends n requests through the Engine and returns the response bodies
+func bodies(e *Engine, n int) []string {
+	got := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		w := httptest.NewRecorder()
+		e.Initiate(w, httptest.NewRequest("GET", "http://flashx/", nil))
+		got = append(got, w.Body.String())
+	}
+	return got
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for index := range a {
+		if a[index] != b[index] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEngine_AddBackend(t *testing.T) {
+	first := newTestBackend("first")
+	defer first.Close()
+	second := newTestBackend("second")
+	defer second.Close()
+
+	e := &Engine{
+		URLs:                  []string{first.URL},
+		LoadBalancingStrategy: RoundRobin,
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	tests := []struct {
+		name    string
+		rawURL  string
+		weight  int
+		wantErr error
+	}{
+		{name: "new URL", rawURL: second.URL, weight: 1},
+		{name: "URL already in the pool", rawURL: first.URL, weight: 1, wantErr: ErrURLExists},
+		{name: "non positive weight", rawURL: "http://localhost:5000", weight: 0, wantErr: errNonPositiveWeight},
+		{name: "missing URL", rawURL: "", weight: 1, wantErr: ErrInvalidURL},
+		{name: "URL without a scheme", rawURL: "not a url", weight: 1, wantErr: ErrInvalidURL},
+		{name: "URL without a host", rawURL: "http:///path", weight: 1, wantErr: ErrInvalidURL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := e.AddBackend(tt.rawURL, tt.weight); err != tt.wantErr {
+				t.Errorf("Engine.AddBackend() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	want := []string{"first", "second", "first", "second"}
+	if got := bodies(e, 4); !equalStrings(got, want) {
+		t.Errorf("Engine.Initiate() bodies = %v, want %v", got, want)
+	}
+}
+
+func TestEngine_RemoveBackend(t *testing.T) {
+	first := newTestBackend("first")
+	defer first.Close()
+	second := newTestBackend("second")
+	defer second.Close()
+
+	e := &Engine{
+		URLs:                  []string{first.URL, second.URL},
+		LoadBalancingStrategy: RoundRobin,
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	if err := e.RemoveBackend(first.URL); err != nil {
+		t.Fatalf("Engine.RemoveBackend() error = %v", err)
+	}
+	if err := e.RemoveBackend(first.URL); err != ErrURLNotFound {
+		t.Errorf("Engine.RemoveBackend() error = %v, want %v", err, ErrURLNotFound)
+	}
+
+	want := []string{"second", "second", "second"}
+	if got := bodies(e, 3); !equalStrings(got, want) {
+		t.Errorf("Engine.Initiate() bodies = %v, want %v", got, want)
+	}
+}
+
+func TestEngine_RemoveBackend_forget(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	second := newTestBackend("second")
+	defer second.Close()
+
+	e := &Engine{
+		URLs:                  []string{slow.URL, second.URL},
+		LoadBalancingStrategy: WeightedResponseTime,
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+	slowURL := e.findURL(slow.URL)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.route(httptest.NewRecorder(), httptest.NewRequest("GET", "http://flashx/", nil), slowURL, nil)
+	}()
+	waitFor(t, func() bool { return atomic.LoadInt64(&e.backend(slowURL).active) == 1 })
+
+	// the request in flight finishes once the URL is removed
+	if err := e.RemoveBackend(slow.URL); err != nil {
+		t.Fatalf("Engine.RemoveBackend() error = %v", err)
+	}
+	close(release)
+	<-done
+	balancer := e.currentBalancer().(*weightedResponseTimeBalancer)
+	balancer.mu.Lock()
+	defer balancer.mu.Unlock()
+	if _, ok := balancer.responseTimes[slowURL]; ok {
+		t.Error("weightedResponseTimeBalancer keeps the response time of the removed URL")
+	}
+}
+
+func TestEngine_DrainBackend(t *testing.T) {
+	release := make(chan struct{})
+	var started int32
+	blocking := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(&started, 1)
+		<-release
+		w.Write([]byte("blocking"))
+	}))
+	defer blocking.Close()
+	other := newTestBackend("other")
+	defer other.Close()
+
+	e := &Engine{
+		URLs:                  []string{blocking.URL, other.URL},
+		LoadBalancingStrategy: RoundRobin,
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	inFlight := make(chan string)
+	go func() {
+		inFlight <- bodies(e, 1)[0]
+	}()
+	waitFor(t, func() bool { return atomic.LoadInt32(&started) == 1 })
+
+	drained, err := e.DrainBackend(blocking.URL)
+	if err != nil {
+		t.Fatalf("Engine.DrainBackend() error = %v", err)
+	}
+	want := []string{"other", "other"}
+	if got := bodies(e, 2); !equalStrings(got, want) {
+		t.Errorf("Engine.Initiate() bodies while draining = %v, want %v", got, want)
+	}
+	select {
+	case <-drained:
+		t.Fatal("Engine.DrainBackend() drained with a request in flight")
+	default:
+	}
+
+	close(release)
+	if got := <-inFlight; got != "blocking" {
+		t.Errorf("Engine.Initiate() in flight body = %q, want %q", got, "blocking")
+	}
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("Engine.DrainBackend() did not drain once the request finished")
+	}
+	if urls, _ := e.pool(); len(urls) != 1 || urls[0].String() != other.URL {
+		t.Errorf("Engine.urls = %v, want [%v]", urls, other.URL)
+	}
+	if _, err := e.DrainBackend(blocking.URL); err != ErrURLNotFound {
+		t.Errorf("Engine.DrainBackend() error = %v, want %v", err, ErrURLNotFound)
+	}
+}
+
+func TestEngine_SetWeight(t *testing.T) {
+	first := newTestBackend("first")
+	defer first.Close()
+	second := newTestBackend("second")
+	defer second.Close()
+
+	e := &Engine{
+		URLs:                  []string{first.URL, second.URL},
+		LoadBalancingStrategy: WeightedRoundRobin,
+		RoundRobinWeights:     []int{1, 1},
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	if err := e.SetWeight(first.URL, 3); err != nil {
+		t.Fatalf("Engine.SetWeight() error = %v", err)
+	}
+	if err := e.SetWeight("http://localhost:5000", 3); err != ErrURLNotFound {
+		t.Errorf("Engine.SetWeight() error = %v, want %v", err, ErrURLNotFound)
+	}
+
+	counts := make(map[string]int)
+	for _, body := range bodies(e, 8) {
+		counts[body]++
+	}
+	if counts["first"] != 6 || counts["second"] != 2 {
+		t.Errorf("Engine.Initiate() counts = %v, want 6 first and 2 second", counts)
+	}
+}
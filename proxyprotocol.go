@@ -0,0 +1,214 @@
+package flashx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultProxyProtocolTimeout = 5 * time.Second
+
+var (
+	// proxyProtocolV1Prefix starts the text header of version 1
+	proxyProtocolV1Prefix = []byte("PROXY ")
+
+	// proxyProtocolV2Signature starts the binary header of version 2
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errInvalidProxyProtocolHeader = errors.New("flashx: invalid PROXY protocol header")
+)
+
+// ProxyProtocolListener wraps a listener whose connections come
+// through a proxy speaking the PROXY protocol, versions 1 and 2,
+// such as a TCP load balancer. The remote address of a connection
+// coming from one of TrustedProxies is the client address the proxy
+// sent in its header. The other connections are left untouched,
+// so a client cannot pretend to be someone else by sending a header.
+//
+//	listener, _ := net.Listen("tcp", ":8080")
+//	http.Serve(&flashx.ProxyProtocolListener{
+//		Listener:       listener,
+//		TrustedProxies: []string{"10.0.0.0/8"},
+//	}, engine)
+type ProxyProtocolListener struct {
+	net.Listener
+
+	// TrustedProxies is an array of the IPs and CIDR
+	// ranges of the proxies allowed to send a header
+	TrustedProxies []string
+
+	// Timeout is the time a trusted proxy has to send its header
+	// If not set, a default value will be picked up
+	Timeout time.Duration
+
+	setupOnce  sync.Once
+	trustedSet *ipSet
+	setupErr   error
+}
+
+// Accept waits for the next connection. The header of a trusted proxy
+// is read on the first call to Read or RemoteAddr of the connection,
+// so a slow proxy does not hold back the other connections
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	l.setupOnce.Do(func() {
+		l.trustedSet, l.setupErr = newIPSet(l.TrustedProxies)
+	})
+	if l.setupErr != nil {
+		return nil, l.setupErr
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	var ip net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	if !l.trustedSet.contains(ip) {
+		return conn, nil
+	}
+	timeout := l.Timeout
+	if timeout <= 0 {
+		timeout = defaultProxyProtocolTimeout
+	}
+	return &proxyProtocolConn{
+		Conn:       conn,
+		reader:     bufio.NewReader(conn),
+		timeout:    timeout,
+		remoteAddr: conn.RemoteAddr(),
+	}, nil
+}
+
+// proxyProtocolConn is a connection of a trusted proxy
+type proxyProtocolConn struct {
+	net.Conn
+
+	reader *bufio.Reader
+
+	timeout time.Duration
+
+	once sync.Once
+
+	remoteAddr net.Addr
+
+	err error
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address sent by the proxy,
+// or the address of the proxy if it did not send one
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	return c.remoteAddr
+}
+
+// readHeader reads the header, if the proxy sent one.
+// A connection with an invalid header is unusable
+func (c *proxyProtocolConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	var addr net.Addr
+	if start, _ := c.reader.Peek(len(proxyProtocolV2Signature)); bytes.Equal(start, proxyProtocolV2Signature) {
+		addr, c.err = readProxyProtocolV2(c.reader)
+	} else if start, _ := c.reader.Peek(len(proxyProtocolV1Prefix)); bytes.Equal(start, proxyProtocolV1Prefix) {
+		addr, c.err = readProxyProtocolV1(c.reader)
+	}
+	if c.err != nil {
+		c.Conn.Close()
+		return
+	}
+	if addr != nil {
+		c.remoteAddr = addr
+	}
+}
+
+// readProxyProtocolV1 reads a header such as
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", and returns
+// nil for the UNKNOWN protocol, which carries no address
+func readProxyProtocolV1(reader *bufio.Reader) (net.Addr, error) {
+	// a header is at most 107 bytes long
+	var line []byte
+	for len(line) < 107 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errInvalidProxyProtocolHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errInvalidProxyProtocolHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errInvalidProxyProtocolHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 reads a binary header, and returns nil for the
+// LOCAL command and the address families other than TCP over IPv4
+// and IPv6, which carry no address to use
+func readProxyProtocolV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errInvalidProxyProtocolHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	command, family := header[12]&0x0f, header[13]
+	if command == 0 {
+		return nil, nil
+	}
+	if command != 1 {
+		return nil, errInvalidProxyProtocolHeader
+	}
+	var ipLen int
+	switch family {
+	case 0x11:
+		ipLen = net.IPv4len
+	case 0x21:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	// the source and destination addresses, then their ports
+	if len(payload) < 2*ipLen+4 {
+		return nil, errInvalidProxyProtocolHeader
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, payload[:ipLen])
+	port := binary.BigEndian.Uint16(payload[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,137 @@
+package flashx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// proxyProtocolV2Header returns a version 2 header of a
+// TCP over IPv4 connection from the source address
+func proxyProtocolV2Header(source *net.TCPAddr) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x21, 0x11, 0, 12)
+	header = append(header, source.IP.To4()...)
+	header = append(header, 192, 0, 2, 1)
+	header = append(header, byte(source.Port>>8), byte(source.Port))
+	return append(header, 0, 80)
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		header         []byte
+		wantAddr       string
+		wantBody       string
+	}{
+		{
+			name:           "version 1",
+			trustedProxies: []string{"127.0.0.1"},
+			header:         []byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 80\r\n"),
+			wantAddr:       "203.0.113.7:56324",
+			wantBody:       "hello",
+		},
+		{
+			name:           "version 1 of an IPv6 client",
+			trustedProxies: []string{"127.0.0.1"},
+			header:         []byte("PROXY TCP6 2001:db8::7 2001:db8::1 56324 80\r\n"),
+			wantAddr:       "[2001:db8::7]:56324",
+			wantBody:       "hello",
+		},
+		{
+			name:           "version 1 of an unknown connection",
+			trustedProxies: []string{"127.0.0.1"},
+			header:         []byte("PROXY UNKNOWN\r\n"),
+			wantAddr:       "127.0.0.1",
+			wantBody:       "hello",
+		},
+		{
+			name:           "version 2",
+			trustedProxies: []string{"127.0.0.0/8"},
+			header:         proxyProtocolV2Header(&net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 56324}),
+			wantAddr:       "203.0.113.7:56324",
+			wantBody:       "hello",
+		},
+		{
+			name:           "no header",
+			trustedProxies: []string{"127.0.0.1"},
+			wantAddr:       "127.0.0.1",
+			wantBody:       "hello",
+		},
+		{
+			name:           "untrusted proxy",
+			trustedProxies: []string{"10.0.0.0/8"},
+			header:         []byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 80\r\n"),
+			wantAddr:       "127.0.0.1",
+			wantBody:       "PROXY TCP4 203.0.113.7 192.0.2.1 56324 80\r\nhello",
+		},
+		{
+			name:           "invalid header",
+			trustedProxies: []string{"127.0.0.1"},
+			header:         []byte("PROXY TCP4 203.0.113.7\r\n"),
+			wantAddr:       "127.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("net.Listen() error = %v", err)
+			}
+			l := &ProxyProtocolListener{Listener: listener, TrustedProxies: tt.trustedProxies}
+			defer l.Close()
+
+			go func() {
+				client, err := net.Dial("tcp", listener.Addr().String())
+				if err != nil {
+					return
+				}
+				client.Write(append(tt.header, "hello"...))
+				client.Close()
+			}()
+
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatalf("ProxyProtocolListener.Accept() error = %v", err)
+			}
+			defer conn.Close()
+			addr := conn.RemoteAddr().String()
+			if host, _, err := net.SplitHostPort(addr); err == nil && tt.wantAddr == "127.0.0.1" {
+				addr = host
+			}
+			if addr != tt.wantAddr {
+				t.Errorf("RemoteAddr() = %v, want %v", addr, tt.wantAddr)
+			}
+			body, _ := ioutil.ReadAll(conn)
+			if !bytes.Equal(body, []byte(tt.wantBody)) {
+				t.Errorf("Read() = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolListener_http(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	remoteAddrs := make(chan string, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs <- r.RemoteAddr
+	})}
+	go server.Serve(&ProxyProtocolListener{Listener: listener, TrustedProxies: []string{"127.0.0.1"}})
+	defer server.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() error = %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 80\r\nGET / HTTP/1.1\r\nHost: flashx\r\n\r\n"))
+	if got := <-remoteAddrs; got != "203.0.113.7:56324" {
+		t.Errorf("Request.RemoteAddr = %v, want 203.0.113.7:56324", got)
+	}
+}
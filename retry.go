@@ -0,0 +1,296 @@
+package flashx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRetryMaxAttempts = 2
+	defaultRetryBackoff     = 25 * time.Millisecond
+	defaultRetryMaxBodySize = 64 << 10
+)
+
+// idempotencyKeyHeader marks a request as safe to retry
+// regardless of its method
+const idempotencyKeyHeader = "Idempotency-Key"
+
+var (
+	defaultRetryableStatusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+	// errRetryableStatusCode is returned by ModifyResponse
+	// to discard a response that is going to be retried
+	errRetryableStatusCode = errors.New("flashx: retryable status code")
+)
+
+// Retry provides configuration options to retry requests on another
+// URL when the chosen URL cannot be reached, takes longer than
+// PerTryTimeout to respond, or responds with a retryable status code.
+// Only idempotent requests are retried: GET, HEAD and OPTIONS
+// requests, as well as requests carrying an Idempotency-Key header
+type Retry struct {
+	// MaxAttempts is the maximum number of times a request
+	// is sent, including the first attempt
+	// If not set, a default value will be picked up
+	MaxAttempts int
+
+	// PerTryTimeout is the time each attempt has to receive
+	// the response headers before it is given up on
+	// If not set, attempts will not time out
+	PerTryTimeout time.Duration
+
+	// Backoff is the time waited before the first retry,
+	// doubling before every subsequent retry
+	// If not set, a default value will be picked up
+	Backoff time.Duration
+
+	// RetryableStatusCodes holds the status codes that are retried
+	// If not set, 502, 503 and 504 responses are retried
+	RetryableStatusCodes []int
+
+	// MaxBodySize is the maximum size of a request body that
+	// is buffered to be replayed. Requests with a larger
+	// body are never retried
+	// If not set, a default value will be picked up
+	MaxBodySize int64
+
+	// Budget bounds the number of retries
+	// If nil, a default budget will be applied
+	Budget *RetryBudget
+
+	statusCodes map[int]bool
+}
+
+func (r *Retry) setDefaults() {
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if r.Backoff <= 0 {
+		r.Backoff = defaultRetryBackoff
+	}
+	if r.RetryableStatusCodes == nil {
+		r.RetryableStatusCodes = defaultRetryableStatusCodes
+	}
+	if r.MaxBodySize <= 0 {
+		r.MaxBodySize = defaultRetryMaxBodySize
+	}
+	if r.Budget == nil {
+		r.Budget = &RetryBudget{}
+	}
+	budget := *r.Budget
+	budget.setDefaults()
+	r.Budget = &budget
+	r.statusCodes = make(map[int]bool)
+	for _, statusCode := range r.RetryableStatusCodes {
+		r.statusCodes[statusCode] = true
+	}
+}
+
+// backoff returns the time to wait before the nth retry
+func (r *Retry) backoff(n int) time.Duration {
+	return r.Backoff << uint(n-1)
+}
+
+func (e *Engine) setupRetry() {
+	if e.Retry == nil {
+		return
+	}
+	retry := *e.Retry
+	retry.setDefaults()
+	e.retry = &retry
+	e.retryBudget = newRetryBudget(retry.Budget)
+}
+
+// newRetryBudget returns the retry budget of a URL,
+// or nil if requests are not retried
+func (e *Engine) newRetryBudget() *retryBudget {
+	if e.retry == nil {
+		return nil
+	}
+	return newRetryBudget(e.retry.Budget)
+}
+
+// attempt holds the state of a single try of a request
+type attempt struct {
+	// retryable is set if the attempt may be retried,
+	// in which case a failure is not written to the client
+	retryable bool
+
+	// statusCodes holds the status codes that are retried
+	statusCodes map[int]bool
+
+	// allowRetry reports whether the retry budget allows
+	// the attempt to be retried, withdrawing it if so
+	allowRetry func() bool
+
+	// timer cancels the attempt once PerTryTimeout elapses,
+	// unless it is stopped when the response headers are received
+	timer *time.Timer
+
+	// timedOut is set to 1 once PerTryTimeout elapses
+	timedOut int32
+
+	// retry is set if the attempt failed and
+	// nothing has been written to the client
+	retry bool
+
+	// err holds the error that caused the retry
+	err error
+
+	// hedged is set if the attempt is one of the attempts of
+	// a hedged request, in which case a failure is never written
+	// to the client
+	hedged bool
+
+	// cancelled is set to 1 once the attempt is cancelled
+	// because another attempt of a hedged request won
+	cancelled int32
+}
+
+// responseReceived stops the per try timer
+// once the response headers are received
+func (a *attempt) responseReceived() {
+	if a != nil && a.timer != nil {
+		a.timer.Stop()
+	}
+}
+
+// failed reports whether the error of the attempt is a failure of the
+// URL, rather than the request being cancelled by the client or the
+// attempt being cancelled by a hedged request. An attempt that runs out
+// of PerTryTimeout is a failure, even though its request is cancelled
+func (a *attempt) failed(request *http.Request) bool {
+	timedOut := a != nil && atomic.LoadInt32(&a.timedOut) == 1
+	if request.Context().Err() != nil && !timedOut {
+		return false
+	}
+	return a == nil || atomic.LoadInt32(&a.cancelled) == 0
+}
+
+// retryStatus reports whether a response with
+// the status code should be retried
+func (a *attempt) retryStatus(statusCode int) bool {
+	return a != nil && a.retryable && a.statusCodes[statusCode] && a.allowRetry()
+}
+
+// shouldRetry reports whether the error from a transport
+// or from ModifyResponse can be retried
+func (a *attempt) shouldRetry(err error) bool {
+	if a != nil && a.hedged {
+		return true
+	}
+	if a == nil || !a.retryable {
+		return false
+	}
+	if err == errRetryableStatusCode {
+		return true
+	}
+	var opErr *net.OpError
+	if atomic.LoadInt32(&a.timedOut) == 1 || (errors.As(err, &opErr) && opErr.Op == "dial") {
+		return a.allowRetry()
+	}
+	return false
+}
+
+// isIdempotent reports whether the request is safe to be sent more than once
+func isIdempotent(request *http.Request) bool {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return request.Header.Get(idempotencyKeyHeader) != ""
+}
+
+// bufferBody reads up to maxSize bytes of the request body so that it can be
+// replayed. If the body is larger, the request is left readable from the
+// start and false is returned.
+func bufferBody(request *http.Request, maxSize int64) ([]byte, bool) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, true
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, maxSize+1))
+	if err != nil || int64(len(body)) > maxSize {
+		request.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), request.Body), request.Body}
+		return nil, false
+	}
+	request.Body.Close()
+	return body, true
+}
+
+// serveWithRetries routes the request to routeURL, and to other URLs
+// picked by the load balancing strategy for as long as the attempts fail
+// in a retryable way
+func (e *Engine) serveWithRetries(writer http.ResponseWriter, request *http.Request, routeURL *url.URL) {
+	body, ok := bufferBody(request, e.retry.MaxBodySize)
+	if !ok {
+		e.route(writer, request, routeURL, nil)
+		return
+	}
+
+	tried := make([]*url.URL, 0, e.retry.MaxAttempts)
+	for n := 1; ; n++ {
+		tried = append(tried, routeURL)
+		a := &attempt{
+			retryable:   n < e.retry.MaxAttempts && len(e.untriedURLs(tried)) > 0,
+			statusCodes: e.retry.statusCodes,
+		}
+		failedURL := routeURL
+		a.allowRetry = func() bool {
+			return e.allowRetry(failedURL)
+		}
+
+		attemptRequest := request
+		cancel := func() {}
+		if e.retry.PerTryTimeout > 0 {
+			ctx, cancelContext := context.WithCancel(request.Context())
+			attemptRequest = request.WithContext(ctx)
+			a.timer = time.AfterFunc(e.retry.PerTryTimeout, func() {
+				atomic.StoreInt32(&a.timedOut, 1)
+				cancelContext()
+			})
+			cancel = func() {
+				a.timer.Stop()
+				cancelContext()
+			}
+		}
+		if body != nil {
+			attemptRequest.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		e.route(writer, attemptRequest, routeURL, a)
+		cancel()
+		if !a.retry {
+			return
+		}
+
+		select {
+		case <-request.Context().Done():
+			e.handleError(writer, request, request.Context().Err())
+			return
+		case <-time.After(e.retry.backoff(n)):
+		}
+
+		routeURL = e.getURL(request, tried...)
+		if routeURL == nil {
+			e.handleError(writer, request, a.err)
+			return
+		}
+	}
+}
+
+// retryStatusError describes a response that was discarded to be retried
+func retryStatusError(statusCode int) error {
+	return fmt.Errorf("flashx: upstream responded with status %d", statusCode)
+}
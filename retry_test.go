@@ -0,0 +1,246 @@
+package flashx
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsIdempotent(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header http.Header
+		want   bool
+	}{
+		{name: "GET", method: http.MethodGet, want: true},
+		{name: "HEAD", method: http.MethodHead, want: true},
+		{name: "OPTIONS", method: http.MethodOptions, want: true},
+		{name: "POST", method: http.MethodPost, want: false},
+		{
+			name:   "POST with idempotency key",
+			method: http.MethodPost,
+			header: http.Header{"Idempotency-Key": []string{"abc"}},
+			want:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := &http.Request{Method: tt.method, Header: tt.header}
+			if got := isIdempotent(request); got != tt.want {
+				t.Errorf("isIdempotent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBufferBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		maxSize  int64
+		wantOK   bool
+		wantBody string
+	}{
+		{
+			name:     "body within limit",
+			body:     "hello",
+			maxSize:  5,
+			wantOK:   true,
+			wantBody: "hello",
+		},
+		{
+			name:    "body over limit",
+			body:    "hello world",
+			maxSize: 5,
+			wantOK:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("POST", "http://flashx/", strings.NewReader(tt.body))
+			got, ok := bufferBody(request, tt.maxSize)
+			if ok != tt.wantOK {
+				t.Fatalf("bufferBody() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && string(got) != tt.wantBody {
+				t.Errorf("bufferBody() = %q, want %q", got, tt.wantBody)
+			}
+			if !ok {
+				rest, _ := ioutil.ReadAll(request.Body)
+				if string(rest) != tt.body {
+					t.Errorf("bufferBody() left body %q, want %q", rest, tt.body)
+				}
+			}
+		})
+	}
+}
+
+func TestEngine_retries(t *testing.T) {
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte("echo:" + string(body)))
+	}))
+	defer echo.Close()
+
+	tests := []struct {
+		name       string
+		failing    string
+		retry      Retry
+		method     string
+		header     http.Header
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "dial failure is retried",
+			failing:    refused.URL,
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantBody:   "echo:",
+		},
+		{
+			name:       "retryable status is retried",
+			failing:    unavailable.URL,
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantBody:   "echo:",
+		},
+		{
+			name:       "non idempotent request is not retried",
+			failing:    unavailable.URL,
+			method:     http.MethodPost,
+			body:       "payload",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "idempotency key replays the body",
+			failing:    unavailable.URL,
+			method:     http.MethodPost,
+			header:     http.Header{"Idempotency-Key": []string{"abc"}},
+			body:       "payload",
+			wantStatus: http.StatusOK,
+			wantBody:   "echo:payload",
+		},
+		{
+			name:       "body over the limit is not retried",
+			failing:    unavailable.URL,
+			retry:      Retry{MaxBodySize: 3},
+			method:     http.MethodPost,
+			header:     http.Header{"Idempotency-Key": []string{"abc"}},
+			body:       "payload",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "status not configured as retryable",
+			failing:    unavailable.URL,
+			retry:      Retry{RetryableStatusCodes: []int{http.StatusBadGateway}},
+			method:     http.MethodGet,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "per try timeout is retried",
+			failing:    slow.URL,
+			retry:      Retry{PerTryTimeout: 20 * time.Millisecond},
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantBody:   "echo:",
+		},
+		{
+			name:       "single attempt",
+			failing:    unavailable.URL,
+			retry:      Retry{MaxAttempts: 1},
+			method:     http.MethodGet,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retry := tt.retry
+			retry.Backoff = time.Millisecond
+			e := &Engine{
+				URLs:                  []string{tt.failing, echo.URL},
+				LoadBalancingStrategy: RoundRobin,
+				Retry:                 &retry,
+			}
+			if err := e.Setup(); err != nil {
+				t.Fatalf("Engine.Setup() error = %v", err)
+			}
+			defer e.Close()
+
+			request := httptest.NewRequest(tt.method, "http://flashx/", strings.NewReader(tt.body))
+			for key, values := range tt.header {
+				request.Header[key] = values
+			}
+			w := httptest.NewRecorder()
+			e.Initiate(w, request)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Engine.Initiate() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("Engine.Initiate() body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestEngine_clientCancelled(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	tests := []struct {
+		name         string
+		retry        *Retry
+		wantFailures int64
+	}{
+		{name: "without retries", wantFailures: 0},
+		{name: "with retries", retry: &Retry{}, wantFailures: 0},
+		{name: "per try timeout", retry: &Retry{PerTryTimeout: 10 * time.Millisecond}, wantFailures: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Engine{
+				URLs:         []string{slow.URL},
+				Retry:        tt.retry,
+				ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {},
+			}
+			if err := e.Setup(); err != nil {
+				t.Fatalf("Engine.Setup() error = %v", err)
+			}
+			defer e.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			request := httptest.NewRequest("GET", "http://flashx/", nil).WithContext(ctx)
+			e.Initiate(httptest.NewRecorder(), request)
+
+			status := e.Backends()[0]
+			if status.Failures != tt.wantFailures {
+				t.Errorf("Engine.Backends() failures = %v, want %v", status.Failures, tt.wantFailures)
+			}
+		})
+	}
+}
@@ -0,0 +1,449 @@
+package flashx
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errRouteWithoutEngine = errors.New("Every route needs either an Engine or a Split to route requests to")
+
+// Route describes the requests that are routed to an Engine.
+// A request matches a route if it matches every field that is set
+type Route struct {
+	// Host is the host of the request, without its port
+	// A host starting with "*." matches any subdomain, so *.example.com
+	// matches api.example.com and v1.api.example.com, but not example.com
+	Host string
+
+	// Path is the exact path of the request
+	Path string
+
+	// PathPrefix is the prefix of the path of the request
+	// It matches whole segments, so /api matches /api and /api/users,
+	// but not /apis
+	PathPrefix string
+
+	// PathRegex is a regular expression matching the path of the request
+	// It is not anchored unless it starts with ^ and ends with $
+	// Only one of Path, PathPrefix and PathRegex can be set
+	PathRegex string
+
+	// Methods holds the methods of the request
+	Methods []string
+
+	// Headers holds the headers of the request along with their value
+	// An empty value only requires the header to be present
+	Headers map[string]string
+
+	// Query holds the query parameters of the request along with their value
+	// An empty value only requires the parameter to be present
+	Query map[string]string
+
+	// StripPrefix removes PathPrefix from the path of the
+	// request before it is routed to the Engine
+	StripPrefix bool
+
+	// RewriteRegex is a regular expression replaced by RewriteReplacement
+	// in the path of the request before it is routed to the Engine
+	// If not set while RewriteReplacement is, PathRegex is used
+	RewriteRegex string
+
+	// RewriteReplacement replaces the matches of RewriteRegex, and can
+	// refer to its capture groups, such as $1 or ${name}
+	// The path is rewritten after StripPrefix is applied
+	RewriteReplacement string
+
+	// Engine holds the pool of URLs and the strategy used for the
+	// requests matching the route. Several routes can share an Engine
+	// The path of its URLs is prepended to the rewritten path
+	Engine *Engine
+
+	// Split splits the requests matching the route between several
+	// pools. Only one of Engine and Split can be set
+	Split *Split
+
+	pathRegex *regexp.Regexp
+
+	rewriteRegex *regexp.Regexp
+}
+
+// Router routes every request to the Engine of the most specific route
+// it matches. Routes are ranked by their host first, an exact host
+// before a wildcard and a longer wildcard before a shorter one, then by
+// their path, an exact path before a prefix, a longer prefix before a
+// shorter one and a prefix before a regular expression, and then by
+// the number of methods, headers and query parameters they match on.
+// Routes ranking the same are tried in the order they are listed
+type Router struct {
+	// Routes holds the routes that requests are matched against
+	Routes []*Route
+
+	// NotFound handles the requests that do not match any route
+	// If not set, a 404 Status Not Found response is returned
+	NotFound http.Handler
+
+	// TrustedProxies and ForwardedHeader resolve the client IP of the
+	// requests before they are routed, as they do for an Engine, so
+	// that every Split and Engine of the routes sees the client IP
+	// If not set, the client IP is the IP of the remote address
+	TrustedProxies  []string
+	ForwardedHeader string
+
+	// ErrorLog specifies an optional logger for the config
+	// files rejected by WatchConfig, and for the Engines
+	// of the pools created from a config file.
+	// If nil, logging is done via the log package's standard logger.
+	ErrorLog *log.Logger
+
+	// mu guards the routes, the pools and the client IP resolver
+	// while they are replaced by ApplyConfig
+	mu sync.RWMutex
+
+	// applyMu serializes the calls to ApplyConfig
+	applyMu sync.Mutex
+
+	routes []*Route
+
+	clientIPs *clientIPResolver
+
+	// pools holds the Engines created from a config file by pool name
+	pools map[string]*Engine
+
+	done chan struct{}
+
+	closeOnce sync.Once
+}
+
+// Setup validates the routes and sets up their Engines
+func (r *Router) Setup() error {
+	clientIPs, err := newClientIPResolver(r.TrustedProxies, r.ForwardedHeader)
+	if err != nil {
+		return err
+	}
+	routes, err := setupRoutes(r.Routes)
+	if err != nil {
+		return err
+	}
+	engines := make(map[*Engine]bool)
+	for _, route := range routes {
+		for _, engine := range route.engines() {
+			if !engines[engine] {
+				engines[engine] = true
+				if err := engine.Setup(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	r.mu.Lock()
+	r.routes, r.clientIPs = routes, clientIPs
+	r.mu.Unlock()
+	r.done = make(chan struct{})
+	return nil
+}
+
+// setupRoutes validates the routes, without setting up
+// their Engines, and returns them from the most specific
+func setupRoutes(routes []*Route) ([]*Route, error) {
+	sorted := make([]*Route, 0, len(routes))
+	for index, route := range routes {
+		if err := route.setup(index); err != nil {
+			return nil, err
+		}
+		sorted = append(sorted, route)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].moreSpecific(sorted[j])
+	})
+	return sorted, nil
+}
+
+// Close closes the Engines of the routes and of the pools,
+// and stops WatchConfig
+func (r *Router) Close() error {
+	r.closeOnce.Do(func() {
+		if r.done != nil {
+			close(r.done)
+		}
+	})
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, route := range r.routes {
+		for _, engine := range route.engines() {
+			engine.Close()
+		}
+	}
+	for _, engine := range r.pools {
+		engine.Close()
+	}
+	return nil
+}
+
+// ServeHTTP routes the request to the Engine of the most specific
+// route it matches
+func (r *Router) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	r.mu.RLock()
+	clientIPs := r.clientIPs
+	r.mu.RUnlock()
+	request = clientIPs.withClientIP(request)
+	route := r.Match(request)
+	if route == nil {
+		if r.NotFound != nil {
+			r.NotFound.ServeHTTP(writer, request)
+		} else {
+			http.NotFound(writer, request)
+		}
+		return
+	}
+	if route.Split != nil {
+		route.Split.ServeHTTP(writer, route.rewrite(request))
+		return
+	}
+	route.Engine.Initiate(writer, route.rewrite(request))
+}
+
+// Match returns the most specific route the request matches,
+// or nil if it does not match any route
+func (r *Router) Match(request *http.Request) *Route {
+	host := requestHost(request)
+	r.mu.RLock()
+	routes := r.routes
+	r.mu.RUnlock()
+	for _, route := range routes {
+		if route.match(request, host) {
+			return route
+		}
+	}
+	return nil
+}
+
+func (route *Route) setup(index int) error {
+	if (route.Engine == nil) == (route.Split == nil) {
+		return errRouteWithoutEngine
+	}
+	if route.Split != nil {
+		if err := route.Split.setup(); err != nil {
+			return err
+		}
+	}
+	paths := 0
+	for _, path := range []string{route.Path, route.PathPrefix, route.PathRegex} {
+		if path != "" {
+			paths++
+		}
+	}
+	if paths > 1 {
+		return fmt.Errorf("flashx: route %d can only set one of Path, PathPrefix and PathRegex", index)
+	}
+	if route.PathRegex != "" {
+		pathRegex, err := regexp.Compile(route.PathRegex)
+		if err != nil {
+			return err
+		}
+		route.pathRegex = pathRegex
+	}
+	switch {
+	case route.RewriteRegex != "":
+		rewriteRegex, err := regexp.Compile(route.RewriteRegex)
+		if err != nil {
+			return err
+		}
+		route.rewriteRegex = rewriteRegex
+	case route.RewriteReplacement != "":
+		if route.pathRegex == nil {
+			return fmt.Errorf("flashx: route %d needs RewriteRegex or PathRegex to rewrite its path", index)
+		}
+		route.rewriteRegex = route.pathRegex
+	}
+	if route.StripPrefix && route.PathPrefix == "" {
+		return fmt.Errorf("flashx: route %d needs PathPrefix to strip it", index)
+	}
+	if strings.HasPrefix(route.Host, "*") && !strings.HasPrefix(route.Host, "*.") {
+		return fmt.Errorf("flashx: route %d has an invalid wildcard host %q", index, route.Host)
+	}
+	return nil
+}
+
+// engines returns the Engines the route sends requests to
+func (route *Route) engines() []*Engine {
+	if route.Split != nil {
+		return route.Split.engines()
+	}
+	return []*Engine{route.Engine}
+}
+
+// rewrite returns a shallow copy of the request with its path
+// rewritten, or the request itself if the route does not rewrite it
+func (route *Route) rewrite(request *http.Request) *http.Request {
+	if !route.StripPrefix && route.rewriteRegex == nil {
+		return request
+	}
+	rewritten := new(http.Request)
+	*rewritten = *request
+	rewritten.URL = new(url.URL)
+	*rewritten.URL = *request.URL
+
+	if route.StripPrefix {
+		prefix := strings.TrimSuffix(route.PathPrefix, "/")
+		rewritten.URL.Path = strings.TrimPrefix(rewritten.URL.Path, prefix)
+		rewritten.URL.RawPath = strings.TrimPrefix(rewritten.URL.RawPath, prefix)
+	}
+	if route.rewriteRegex != nil {
+		rewritten.URL.Path = route.rewriteRegex.ReplaceAllString(rewritten.URL.Path, route.RewriteReplacement)
+		rewritten.URL.RawPath = ""
+	}
+	if !strings.HasPrefix(rewritten.URL.Path, "/") {
+		rewritten.URL.Path = "/" + rewritten.URL.Path
+		if rewritten.URL.RawPath != "" {
+			rewritten.URL.RawPath = "/" + rewritten.URL.RawPath
+		}
+	}
+	return rewritten
+}
+
+func (r *Router) logf(format string, args ...interface{}) {
+	if r.ErrorLog != nil {
+		r.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// requestHost returns the host of the request, without its port
+func requestHost(request *http.Request) string {
+	host := request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func (route *Route) match(request *http.Request, host string) bool {
+	return route.matchHost(host) &&
+		route.matchPath(request.URL.Path) &&
+		route.matchMethod(request.Method) &&
+		matchValues(route.Headers, func(key string) ([]string, bool) {
+			values, ok := request.Header[http.CanonicalHeaderKey(key)]
+			return values, ok
+		}) &&
+		matchValues(route.Query, func(key string) ([]string, bool) {
+			values, ok := request.URL.Query()[key]
+			return values, ok
+		})
+}
+
+func (route *Route) matchHost(host string) bool {
+	switch {
+	case route.Host == "":
+		return true
+	case strings.HasPrefix(route.Host, "*."):
+		return strings.HasSuffix(host, strings.ToLower(route.Host[1:]))
+	default:
+		return host == strings.ToLower(route.Host)
+	}
+}
+
+func (route *Route) matchPath(path string) bool {
+	switch {
+	case route.Path != "":
+		return path == route.Path
+	case route.PathPrefix != "":
+		prefix := strings.TrimSuffix(route.PathPrefix, "/")
+		return path == prefix || strings.HasPrefix(path, prefix+"/")
+	case route.pathRegex != nil:
+		return route.pathRegex.MatchString(path)
+	}
+	return true
+}
+
+func (route *Route) matchMethod(method string) bool {
+	if len(route.Methods) == 0 {
+		return true
+	}
+	for _, m := range route.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchValues reports whether every key of want is present with
+// its value among the values returned by lookup
+func matchValues(want map[string]string, lookup func(key string) ([]string, bool)) bool {
+	for key, value := range want {
+		values, ok := lookup(key)
+		if !ok {
+			return false
+		}
+		if value == "" {
+			continue
+		}
+		found := false
+		for _, v := range values {
+			if v == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// hostRank ranks an exact host before a wildcard, and
+// a longer wildcard before a shorter one
+func (route *Route) hostRank() (int, int) {
+	switch {
+	case route.Host == "":
+		return 0, 0
+	case strings.HasPrefix(route.Host, "*."):
+		return 1, len(route.Host)
+	default:
+		return 2, 0
+	}
+}
+
+// pathRank ranks an exact path before a prefix, a longer prefix
+// before a shorter one, and a prefix before a regular expression
+func (route *Route) pathRank() (int, int) {
+	switch {
+	case route.Path != "":
+		return 3, 0
+	case route.PathPrefix != "":
+		return 2, len(strings.TrimSuffix(route.PathPrefix, "/"))
+	case route.PathRegex != "":
+		return 1, 0
+	}
+	return 0, 0
+}
+
+// moreSpecific reports whether route ranks before other
+func (route *Route) moreSpecific(other *Route) bool {
+	ranks := func(r *Route) []int {
+		hostKind, hostLength := r.hostRank()
+		pathKind, pathLength := r.pathRank()
+		methods := 0
+		if len(r.Methods) > 0 {
+			methods = 1
+		}
+		return []int{hostKind, hostLength, pathKind, pathLength, methods + len(r.Headers) + len(r.Query)}
+	}
+	a, b := ranks(route), ranks(other)
+	for index := range a {
+		if a[index] != b[index] {
+			return a[index] > b[index]
+		}
+	}
+	return false
+}
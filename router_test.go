@@ -0,0 +1,197 @@
+package flashx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouter_Match(t *testing.T) {
+	routes := map[string]*Route{
+		"any":            {},
+		"host":           {Host: "api.example.com"},
+		"wildcard":       {Host: "*.example.com"},
+		"deep wildcard":  {Host: "*.api.example.com"},
+		"prefix":         {PathPrefix: "/users"},
+		"longer prefix":  {PathPrefix: "/users/admin/"},
+		"exact path":     {Path: "/users/me"},
+		"regex":          {PathRegex: `^/items/[0-9]+$`},
+		"method":         {PathPrefix: "/users", Methods: []string{"post"}},
+		"header":         {PathPrefix: "/users", Headers: map[string]string{"X-Version": "2"}},
+		"header present": {PathPrefix: "/users", Headers: map[string]string{"X-Debug": ""}},
+		"query":          {PathRegex: `^/items/`, Query: map[string]string{"beta": "true"}},
+	}
+	router := &Router{}
+	names := make(map[*Route]string)
+	engine := &Engine{URLs: []string{"http://localhost:3000"}}
+	for name, route := range routes {
+		route.Engine = engine
+		router.Routes = append(router.Routes, route)
+		names[route] = name
+	}
+	if err := router.Setup(); err != nil {
+		t.Fatalf("Router.Setup() error = %v", err)
+	}
+	defer router.Close()
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		headers map[string]string
+		want    string
+	}{
+		{name: "no match falls back", method: "GET", target: "http://localhost/", want: "any"},
+		{name: "exact host beats path", method: "GET", target: "http://api.example.com:8080/users/me", want: "host"},
+		{name: "longer wildcard", method: "GET", target: "http://v1.api.example.com/", want: "deep wildcard"},
+		{name: "wildcard", method: "GET", target: "http://www.example.com/", want: "wildcard"},
+		{name: "wildcard skips apex", method: "GET", target: "http://example.com/", want: "any"},
+		{name: "exact path", method: "GET", target: "http://localhost/users/me", want: "exact path"},
+		{name: "longer prefix", method: "GET", target: "http://localhost/users/admin/1", want: "longer prefix"},
+		{name: "prefix matches whole segments", method: "GET", target: "http://localhost/usersx", want: "any"},
+		{name: "prefix", method: "GET", target: "http://localhost/users", want: "prefix"},
+		{name: "method", method: "POST", target: "http://localhost/users/1", want: "method"},
+		{name: "header", method: "GET", target: "http://localhost/users/1", headers: map[string]string{"x-version": "2"}, want: "header"},
+		{name: "header value mismatch", method: "GET", target: "http://localhost/users/1", headers: map[string]string{"X-Version": "3"}, want: "prefix"},
+		{name: "header present", method: "GET", target: "http://localhost/users/1", headers: map[string]string{"X-Debug": "1"}, want: "header present"},
+		{name: "regex", method: "GET", target: "http://localhost/items/42", want: "regex"},
+		{name: "regex mismatch", method: "GET", target: "http://localhost/items/abc", want: "any"},
+		{name: "query", method: "GET", target: "http://localhost/items/abc?beta=true", want: "query"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.target, nil)
+			for key, value := range tt.headers {
+				request.Header.Set(key, value)
+			}
+			if got := names[router.Match(request)]; got != tt.want {
+				t.Errorf("Router.Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouter_Setup(t *testing.T) {
+	engine := &Engine{URLs: []string{"http://localhost:3000"}}
+	tests := []struct {
+		name  string
+		route *Route
+	}{
+		{name: "no Engine", route: &Route{Path: "/"}},
+		{name: "Engine and Split", route: &Route{Path: "/", Engine: engine, Split: &Split{Pools: []*SplitPool{{Name: "stable", Engine: engine}}}}},
+		{name: "several paths", route: &Route{Path: "/", PathPrefix: "/api", Engine: engine}},
+		{name: "invalid regex", route: &Route{PathRegex: "(", Engine: engine}},
+		{name: "invalid wildcard", route: &Route{Host: "*example.com", Engine: engine}},
+		{name: "strip without a prefix", route: &Route{Path: "/api", StripPrefix: true, Engine: engine}},
+		{name: "rewrite without a regex", route: &Route{RewriteReplacement: "/v2", Engine: engine}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := &Router{Routes: []*Route{tt.route}}
+			if err := router.Setup(); err == nil {
+				router.Close()
+				t.Error("Router.Setup() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestRouter_ServeHTTP(t *testing.T) {
+	users := newTestBackend("users")
+	defer users.Close()
+	orders := newTestBackend("orders")
+	defer orders.Close()
+
+	router := &Router{
+		Routes: []*Route{
+			{PathPrefix: "/users", Engine: &Engine{URLs: []string{users.URL}}},
+			{PathPrefix: "/orders", Engine: &Engine{URLs: []string{orders.URL}, LoadBalancingStrategy: RoundRobin}},
+		},
+	}
+	if err := router.Setup(); err != nil {
+		t.Fatalf("Router.Setup() error = %v", err)
+	}
+	defer router.Close()
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "users", target: "http://flashx/users/1", wantStatus: http.StatusOK, wantBody: "users"},
+		{name: "orders", target: "http://flashx/orders", wantStatus: http.StatusOK, wantBody: "orders"},
+		{name: "not found", target: "http://flashx/carts", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", tt.target, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("Router.ServeHTTP() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("Router.ServeHTTP() body = %v, want %v", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestRoute_rewrite(t *testing.T) {
+	engine := &Engine{URLs: []string{"http://localhost:3000"}}
+	tests := []struct {
+		name   string
+		route  *Route
+		target string
+		want   string
+	}{
+		{name: "untouched", route: &Route{PathPrefix: "/api"}, target: "/api/users", want: "/api/users"},
+		{name: "strip prefix", route: &Route{PathPrefix: "/api/", StripPrefix: true}, target: "/api/users?page=2", want: "/users?page=2"},
+		{name: "strip the whole path", route: &Route{PathPrefix: "/api", StripPrefix: true}, target: "/api", want: "/"},
+		{name: "capture groups", route: &Route{PathRegex: `^/users/([0-9]+)$`, RewriteReplacement: "/v2/users/$1"}, target: "/users/42", want: "/v2/users/42"},
+		{
+			name:   "strip then rewrite",
+			route:  &Route{PathPrefix: "/api", StripPrefix: true, RewriteRegex: `^/(?P<name>[a-z]+)`, RewriteReplacement: "/${name}/v1"},
+			target: "/api/items/3",
+			want:   "/items/v1/3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.route.Engine = engine
+			if err := tt.route.setup(0); err != nil {
+				t.Fatalf("Route.setup() error = %v", err)
+			}
+			request := httptest.NewRequest("GET", tt.target, nil)
+			if got := tt.route.rewrite(request).URL.RequestURI(); got != tt.want {
+				t.Errorf("Route.rewrite() = %v, want %v", got, tt.want)
+			}
+			if got := request.URL.RequestURI(); got != tt.target {
+				t.Errorf("Route.rewrite() changed the request to %v", got)
+			}
+		})
+	}
+}
+
+func TestRouter_ServeHTTP_rewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+
+	router := &Router{
+		Routes: []*Route{
+			{PathPrefix: "/users", StripPrefix: true, Engine: &Engine{URLs: []string{backend.URL + "/api"}}},
+		},
+	}
+	if err := router.Setup(); err != nil {
+		t.Fatalf("Router.Setup() error = %v", err)
+	}
+	defer router.Close()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "http://flashx/users/42?full=1", nil))
+	if want := "/api/42?full=1"; w.Body.String() != want {
+		t.Errorf("Router.ServeHTTP() routed to %v, want %v", w.Body.String(), want)
+	}
+}
@@ -0,0 +1,209 @@
+package flashx
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errConfigWithRoutes = errors.New("flashx: a config with pools or routes needs to be applied to a Router")
+
+// RouteConfig describes a route in a config file.
+// Its fields match the ones of Route
+type RouteConfig struct {
+	Host               string            `yaml:"host"`
+	Path               string            `yaml:"path"`
+	PathPrefix         string            `yaml:"path_prefix"`
+	PathRegex          string            `yaml:"path_regex"`
+	Methods            []string          `yaml:"methods"`
+	Headers            map[string]string `yaml:"headers"`
+	Query              map[string]string `yaml:"query"`
+	StripPrefix        bool              `yaml:"strip_prefix"`
+	RewriteRegex       string            `yaml:"rewrite_regex"`
+	RewriteReplacement string            `yaml:"rewrite_replacement"`
+
+	// Pool is the name of the pool the requests
+	// matching the route are routed to
+	// If not set, the top level URLs are used
+	Pool string `yaml:"pool"`
+}
+
+func (r *RouteConfig) route(engine *Engine) *Route {
+	return &Route{
+		Host:               r.Host,
+		Path:               r.Path,
+		PathPrefix:         r.PathPrefix,
+		PathRegex:          r.PathRegex,
+		Methods:            r.Methods,
+		Headers:            r.Headers,
+		Query:              r.Query,
+		StripPrefix:        r.StripPrefix,
+		RewriteRegex:       r.RewriteRegex,
+		RewriteReplacement: r.RewriteReplacement,
+		Engine:             engine,
+	}
+}
+
+func (c *Config) hasRoutes() bool {
+	return len(c.Pools) > 0 || len(c.Routes) > 0
+}
+
+func (c *Config) validateRoutes() error {
+	for name, pool := range c.Pools {
+		if name == "" {
+			return errors.New("flashx: every pool needs a name")
+		}
+		if pool == nil || len(pool.URLs) == 0 {
+			return fmt.Errorf("flashx: pool %q needs URLs", name)
+		}
+		if pool.hasRoutes() {
+			return fmt.Errorf("flashx: pool %q cannot have pools or routes", name)
+		}
+		if err := pool.validate(); err != nil {
+			return fmt.Errorf("flashx: pool %q: %v", name, err)
+		}
+	}
+	for index := range c.Routes {
+		route := &c.Routes[index]
+		switch {
+		case route.Pool == "" && len(c.URLs) == 0:
+			return fmt.Errorf("flashx: route %d needs a pool, as there are no top level URLs", index)
+		case route.Pool != "" && c.Pools[route.Pool] == nil:
+			return fmt.Errorf("%v: %q is the pool of route %d", ErrUnknownPool, route.Pool, index)
+		}
+		if err := route.route(&Engine{}).setup(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// engineConfig returns the config of the Engine of the top level URLs
+func (c *Config) engineConfig() *Config {
+	config := *c
+	config.Pools, config.Routes = nil, nil
+	return &config
+}
+
+// poolConfigs returns the config of every pool by name,
+// the top level URLs being the pool without a name
+func (c *Config) poolConfigs() map[string]*Config {
+	configs := make(map[string]*Config, len(c.Pools)+1)
+	for name, pool := range c.Pools {
+		configs[name] = pool
+	}
+	if len(c.URLs) > 0 {
+		configs[""] = c.engineConfig()
+	}
+	return configs
+}
+
+// routes returns the routes of the config along with the route
+// of the top level URLs, which matches every request
+func (c *Config) routes(pools map[string]*Engine) []*Route {
+	routes := make([]*Route, 0, len(c.Routes)+1)
+	for index := range c.Routes {
+		routes = append(routes, c.Routes[index].route(pools[c.Routes[index].Pool]))
+	}
+	if engine, ok := pools[""]; ok {
+		routes = append(routes, &Route{Engine: engine})
+	}
+	return routes
+}
+
+// ConfigureRouter fills the routes of a Router from the config, along
+// with an Engine for the top level URLs and for each pool.
+// Call it before Setup, and use ApplyConfig for a
+// Router that is already serving requests
+func (c *Config) ConfigureRouter(r *Router) {
+	pools := make(map[string]*Engine)
+	for name, config := range c.poolConfigs() {
+		engine := &Engine{ErrorLog: r.ErrorLog}
+		config.Configure(engine)
+		pools[name] = engine
+	}
+	r.Routes = c.routes(pools)
+	r.TrustedProxies = c.TrustedProxies
+	r.ForwardedHeader = c.ForwardedHeader
+	r.pools = pools
+}
+
+// ApplyConfig applies the config to a Router that is serving requests,
+// once ConfigureRouter has filled it. The Engines of the pools that are
+// still listed are changed as Engine.ApplyConfig does, the Engines of
+// the new pools are set up, and the routes are then replaced at once.
+// The Engines of the pools that are no longer listed are then closed,
+// which stops their background work while the requests in flight to
+// them complete. If an Engine cannot be set up, nothing is changed
+func (r *Router) ApplyConfig(config *Config) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+
+	r.mu.RLock()
+	current := r.pools
+	r.mu.RUnlock()
+
+	pools := make(map[string]*Engine)
+	var created []*Engine
+	discard := func(err error) error {
+		for _, engine := range created {
+			engine.Close()
+		}
+		return err
+	}
+	configs := config.poolConfigs()
+	for name, poolConfig := range configs {
+		if engine, ok := current[name]; ok {
+			pools[name] = engine
+			continue
+		}
+		engine := &Engine{ErrorLog: r.ErrorLog}
+		poolConfig.Configure(engine)
+		if err := engine.Setup(); err != nil {
+			return discard(err)
+		}
+		created = append(created, engine)
+		pools[name] = engine
+	}
+	routes := config.routes(pools)
+	sorted, err := setupRoutes(routes)
+	if err != nil {
+		return discard(err)
+	}
+	clientIPs, err := newClientIPResolver(config.TrustedProxies, config.ForwardedHeader)
+	if err != nil {
+		return discard(err)
+	}
+	for name, engine := range current {
+		if pools[name] == engine {
+			if err := engine.ApplyConfig(configs[name]); err != nil {
+				return discard(err)
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.Routes, r.routes, r.pools = routes, sorted, pools
+	r.TrustedProxies, r.ForwardedHeader, r.clientIPs = config.TrustedProxies, config.ForwardedHeader, clientIPs
+	r.mu.Unlock()
+
+	for name, engine := range current {
+		if pools[name] != engine {
+			engine.Close()
+		}
+	}
+	return nil
+}
+
+// WatchConfig polls the config file every interval and applies it to
+// the Router whenever its content changes, until the Router is closed.
+// A file that cannot be read or fails validation is logged and
+// rejected, and the config that was applied last stays active.
+// If interval is not set, a default value will be picked up.
+// It returns an error if the Router has not been set up
+func (r *Router) WatchConfig(path string, interval time.Duration) error {
+	return watchConfig(path, interval, r.done, r.logf, r.ApplyConfig)
+}
@@ -0,0 +1,223 @@
+package flashx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfig_validateRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{
+			name: "routes",
+			data: `
+urls: [http://localhost:3000]
+pools:
+  api: {strategy: round_robin, urls: [http://localhost:4000, http://localhost:4001]}
+routes:
+  - {host: api.example.com, path_prefix: /v1, strip_prefix: true, methods: [GET], pool: api}
+  - {path_regex: "^/users/(\\d+)$", rewrite_replacement: /accounts/$1, headers: {X-Env: prod}, query: {debug: ""}}
+`,
+		},
+		{
+			name:    "unknown pool",
+			data:    "pools: {api: {urls: [http://localhost:4000]}}\nroutes: [{path: /, pool: web}]",
+			wantErr: true,
+		},
+		{
+			name:    "route without a pool or top level URLs",
+			data:    "routes: [{path: /}]",
+			wantErr: true,
+		},
+		{
+			name:    "pool without URLs",
+			data:    "pools: {api: {strategy: round_robin}}",
+			wantErr: true,
+		},
+		{
+			name:    "invalid pool",
+			data:    "pools: {api: {urls: [localhost]}}",
+			wantErr: true,
+		},
+		{
+			name:    "nested routes",
+			data:    "pools: {api: {urls: [http://localhost:4000], routes: [{path: /}]}}",
+			wantErr: true,
+		},
+		{
+			name:    "invalid route",
+			data:    "urls: [http://localhost:3000]\nroutes: [{path: /, path_prefix: /api}]",
+			wantErr: true,
+		},
+		{
+			name:    "invalid path regex",
+			data:    "urls: [http://localhost:3000]\nroutes: [{path_regex: \"(\"}]",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseConfig([]byte(tt.data)); (err != nil) != tt.wantErr {
+				t.Errorf("parseConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRouter_ApplyConfig(t *testing.T) {
+	web := newTestBackend("web")
+	defer web.Close()
+	api := newTestBackend("api")
+	defer api.Close()
+	admin := newTestBackend("admin")
+	defer admin.Close()
+
+	config, err := parseConfig([]byte(fmt.Sprintf(`
+urls: [%s]
+pools:
+  api: {urls: [%s]}
+routes:
+  - {path_prefix: /api, pool: api}
+`, web.URL, api.URL)))
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	router := &Router{}
+	config.ConfigureRouter(router)
+	if err := router.Setup(); err != nil {
+		t.Fatalf("Router.Setup() error = %v", err)
+	}
+	defer router.Close()
+
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "http://flashx"+path, nil))
+		return w.Body.String()
+	}
+	if got := get("/api/users"); got != "api" {
+		t.Errorf("Router.ServeHTTP() /api/users = %v, want api", got)
+	}
+	if got := get("/home"); got != "web" {
+		t.Errorf("Router.ServeHTTP() /home = %v, want web", got)
+	}
+	apiEngine := router.pools["api"]
+
+	// a pool is added, and the route of the top level URLs is removed
+	config, err = parseConfig([]byte(fmt.Sprintf(`
+pools:
+  api: {urls: [%s]}
+  admin: {urls: [%s]}
+routes:
+  - {path_prefix: /api, pool: api}
+  - {path_prefix: /admin, pool: admin}
+`, api.URL, admin.URL)))
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	if err := router.ApplyConfig(config); err != nil {
+		t.Fatalf("Router.ApplyConfig() error = %v", err)
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/api/users", want: "api"},
+		{path: "/admin", want: "admin"},
+		{path: "/home", want: "404 page not found\n"},
+	}
+	for _, tt := range tests {
+		if got := get(tt.path); got != tt.want {
+			t.Errorf("Router.ServeHTTP() %v = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+	if router.pools["api"] != apiEngine {
+		t.Error("Router.ApplyConfig() replaced the Engine of a pool that is still listed")
+	}
+
+	// a config with an invalid pool is rejected as a whole
+	config, err = parseConfig([]byte(fmt.Sprintf(`
+pools:
+  api: {urls: [%s]}
+  broken: {urls: [%s]}
+routes:
+  - {path_prefix: /api, pool: broken}
+`, api.URL, admin.URL)))
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	config.Pools["broken"].URLs[0].URL = "dns+http://"
+	if err := router.ApplyConfig(config); err == nil {
+		t.Error("Router.ApplyConfig() error = nil for an invalid pool, want an error")
+	}
+	if got := get("/admin"); got != "admin" {
+		t.Errorf("Router.ServeHTTP() /admin = %q after a rejected config, want admin", got)
+	}
+}
+
+func TestEngine_ApplyConfig_routes(t *testing.T) {
+	e := &Engine{URLs: []string{"http://localhost:3000"}}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+	defer e.Close()
+
+	config, err := parseConfig([]byte("urls: [http://localhost:3000]\nroutes: [{path: /api}]"))
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	if err := e.ApplyConfig(config); err != errConfigWithRoutes {
+		t.Errorf("Engine.ApplyConfig() error = %v, want %v", err, errConfigWithRoutes)
+	}
+}
+
+func TestRouter_WatchConfig(t *testing.T) {
+	web := newTestBackend("web")
+	defer web.Close()
+	api := newTestBackend("api")
+	defer api.Close()
+
+	dir, err := ioutil.TempDir("", "flashx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flashx.yaml")
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(fmt.Sprintf("urls: [%s]", web.URL))
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	router := &Router{}
+	config.ConfigureRouter(router)
+	if err := router.WatchConfig(path, 5*time.Millisecond); err != errWatchBeforeSetup {
+		t.Fatalf("Router.WatchConfig() error = %v before Setup, want %v", err, errWatchBeforeSetup)
+	}
+	if err := router.Setup(); err != nil {
+		t.Fatalf("Router.Setup() error = %v", err)
+	}
+	defer router.Close()
+	if err := router.WatchConfig(path, 5*time.Millisecond); err != nil {
+		t.Fatalf("Router.WatchConfig() error = %v", err)
+	}
+
+	write(fmt.Sprintf("urls: [%s]\npools: {api: {urls: [%s]}}\nroutes: [{path_prefix: /api, pool: api}]", web.URL, api.URL))
+	waitFor(t, func() bool {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "http://flashx/api", nil))
+		return w.Body.String() == "api"
+	})
+}
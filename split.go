@@ -0,0 +1,239 @@
+package flashx
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net/http"
+	"sync"
+)
+
+// splitBuckets is the number of buckets the keys are spread over,
+// which sets the precision of the weights of a Split to 0.01%
+const splitBuckets = 10000
+
+var (
+	// ErrUnknownPool is returned when changing a pool that is not in a Split
+	ErrUnknownPool = errors.New("flashx: unknown pool")
+
+	errNegativePoolWeight = errors.New("Weights specified for the pools cannot be negative")
+)
+
+// SplitPool is a named pool of URLs that a Split sends traffic to
+type SplitPool struct {
+	// Name identifies the pool, such as "stable" or "canary"
+	Name string
+
+	// Weight is the share of the traffic sent to the pool, relative
+	// to the weights of the other pools, so weights of 95 and 5
+	// send 95% of the traffic to the first pool and 5% to the second
+	Weight int
+
+	// Engine holds the URLs of the pool and their strategy
+	Engine *Engine
+}
+
+// Split splits the traffic between named pools by weight, for
+// example to send 5% of the traffic to a canary release.
+// Requests are spread by hashing the key returned by HashKey, so a
+// user keeps being routed to the same pool while the weights do not
+// change. With two pools, raising the weight of one of them only moves
+// users to it.
+// Split is an http.Handler, and can be the target of a Route
+type Split struct {
+	// Pools holds the pools the traffic is split between
+	Pools []*SplitPool
+
+	// HashKey returns the key that keeps a user on the same pool,
+	// such as HashByCookie or HashByHeader
+	// If not set, the client IP will be used
+	// Requests with an empty key are spread at random
+	HashKey func(*http.Request) string
+
+	// TrustedProxies and ForwardedHeader resolve the client IP
+	// before the pool is picked, as they do for an Engine, so that
+	// the users behind a load balancer are not all hashed alike
+	// If not set, the client IP resolved by the Router is used,
+	// if any, or else the IP of the remote address
+	TrustedProxies  []string
+	ForwardedHeader string
+
+	// OverrideHeader holds the name of a header forcing the pool of a
+	// request, such as X-Canary. Its value is either the name of a pool
+	// or a key of Overrides
+	OverrideHeader string
+
+	// Overrides maps values of OverrideHeader to the name of a pool,
+	// for example "always" to "canary" and "never" to "stable"
+	Overrides map[string]string
+
+	clientIPs *clientIPResolver
+
+	mu sync.RWMutex
+
+	// weights holds the weights of the pools by index,
+	// it is replaced whenever a weight changes
+	weights []int
+}
+
+// Setup validates the pools and sets up their Engines
+func (s *Split) Setup() error {
+	if err := s.setup(); err != nil {
+		return err
+	}
+	for _, engine := range s.engines() {
+		if err := engine.Setup(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the Engines of the pools
+func (s *Split) Close() error {
+	for _, engine := range s.engines() {
+		engine.Close()
+	}
+	return nil
+}
+
+// engines returns the distinct Engines of the pools
+func (s *Split) engines() []*Engine {
+	var engines []*Engine
+	seen := make(map[*Engine]bool)
+	for _, pool := range s.Pools {
+		if !seen[pool.Engine] {
+			seen[pool.Engine] = true
+			engines = append(engines, pool.Engine)
+		}
+	}
+	return engines
+}
+
+// setup validates the pools without setting up their Engines
+func (s *Split) setup() error {
+	if len(s.Pools) == 0 {
+		return errors.New("A split needs at least one pool")
+	}
+	names := make(map[string]bool)
+	weights := make([]int, 0, len(s.Pools))
+	for _, pool := range s.Pools {
+		if pool.Engine == nil {
+			return fmt.Errorf("flashx: pool %q needs an Engine", pool.Name)
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("flashx: pool %q is listed more than once", pool.Name)
+		}
+		names[pool.Name] = true
+		if pool.Weight < 0 {
+			return errNegativePoolWeight
+		}
+		weights = append(weights, pool.Weight)
+	}
+	for value, name := range s.Overrides {
+		if !names[name] {
+			return fmt.Errorf("%v: %q is the override of %q", ErrUnknownPool, name, value)
+		}
+	}
+	if s.HashKey == nil {
+		s.HashKey = HashByClientIP
+	}
+	clientIPs, err := newClientIPResolver(s.TrustedProxies, s.ForwardedHeader)
+	if err != nil {
+		return err
+	}
+	s.clientIPs = clientIPs
+	s.mu.Lock()
+	s.weights = weights
+	s.mu.Unlock()
+	return nil
+}
+
+// SetWeight changes the weight of a pool while the Split is serving requests
+func (s *Split) SetWeight(name string, weight int) error {
+	if weight < 0 {
+		return errNegativePoolWeight
+	}
+	index := s.poolIndex(name)
+	if index < 0 {
+		return ErrUnknownPool
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	weights := make([]int, len(s.weights))
+	copy(weights, s.weights)
+	weights[index] = weight
+	s.weights = weights
+	return nil
+}
+
+// Weights returns the weight of every pool by name
+func (s *Split) Weights() map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	weights := make(map[string]int, len(s.weights))
+	for index, weight := range s.weights {
+		weights[s.Pools[index].Name] = weight
+	}
+	return weights
+}
+
+func (s *Split) poolIndex(name string) int {
+	for index, pool := range s.Pools {
+		if pool.Name == name {
+			return index
+		}
+	}
+	return -1
+}
+
+// ServeHTTP routes the request to the Engine of the pool it falls in
+func (s *Split) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	request = s.clientIPs.withClientIP(request)
+	s.Pick(request).Engine.Initiate(writer, request)
+}
+
+// Pick returns the pool the request falls in.
+// Unlike ServeHTTP, it does not resolve the client IP
+func (s *Split) Pick(request *http.Request) *SplitPool {
+	if s.OverrideHeader != "" {
+		if value := request.Header.Get(s.OverrideHeader); value != "" {
+			name, ok := s.Overrides[value]
+			if !ok {
+				name = value
+			}
+			if index := s.poolIndex(name); index >= 0 {
+				return s.Pools[index]
+			}
+		}
+	}
+
+	s.mu.RLock()
+	weights := s.weights
+	s.mu.RUnlock()
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	if total == 0 {
+		return s.Pools[0]
+	}
+
+	var bucket int
+	if key := s.HashKey(request); key != "" {
+		bucket = int(crc32.ChecksumIEEE([]byte(key)) % splitBuckets)
+	} else {
+		bucket = rand.Intn(splitBuckets)
+	}
+	// the pools own consecutive ranges of buckets, so a change of
+	// weight only moves the buckets at the edges of the ranges
+	point := bucket * total / splitBuckets
+	for index, weight := range weights {
+		if point < weight {
+			return s.Pools[index]
+		}
+		point -= weight
+	}
+	return s.Pools[len(s.Pools)-1]
+}
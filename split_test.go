@@ -0,0 +1,207 @@
+package flashx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func newTestSplit(t *testing.T, stableWeight, canaryWeight int) *Split {
+	s := &Split{
+		Pools: []*SplitPool{
+			{Name: "stable", Weight: stableWeight, Engine: &Engine{URLs: []string{"http://localhost:3000"}}},
+			{Name: "canary", Weight: canaryWeight, Engine: &Engine{URLs: []string{"http://localhost:4000"}}},
+		},
+		HashKey:        HashByHeader("X-User"),
+		OverrideHeader: "X-Canary",
+		Overrides:      map[string]string{"always": "canary", "never": "stable"},
+	}
+	if err := s.setup(); err != nil {
+		t.Fatalf("Split.setup() error = %v", err)
+	}
+	return s
+}
+
+// canaryShare returns the share of n users that fall in the canary pool
+func canaryShare(s *Split, n int) float64 {
+	canary := 0
+	for i := 0; i < n; i++ {
+		request := httptest.NewRequest("GET", "http://flashx/", nil)
+		request.Header.Set("X-User", strconv.Itoa(i))
+		if s.Pick(request).Name == "canary" {
+			canary++
+		}
+	}
+	return float64(canary) / float64(n)
+}
+
+func TestSplit_Pick(t *testing.T) {
+	s := newTestSplit(t, 95, 5)
+	if got := canaryShare(s, 10000); got < 0.04 || got > 0.06 {
+		t.Errorf("Split.Pick() sent %.3f of the users to the canary, want about 0.05", got)
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		override string
+		want     string
+	}{
+		{name: "override", user: "1", override: "always", want: "canary"},
+		{name: "override to the other pool", user: "1", override: "never", want: "stable"},
+		{name: "pool name", user: "1", override: "canary", want: "canary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "http://flashx/", nil)
+			request.Header.Set("X-User", tt.user)
+			request.Header.Set("X-Canary", tt.override)
+			if got := s.Pick(request).Name; got != tt.want {
+				t.Errorf("Split.Pick() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplit_SetWeight(t *testing.T) {
+	s := newTestSplit(t, 95, 5)
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		request := httptest.NewRequest("GET", "http://flashx/", nil)
+		request.Header.Set("X-User", strconv.Itoa(i))
+		before[strconv.Itoa(i)] = s.Pick(request).Name
+	}
+
+	if err := s.SetWeight("canary", 20); err != nil {
+		t.Fatalf("Split.SetWeight() error = %v", err)
+	}
+	// the users of the canary stay on it
+	for user, pool := range before {
+		request := httptest.NewRequest("GET", "http://flashx/", nil)
+		request.Header.Set("X-User", user)
+		if got := s.Pick(request).Name; pool == "canary" && got != "canary" {
+			t.Errorf("Split.Pick() moved user %v from the canary to %v", user, got)
+		}
+	}
+	if got := canaryShare(s, 10000); got < 0.15 || got > 0.19 {
+		t.Errorf("Split.Pick() sent %.3f of the users to the canary, want about 0.17", got)
+	}
+
+	if err := s.SetWeight("canary", 0); err != nil {
+		t.Fatalf("Split.SetWeight() error = %v", err)
+	}
+	if got := canaryShare(s, 1000); got != 0 {
+		t.Errorf("Split.Pick() sent %.3f of the users to the canary, want 0", got)
+	}
+
+	if err := s.SetWeight("beta", 1); err != ErrUnknownPool {
+		t.Errorf("Split.SetWeight() error = %v, want %v", err, ErrUnknownPool)
+	}
+	if err := s.SetWeight("canary", -1); err != errNegativePoolWeight {
+		t.Errorf("Split.SetWeight() error = %v, want %v", err, errNegativePoolWeight)
+	}
+	want := map[string]int{"stable": 95, "canary": 0}
+	if got := s.Weights(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Split.Weights() = %v, want %v", got, want)
+	}
+}
+
+func TestRouter_ServeHTTP_split(t *testing.T) {
+	stable := newTestBackend("stable")
+	defer stable.Close()
+	canary := newTestBackend("canary")
+	defer canary.Close()
+
+	split := &Split{
+		Pools: []*SplitPool{
+			{Name: "stable", Weight: 1, Engine: &Engine{URLs: []string{stable.URL}}},
+			{Name: "canary", Weight: 0, Engine: &Engine{URLs: []string{canary.URL}}},
+		},
+		OverrideHeader: "X-Canary",
+		Overrides:      map[string]string{"always": "canary"},
+	}
+	router := &Router{Routes: []*Route{{PathPrefix: "/", Split: split}}}
+	if err := router.Setup(); err != nil {
+		t.Fatalf("Router.Setup() error = %v", err)
+	}
+	defer router.Close()
+
+	tests := []struct {
+		name     string
+		override string
+		want     string
+	}{
+		{name: "weights", want: "stable"},
+		{name: "override", override: "always", want: "canary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "http://flashx/", nil)
+			if tt.override != "" {
+				request.Header.Set("X-Canary", tt.override)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, request)
+			if w.Body.String() != tt.want {
+				t.Errorf("Router.ServeHTTP() body = %v, want %v", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSplit_ServeHTTP_trustedProxies(t *testing.T) {
+	stable := newTestBackend("stable")
+	defer stable.Close()
+	canary := newTestBackend("canary")
+	defer canary.Close()
+
+	newSplit := func(trustedProxies []string) *Split {
+		return &Split{
+			Pools: []*SplitPool{
+				{Name: "stable", Weight: 1, Engine: &Engine{URLs: []string{stable.URL}}},
+				{Name: "canary", Weight: 1, Engine: &Engine{URLs: []string{canary.URL}}},
+			},
+			TrustedProxies: trustedProxies,
+		}
+	}
+	split := newSplit([]string{"10.0.0.0/8"})
+	if err := split.Setup(); err != nil {
+		t.Fatalf("Split.Setup() error = %v", err)
+	}
+	defer split.Close()
+	router := &Router{
+		Routes:         []*Route{{PathPrefix: "/", Split: newSplit(nil)}},
+		TrustedProxies: []string{"10.0.0.0/8"},
+	}
+	if err := router.Setup(); err != nil {
+		t.Fatalf("Router.Setup() error = %v", err)
+	}
+	defer router.Close()
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+	}{
+		{name: "split", handler: split},
+		{name: "router", handler: router},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pools := make(map[string]int)
+			for i := 0; i < 200; i++ {
+				// every client comes through the same load balancer
+				request := httptest.NewRequest("GET", "http://flashx/", nil)
+				request.RemoteAddr = "10.0.0.1:5678"
+				request.Header.Set("X-Forwarded-For", "198.51.100."+strconv.Itoa(i))
+				w := httptest.NewRecorder()
+				tt.handler.ServeHTTP(w, request)
+				pools[w.Body.String()]++
+			}
+			if pools["stable"] < 50 || pools["canary"] < 50 {
+				t.Errorf("ServeHTTP() sent %v of the clients to the pools, want about half to each", pools)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package flashx
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// stickySecretLength is the length of the key generated
+// to sign sticky session cookies when no secret is set
+const stickySecretLength = 32
+
+func (e *Engine) setupStickySessions() error {
+	if e.StickySessionCookie == "" {
+		return nil
+	}
+	e.stickySecret = e.StickySessionSecret
+	if len(e.stickySecret) == 0 {
+		e.stickySecret = make([]byte, stickySecretLength)
+		if _, err := rand.Read(e.stickySecret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stickyURL returns the URL named by the sticky session cookie
+// of the request, or nil if there is no valid cookie or
+// the URL is no longer able to serve requests.
+// As with getURL, a probe of a half-open circuit is taken
+func (e *Engine) stickyURL(request *http.Request) *url.URL {
+	if e.StickySessionCookie == "" {
+		return nil
+	}
+	cookie, err := request.Cookie(e.StickySessionCookie)
+	if err != nil {
+		return nil
+	}
+	rawURL, ok := e.verifyStickyValue(cookie.Value)
+	if !ok {
+		return nil
+	}
+	for _, v := range e.availableURLs() {
+		if v.String() == rawURL && e.acquireURL(v) {
+			return v
+		}
+	}
+	return nil
+}
+
+// stickyCookieKey is the context key marking the requests whose
+// response sets the sticky session cookie
+type stickyCookieKey struct{}
+
+// withStickyCookie marks the request so that its response makes
+// the client stick to the URL that serves it, which may not be the
+// URL picked first if the request is retried or hedged
+func (e *Engine) withStickyCookie(request *http.Request) *http.Request {
+	if e.StickySessionCookie == "" {
+		return request
+	}
+	return request.WithContext(context.WithValue(request.Context(), stickyCookieKey{}, true))
+}
+
+// setStickyCookie makes the client stick to routeURL for the
+// subsequent requests, if the request of the response is marked
+func (e *Engine) setStickyCookie(response *http.Response, routeURL *url.URL) {
+	if response.Request == nil || response.Request.Context().Value(stickyCookieKey{}) == nil {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     e.StickySessionCookie,
+		Value:    e.signStickyValue(routeURL.String()),
+		Path:     "/",
+		HttpOnly: true,
+	}
+	response.Header.Add("Set-Cookie", cookie.String())
+}
+
+func (e *Engine) signStickyValue(rawURL string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(rawURL)) + "." +
+		base64.RawURLEncoding.EncodeToString(e.stickySignature(rawURL))
+}
+
+func (e *Engine) verifyStickyValue(value string) (string, bool) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	rawURL, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(signature, e.stickySignature(string(rawURL))) {
+		return "", false
+	}
+	return string(rawURL), true
+}
+
+func (e *Engine) stickySignature(rawURL string) []byte {
+	mac := hmac.New(sha256.New, e.stickySecret)
+	mac.Write([]byte(rawURL))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,180 @@
+package flashx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}))
+}
+
+func TestEngine_stickySessions(t *testing.T) {
+	first := newTestBackend("first")
+	defer first.Close()
+	second := newTestBackend("second")
+	defer second.Close()
+
+	e := &Engine{
+		URLs:                  []string{first.URL, second.URL},
+		LoadBalancingStrategy: RoundRobin,
+		StickySessionCookie:   "flashx",
+		StickySessionSecret:   []byte("secret"),
+	}
+	if err := e.Setup(); err != nil {
+		t.Fatalf("Engine.Setup() error = %v", err)
+	}
+
+	serve := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "http://flashx/", nil)
+		if cookie != nil {
+			request.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		e.Initiate(w, request)
+		return w
+	}
+
+	w := serve(nil)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "flashx" {
+		t.Fatalf("Engine.Initiate() cookies = %v, want a sticky session cookie", cookies)
+	}
+	sticky := cookies[0]
+	for i := 0; i < 4; i++ {
+		w := serve(sticky)
+		if got := w.Body.String(); got != "first" {
+			t.Errorf("Engine.Initiate() with sticky cookie routed to %v, want first", got)
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Errorf("Engine.Initiate() rewrote a valid sticky cookie")
+		}
+	}
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+	}{
+		{
+			name:   "tampered cookie",
+			cookie: &http.Cookie{Name: "flashx", Value: sticky.Value + "x"},
+		},
+		{
+			name:   "unknown URL",
+			cookie: &http.Cookie{Name: "flashx", Value: e.signStickyValue("http://localhost:1")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(tt.cookie)
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Value == tt.cookie.Value {
+				t.Errorf("Engine.Initiate() cookies = %v, want a rewritten sticky session cookie", cookies)
+			}
+		})
+	}
+}
+
+func TestEngine_stickySessions_servingURL(t *testing.T) {
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+	fast := newTestBackend("fast")
+	defer fast.Close()
+
+	tests := []struct {
+		name   string
+		engine *Engine
+	}{
+		{
+			name: "retried request",
+			engine: &Engine{
+				URLs:  []string{refused.URL, fast.URL},
+				Retry: &Retry{},
+			},
+		},
+		{
+			name: "hedged request",
+			engine: &Engine{
+				URLs:  []string{slow.URL, fast.URL},
+				Hedge: &Hedge{Delay: 20 * time.Millisecond},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := tt.engine
+			e.LoadBalancingStrategy = RoundRobin
+			e.StickySessionCookie = "flashx"
+			if err := e.Setup(); err != nil {
+				t.Fatalf("Engine.Setup() error = %v", err)
+			}
+			defer e.Close()
+
+			w := httptest.NewRecorder()
+			e.Initiate(w, httptest.NewRequest("GET", "http://flashx/", nil))
+			if got := w.Body.String(); got != "fast" {
+				t.Fatalf("Engine.Initiate() body = %q, want fast", got)
+			}
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("Engine.Initiate() cookies = %v, want a sticky session cookie", cookies)
+			}
+			if got, _ := e.verifyStickyValue(cookies[0].Value); got != fast.URL {
+				t.Errorf("Engine.Initiate() sticky URL = %v, want %v", got, fast.URL)
+			}
+		})
+	}
+}
+
+func TestEngine_verifyStickyValue(t *testing.T) {
+	e := &Engine{stickySecret: []byte("secret")}
+	other := &Engine{stickySecret: []byte("other")}
+	routeURL := &url.URL{
+		Scheme: "http",
+		Host:   "localhost:3000",
+	}
+	tests := []struct {
+		name   string
+		value  string
+		wantOK bool
+	}{
+		{
+			name:   "signed value",
+			value:  e.signStickyValue(routeURL.String()),
+			wantOK: true,
+		},
+		{
+			name:   "signed with another secret",
+			value:  other.signStickyValue(routeURL.String()),
+			wantOK: false,
+		},
+		{
+			name:   "unsigned value",
+			value:  routeURL.String(),
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := e.verifyStickyValue(tt.value)
+			if ok != tt.wantOK {
+				t.Fatalf("Engine.verifyStickyValue() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && got != routeURL.String() {
+				t.Errorf("Engine.verifyStickyValue() = %v, want %v", got, routeURL.String())
+			}
+		})
+	}
+}